@@ -0,0 +1,96 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gojoin/models"
+)
+
+// listAllSubs lets admins search through the subscriptions of all users. The
+// filters are all optional and combined, the user is included in the results.
+func listAllSubs(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	page, httpErr := paginate(r)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
+	subsTable := models.Subscription{}.TableName()
+	usersTable := models.User{}.TableName()
+	query := getDB(ctx).Model(&models.Subscription{}).
+		Joins("LEFT JOIN " + usersTable + " ON " + usersTable + ".id = " + subsTable + ".user_id AND " +
+			usersTable + ".tenant_id = " + subsTable + ".tenant_id")
+	query = forTenant(ctx, query, subsTable+".tenant_id")
+
+	params := r.URL.Query()
+	filters := []struct {
+		param  string
+		column string
+	}{
+		{"type", subsTable + ".type"},
+		{"plan", subsTable + ".plan"},
+		{"status", subsTable + ".status"},
+		{"user_id", subsTable + ".user_id"},
+		{"email", usersTable + ".email"},
+	}
+	for _, f := range filters {
+		if v := params.Get(f.param); v != "" {
+			query = query.Where(f.column+" = ?", v)
+		}
+	}
+
+	total := 0
+	if rsp := query.Count(&total); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to count subscriptions")
+		writeError(w, http.StatusInternalServerError, "DB error while searching for subscriptions")
+		return
+	}
+
+	subs := []models.Subscription{}
+	rsp := page.apply(query).
+		Select(subsTable + ".*").
+		Order(subsTable + ".created_at desc").
+		Preload("Items").
+		Find(&subs)
+	if rsp.Error == nil {
+		rsp.Error = attachUsers(getDB(ctx), subs)
+	}
+	if rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to search subscriptions")
+		writeError(w, http.StatusInternalServerError, "DB error while searching for subscriptions")
+		return
+	}
+
+	page.setHeaders(w, r, total)
+	sendJSON(w, http.StatusOK, subs)
+}
+
+// attachUsers loads the user of every subscription. Users are keyed by their
+// tenant and id, so preloading by the id alone could attach another tenant's user.
+func attachUsers(db *gorm.DB, subs []models.Subscription) error {
+	if len(subs) == 0 {
+		return nil
+	}
+	tenantIDs := []string{}
+	userIDs := []string{}
+	for _, sub := range subs {
+		tenantIDs = append(tenantIDs, sub.TenantID)
+		userIDs = append(userIDs, sub.UserID)
+	}
+
+	users := []models.User{}
+	if rsp := db.Where("tenant_id IN (?) AND id IN (?)", tenantIDs, userIDs).Find(&users); rsp.Error != nil {
+		return rsp.Error
+	}
+	byKey := map[[2]string]*models.User{}
+	for i := range users {
+		byKey[[2]string{users[i].TenantID, users[i].ID}] = &users[i]
+	}
+	for i := range subs {
+		subs[i].User = byKey[[2]string{subs[i].TenantID, subs[i].UserID}]
+	}
+	return nil
+}
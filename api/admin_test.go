@@ -0,0 +1,145 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/netlify/gojoin/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdminListAndViewSubs(t *testing.T) {
+	tu := createUser("batman", "bruce@dc.com", "eulav-epits-emos")
+	s1 := createSubscription("batman", "membership", "nonsense")
+	s2 := createSubscription(testUserID, "membership", "other-nonsense")
+	defer cleanup(s1, s2, tu)
+
+	body := new(getAllResponse)
+	extractPayload(t, request(t, "GET", "/admin/users/batman/subscriptions", nil, true), body)
+	if assert.Len(t, body.Subscriptions, 1) {
+		validateSub(t, s1, &body.Subscriptions[0])
+	}
+	assert.Empty(t, body.Token)
+
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "GET", "/admin/users/batman/subscriptions/membership", nil, true), sub)
+	validateSub(t, s1, sub)
+}
+
+func TestAdminCreateAndModifySub(t *testing.T) {
+	tp := &testProxy{createSubID: "remote-id", createCustomerID: "remote-user-id", updateSubID: "remote-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	payload := &subscriptionRequest{
+		StripeKey: "something",
+		Plan:      "gold",
+	}
+	rsp := request(t, "PUT", "/admin/users/batman/subscriptions/membership", payload, true)
+	extractError(t, http.StatusBadRequest, rsp)
+	assert.Empty(t, tp.createCustomerCalls)
+
+	payload.Email = "bruce@dc.com"
+	rsp = request(t, "PUT", "/admin/users/batman/subscriptions/membership", payload, true)
+	dbSub, dbUser := validateResponseAndDBVal(t, rsp, &models.Subscription{
+		Type:     "membership",
+		UserID:   "batman",
+		Plan:     "gold",
+		RemoteID: "remote-id",
+		Status:   models.StatusActive,
+	}, &models.User{
+		ID:       "batman",
+		Email:    "bruce@dc.com",
+		RemoteID: "remote-user-id",
+	})
+	defer cleanup(dbSub, dbUser)
+
+	if assert.Len(t, tp.createCustomerCalls, 1) {
+		assert.Equal(t, "batman", tp.createCustomerCalls[0].userID)
+	}
+
+	payload.Plan = "silver"
+	rsp = request(t, "PUT", "/admin/users/batman/subscriptions/membership", payload, true)
+	sub := new(models.Subscription)
+	extractPayload(t, rsp, sub)
+	assert.Equal(t, "silver", sub.Plan)
+	assert.Len(t, tp.updateCalls, 1)
+
+	// the admin's own subscriptions are untouched
+	own, _ := getSubscriptionForTest(testUserID, "membership")
+	assert.Nil(t, own)
+}
+
+func TestAdminDeleteSub(t *testing.T) {
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser("batman", "bruce@dc.com", "eulav-epits-emos")
+	s1 := createSubscription("batman", "membership", "nonsense")
+	defer cleanup(s1, tu)
+
+	rsp := request(t, "DELETE", "/admin/users/batman/subscriptions/membership", nil, true)
+	assert.Equal(t, http.StatusAccepted, rsp.StatusCode)
+	if assert.Len(t, tp.deleteCalls, 1) {
+		assert.Equal(t, s1.RemoteID, tp.deleteCalls[0])
+	}
+}
+
+func TestAdminEndpointsRequireAdmin(t *testing.T) {
+	for _, method := range []string{"GET", "PUT", "DELETE"} {
+		rsp := request(t, method, "/admin/users/batman/subscriptions/membership", nil, false)
+		extractError(t, http.StatusForbidden, rsp)
+	}
+	rsp := request(t, "GET", "/admin/users/batman/subscriptions", nil, false)
+	extractError(t, http.StatusForbidden, rsp)
+}
+
+func getSubscriptionForTest(userID, subType string) (*models.Subscription, error) {
+	sub := new(models.Subscription)
+	rsp := db.Where("user_id = ? AND type = ?", userID, subType).First(sub)
+	if rsp.RecordNotFound() {
+		return nil, nil
+	}
+	return sub, rsp.Error
+}
+
+func TestAdminSearchSubs(t *testing.T) {
+	tu1 := createUser(testUserID, testUserEmail, "some-stripe-value")
+	tu2 := createUser("batman", "bruce@dc.com", "eulav-epits-emos")
+	s1 := createSubscription(testUserID, "membership", "gold")
+	s2 := createSubscription(testUserID, "revenue", "gold")
+	s3 := createSubscription("batman", "membership", "gold")
+	s4 := createSubscription("batman", "revenue", "silver")
+	defer cleanup(s1, s2, s3, s4, tu1, tu2)
+
+	subs := []models.Subscription{}
+	rsp := request(t, "GET", "/admin/subscriptions?plan=gold", nil, true)
+	assert.Equal(t, "3", rsp.Header.Get("X-Total-Count"))
+	extractPayload(t, rsp, &subs)
+	assert.Len(t, subs, 3)
+
+	subs = []models.Subscription{}
+	extractPayload(t, request(t, "GET", "/admin/subscriptions?plan=gold&email=bruce@dc.com", nil, true), &subs)
+	if assert.Len(t, subs, 1) {
+		validateSub(t, s3, &subs[0])
+		if assert.NotNil(t, subs[0].User) {
+			assert.Equal(t, "bruce@dc.com", subs[0].User.Email)
+		}
+	}
+
+	subs = []models.Subscription{}
+	rsp = request(t, "GET", "/admin/subscriptions?type=membership&per_page=1&page=2", nil, true)
+	assert.Equal(t, "2", rsp.Header.Get("X-Total-Count"))
+	link := rsp.Header.Get("Link")
+	assert.Contains(t, link, `rel="prev"`)
+	assert.Contains(t, link, `rel="first"`)
+	assert.NotContains(t, link, `rel="next"`)
+	extractPayload(t, rsp, &subs)
+	assert.Len(t, subs, 1)
+
+	rsp = request(t, "GET", "/admin/subscriptions?page=0", nil, true)
+	extractError(t, http.StatusBadRequest, rsp)
+
+	rsp = request(t, "GET", "/admin/subscriptions", nil, false)
+	extractError(t, http.StatusForbidden, rsp)
+}
@@ -16,6 +16,7 @@ import (
 
 	"github.com/jinzhu/gorm"
 	"github.com/netlify/gojoin/conf"
+	"github.com/netlify/gojoin/models"
 	"github.com/zenazn/goji/web/mutil"
 )
 
@@ -25,7 +26,8 @@ type API struct {
 	port       int
 	handler    http.Handler
 	db         *gorm.DB
-	payerProxy payerProxy
+	payerProxy PayerProxy
+	tenants    *tenantRegistry
 	version    string
 }
 
@@ -38,15 +40,23 @@ type JWTClaims struct {
 var bearerRegexp = regexp.MustCompile(`^(?:B|b)earer (\S+$)`)
 var signingMethod = jwt.SigningMethodHS256
 
-func NewAPI(config *conf.Config, db *gorm.DB, proxy payerProxy, version string) *API {
+// NewAPI builds the API. In multi-tenant mode every tenant has its own payer
+// and the proxy can be nil.
+func NewAPI(config *conf.Config, db *gorm.DB, proxy PayerProxy, version string) *API {
 	api := &API{
 		log:        logrus.WithField("component", "api"),
 		config:     config,
 		port:       config.Port,
 		db:         db,
-		payerProxy: proxy,
+		payerProxy: errorProxy{},
 		version:    version,
 	}
+	if proxy != nil {
+		api.payerProxy = withRetries(proxy, config.ProviderCalls)
+	}
+	if config.MultiTenant {
+		api.tenants = newTenantRegistry(config, db)
+	}
 
 	k := kami.New()
 	k.LogHandler = logCompleted
@@ -58,12 +68,74 @@ func NewAPI(config *conf.Config, db *gorm.DB, proxy payerProxy, version string)
 
 	k.Get("/subscriptions", listSubs)
 	k.Get("/subscriptions/:type", viewSub)
-	k.Put("/subscriptions/:type", createOrModSub)
-	k.Delete("/subscriptions/:type", deleteSub)
+	k.Put("/subscriptions/:type", idempotent(createOrModSub))
+	k.Delete("/subscriptions/:type", idempotent(deleteSub))
+	k.Post("/subscriptions/:type/reactivate", idempotent(reactivateSub))
+	k.Post("/subscriptions/:type/pause", idempotent(pauseSub))
+	k.Post("/subscriptions/:type/resume", idempotent(resumeSub))
+	k.Post("/subscriptions/:type/items", idempotent(addItem))
+	k.Delete("/subscriptions/:type/items/:plan", idempotent(removeItem))
+	k.Post("/subscriptions/:type/preview", previewSub)
+
+	k.Use("/payment_method", api.populateConfig)
+	k.Put("/payment_method", idempotent(updatePaymentMethod))
+
+	k.Use("/payment_methods/", api.populateConfig)
+	k.Use("/payment_methods", api.populateConfig)
+	k.Get("/payment_methods", listPaymentMethods)
+	k.Post("/payment_methods", idempotent(addPaymentMethod))
+	k.Delete("/payment_methods/:id", idempotent(deletePaymentMethod))
+	k.Put("/payment_methods/:id/default", idempotent(setDefaultPaymentMethod))
+
+	k.Use("/invoices/", api.populateConfig)
+	k.Use("/invoices", api.populateConfig)
+	k.Get("/invoices", listInvoices)
+	k.Get("/invoices/:id", viewInvoice)
+
+	k.Use("/plans", api.populatePublicConfig)
+	k.Use("/plans/", api.populatePublicConfig)
+	k.Get("/plans", listPlans)
+	k.Get("/plans/:type", viewPlans)
+
+	k.Use("/coupons/", api.populateConfig)
+	k.Get("/coupons/:code", viewCoupon)
+
+	k.Use("/admin/", api.populateConfig)
+	k.Use("/admin/", requireAdmin)
+	k.Get("/admin/subscriptions", listAllSubs)
+	k.Use("/admin/users/:user_id/", api.populateTargetUser)
+	k.Get("/admin/users/:user_id/subscriptions", adminListSubs)
+	k.Get("/admin/users/:user_id/subscriptions/:type", viewSub)
+	k.Put("/admin/users/:user_id/subscriptions/:type", idempotent(createOrModSub))
+	k.Delete("/admin/users/:user_id/subscriptions/:type", idempotent(deleteSub))
+	k.Post("/admin/users/:user_id/subscriptions/:type/reactivate", idempotent(reactivateSub))
+	k.Post("/admin/users/:user_id/subscriptions/:type/pause", idempotent(pauseSub))
+	k.Post("/admin/users/:user_id/subscriptions/:type/resume", idempotent(resumeSub))
+	k.Post("/admin/users/:user_id/subscriptions/:type/items", idempotent(addItem))
+	k.Delete("/admin/users/:user_id/subscriptions/:type/items/:plan", idempotent(removeItem))
+	k.Post("/admin/users/:user_id/subscriptions/:type/preview", previewSub)
+	k.Put("/admin/users/:user_id/payment_method", idempotent(updatePaymentMethod))
+	k.Get("/admin/users/:user_id/payment_methods", listPaymentMethods)
+	k.Post("/admin/users/:user_id/payment_methods", idempotent(addPaymentMethod))
+	k.Delete("/admin/users/:user_id/payment_methods/:id", idempotent(deletePaymentMethod))
+	k.Put("/admin/users/:user_id/payment_methods/:id/default", idempotent(setDefaultPaymentMethod))
+	k.Get("/admin/users/:user_id/invoices", listInvoices)
+	k.Get("/admin/users/:user_id/invoices/:id", viewInvoice)
+	k.Get("/admin/audit_log", listAuditLog)
+	k.Get("/admin/failed_writes", listFailedWrites)
+	k.Post("/admin/failed_writes/:id/retry", retryFailedWriteNow)
 
+	k.Use("/webhooks/", api.populateWebhookConfig)
+	k.Post("/webhooks/stripe", stripeWebhook)
+
+	allowedHeaders := []string{"Accept", "Authorization", "Content-Type", idempotencyKeyHeader}
+	if config.MultiTenant {
+		allowedHeaders = append(allowedHeaders, config.TenantHeader)
+	}
 	corsHandler := cors.New(cors.Options{
 		AllowedMethods:   []string{"GET", "POST", "PATCH", "PUT", "DELETE"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type"},
+		AllowedHeaders:   allowedHeaders,
+		ExposedHeaders:   []string{"Link", "X-Total-Count"},
 		AllowCredentials: true,
 	})
 
@@ -74,6 +146,8 @@ func NewAPI(config *conf.Config, db *gorm.DB, proxy payerProxy, version string)
 func (a *API) Serve() error {
 	l := fmt.Sprintf(":%d", a.port)
 	a.log.Infof("GoJoin API started on: %s", l)
+	go a.retryFailedWrites(failedWriteRetryInterval)
+	go a.applyScheduledChanges(scheduledChangeInterval)
 	return http.ListenAndServe(l, a.handler)
 }
 
@@ -89,22 +163,34 @@ func logCompleted(ctx context.Context, wp mutil.WriterProxy, r *http.Request) {
 }
 
 func (a *API) populateConfig(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
-	reqID := uuid.NewRandom().String()
-	log := a.log.WithFields(logrus.Fields{
-		"request_id": reqID,
-		"method":     r.Method,
-		"path":       r.URL.Path,
-	})
-	log.Info("Started request")
-
-	ctx = setRequestID(ctx, reqID)
-	ctx = setStartTime(ctx, time.Now())
-	ctx = setConfig(ctx, a.config)
-	ctx = setDB(ctx, a.db)
+	ctx, log := a.startRequest(ctx, r)
 
-	ctx = setPayerProxy(ctx, a.payerProxy)
+	var t *tenant
+	secret := func(*JWTClaims) (string, error) { return a.config.JWTSecret, nil }
+	if a.config.MultiTenant {
+		var httpErr *HTTPError
+		if t, httpErr = a.requestTenant(r); httpErr != nil {
+			log.Info(httpErr.Message)
+			sendJSON(w, httpErr.Code, httpErr)
+			return nil
+		}
+		secret = func(claims *JWTClaims) (string, error) {
+			if t == nil {
+				// the aud names the tenant when the header and host don't
+				found, err := a.tenants.find(claims.Audience)
+				if err != nil {
+					return "", err
+				}
+				if found == nil {
+					return "", fmt.Errorf("Unknown tenant %s", claims.Audience)
+				}
+				t = found
+			}
+			return t.config.JWTSecret, nil
+		}
+	}
 
-	token, err := extractToken(a.config.JWTSecret, r)
+	token, err := parseToken(r, secret)
 	if err != nil {
 		log.WithError(err).Info("Failed to parse token")
 		sendJSON(w, err.Code, err)
@@ -123,10 +209,14 @@ func (a *API) populateConfig(ctx context.Context, w http.ResponseWriter, r *http
 		writeError(w, http.StatusBadRequest, "JWT Token must contain a sub")
 		return nil
 	}
+	if t != nil {
+		ctx = useTenant(ctx, t)
+		log = getLogger(ctx)
+	}
 
 	adminFlag := false
 	for _, g := range claims.Groups {
-		if g == a.config.AdminGroupName {
+		if g == getConfig(ctx).AdminGroupName {
 			adminFlag = true
 			break
 		}
@@ -142,7 +232,83 @@ func (a *API) populateConfig(ctx context.Context, w http.ResponseWriter, r *http
 	return ctx
 }
 
+// startRequest sets up everything a request needs that doesn't depend on
+// the caller being authenticated.
+func (a *API) startRequest(ctx context.Context, r *http.Request) (context.Context, *logrus.Entry) {
+	reqID := uuid.NewRandom().String()
+	log := a.log.WithFields(logrus.Fields{
+		"request_id": reqID,
+		"method":     r.Method,
+		"path":       r.URL.Path,
+	})
+	log.Info("Started request")
+
+	ctx = setRequestID(ctx, reqID)
+	ctx = setStartTime(ctx, time.Now())
+	ctx = setConfig(ctx, a.config)
+	ctx = setDB(ctx, a.db)
+	ctx = setLogger(ctx, log)
+
+	ctx = setPayerProxy(ctx, a.payerProxy)
+
+	return ctx, log
+}
+
+// populatePublicConfig is the middleware for the endpoints anyone can call, like
+// the plan catalog that is shown before signing up
+func (a *API) populatePublicConfig(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	ctx, _ = a.startRequest(ctx, r)
+	return a.requireTenant(ctx, w, r)
+}
+
+// populateWebhookConfig is the middleware for the webhook endpoints. These are
+// called by the payment provider, so there is no JWT; each handler verifies the
+// request itself. With several tenants the host or header of the webhook names
+// the tenant.
+func (a *API) populateWebhookConfig(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	ctx, _ = a.startRequest(ctx, r)
+	return a.requireTenant(ctx, w, r)
+}
+
+// requireAdmin must come after populateConfig, it stops any request from a user
+// that isn't in the admin group.
+func requireAdmin(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	if !isAdmin(ctx) {
+		getLogger(ctx).Info("Attempted to make admin request as a non-admin")
+		writeError(w, http.StatusForbidden, "Must be an admin to access this endpoint")
+		return nil
+	}
+	return ctx
+}
+
+// populateTargetUser makes the admin endpoints act on the user in the path
+// instead of the user in the token.
+func (a *API) populateTargetUser(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	userID := kami.Param(ctx, "user_id")
+	target := &targetUser{ID: userID}
+
+	user := new(models.User)
+	if rsp := forTenant(ctx, getDB(ctx), "tenant_id").Where("id = ?", userID).First(user); rsp.Error != nil {
+		if !rsp.RecordNotFound() {
+			getLogger(ctx).WithError(rsp.Error).Warnf("Failed to find user %s", userID)
+			writeError(w, http.StatusInternalServerError, "Failed to find the user specified")
+			return nil
+		}
+	} else {
+		target.Email = user.Email
+	}
+
+	ctx = setLogger(ctx, getLogger(ctx).WithField("target_user_id", userID))
+	return setTargetUser(ctx, target)
+}
+
 func extractToken(secret string, r *http.Request) (*jwt.Token, *HTTPError) {
+	return parseToken(r, func(*JWTClaims) (string, error) { return secret, nil })
+}
+
+// parseToken verifies the token of the request with the secret for its claims,
+// the claims aren't verified yet when the secret is picked
+func parseToken(r *http.Request, secret func(*JWTClaims) (string, error)) (*jwt.Token, *HTTPError) {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		return nil, nil
@@ -157,7 +323,11 @@ func extractToken(secret string, r *http.Request) (*jwt.Token, *HTTPError) {
 		if token.Header["alg"] != signingMethod.Name {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(secret), nil
+		key, err := secret(token.Claims.(*JWTClaims))
+		if err != nil {
+			return nil, err
+		}
+		return []byte(key), nil
 	})
 	if err != nil {
 		return nil, httpError(http.StatusUnauthorized, "Invalid Token")
@@ -39,8 +39,9 @@ func TestMain(m *testing.M) {
 	defer os.Remove(f.Name())
 
 	config = &conf.Config{
-		AdminGroupName: "admin",
-		JWTSecret:      "secret",
+		AdminGroupName:      "admin",
+		JWTSecret:           "secret",
+		StripeWebhookSecret: "whsec_test",
 		DBConfig: conf.DBConfig{
 			Automigrate: true,
 			Namespace:   "test",
@@ -152,6 +153,10 @@ func TestGetHello(t *testing.T) {
 // ------------------------------------------------------------------------------------------------
 
 func request(t *testing.T, method, path string, body interface{}, isAdmin bool) *http.Response {
+	return requestWithHeaders(t, method, path, body, isAdmin, nil)
+}
+
+func requestWithHeaders(t *testing.T, method, path string, body interface{}, isAdmin bool, headers map[string]string) *http.Response {
 	var r *http.Request
 	if body != nil {
 		b, err := json.Marshal(body)
@@ -165,6 +170,9 @@ func request(t *testing.T, method, path string, body interface{}, isAdmin bool)
 	}
 	tokenString := testToken(t, testUserID, testUserEmail, config.JWTSecret, isAdmin)
 	r.Header.Add("Authorization", "Bearer "+tokenString)
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
 
 	rsp, err := client.Do(r)
 	if !assert.NoError(t, err) {
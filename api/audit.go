@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/netlify/gojoin/models"
+)
+
+// the actor for changes that come from stripe's webhooks
+const stripeActor = "stripe"
+
+// audit records a change to a subscription made by the user in the token. Failing
+// to write the audit log is logged, but doesn't fail the change.
+func audit(ctx context.Context, action string, sub *models.Subscription, oldPlan string) {
+	actor := ""
+	if token, ok := ctx.Value(tokenKey).(*jwt.Token); ok {
+		actor = token.Claims.(*JWTClaims).Subject
+	}
+	auditAs(ctx, actor, action, sub, oldPlan)
+}
+
+// auditAs records a change made by the actor, it is marked as an admin change
+// when it was made through the admin endpoints
+func auditAs(ctx context.Context, actor, action string, sub *models.Subscription, oldPlan string) {
+	entry := &models.AuditLogEntry{
+		Actor:     actor,
+		Admin:     hasTargetUser(ctx),
+		Action:    action,
+		OldPlan:   oldPlan,
+		RequestID: getRequestID(ctx),
+	}
+	if err := models.RecordAudit(getDB(ctx), entry, sub); err != nil {
+		getLogger(ctx).WithError(err).Warnf("Failed to write audit log entry: %+v", entry)
+	}
+}
+
+// auditPaymentMethod records a change to the payment methods of the user
+func auditPaymentMethod(ctx context.Context, action string, user *models.User, remoteID string) {
+	audit(ctx, action, &models.Subscription{UserID: user.ID, TenantID: user.TenantID, RemoteID: remoteID}, "")
+}
+
+func listAuditLog(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	page, httpErr := paginate(r)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
+	query := forTenant(ctx, getDB(ctx).Model(&models.AuditLogEntry{}), "tenant_id")
+	params := r.URL.Query()
+	filters := []struct {
+		param  string
+		column string
+	}{
+		{"user_id", "target_user_id"},
+		{"actor", "actor"},
+		{"type", "type"},
+		{"action", "action"},
+		{"request_id", "request_id"},
+	}
+	for _, f := range filters {
+		if v := params.Get(f.param); v != "" {
+			query = query.Where(f.column+" = ?", v)
+		}
+	}
+
+	total := 0
+	if rsp := query.Count(&total); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to count audit log entries")
+		writeError(w, http.StatusInternalServerError, "DB error while searching the audit log")
+		return
+	}
+
+	entries := []models.AuditLogEntry{}
+	if rsp := page.apply(query).Order("created_at desc").Find(&entries); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to search the audit log")
+		writeError(w, http.StatusInternalServerError, "DB error while searching the audit log")
+		return
+	}
+
+	page.setHeaders(w, r, total)
+	sendJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/netlify/gojoin/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLogOfSubscriptionChanges(t *testing.T) {
+	clearAuditLog()
+	tp := &testProxy{createSubID: "remote-id", createCustomerID: "remote-user-id", updateSubID: "remote-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	payload := &subscriptionRequest{StripeKey: "something", Plan: "gold"}
+	rsp := request(t, "PUT", "/subscriptions/membership", payload, false)
+	dbSub, dbUser := validateResponseAndDBVal(t, rsp, &models.Subscription{
+		Type:     "membership",
+		UserID:   testUserID,
+		Plan:     "gold",
+		RemoteID: "remote-id",
+		Status:   models.StatusActive,
+	}, &models.User{
+		ID:       testUserID,
+		Email:    testUserEmail,
+		RemoteID: "remote-user-id",
+	})
+	defer cleanup(dbSub, dbUser)
+
+	payload.Plan = "silver"
+	rsp = request(t, "PUT", "/admin/users/"+testUserID+"/subscriptions/membership", payload, true)
+	extractPayload(t, rsp, new(models.Subscription))
+
+	rsp = request(t, "DELETE", "/subscriptions/membership", nil, false)
+	assert.Equal(t, http.StatusAccepted, rsp.StatusCode)
+
+	entries := []models.AuditLogEntry{}
+	db.Order("created_at asc").Find(&entries)
+	if !assert.Len(t, entries, 3) {
+		return
+	}
+
+	for _, e := range entries {
+		assert.Equal(t, testUserID, e.Actor)
+		assert.Equal(t, testUserID, e.TargetUserID)
+		assert.Equal(t, "membership", e.Type)
+		assert.Equal(t, "remote-id", e.RemoteID)
+		assert.NotEmpty(t, e.RequestID)
+	}
+
+	assert.Equal(t, models.AuditCreate, entries[0].Action)
+	assert.Equal(t, "gold", entries[0].NewPlan)
+	assert.False(t, entries[0].Admin)
+
+	assert.Equal(t, models.AuditUpdate, entries[1].Action)
+	assert.Equal(t, "gold", entries[1].OldPlan)
+	assert.Equal(t, "silver", entries[1].NewPlan)
+	assert.True(t, entries[1].Admin)
+
+	assert.Equal(t, models.AuditCancel, entries[2].Action)
+	assert.Equal(t, "silver", entries[2].OldPlan)
+	assert.Empty(t, entries[2].NewPlan)
+	assert.False(t, entries[2].Admin)
+}
+
+func TestAdminChangesAreMarkedInAuditLog(t *testing.T) {
+	clearAuditLog()
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser("batman", "bruce@dc.com", "eulav-epits-emos")
+	s1 := createSubscription("batman", "membership", "nonsense")
+	defer cleanup(s1, tu)
+
+	rsp := request(t, "DELETE", "/admin/users/batman/subscriptions/membership", nil, true)
+	assert.Equal(t, http.StatusAccepted, rsp.StatusCode)
+
+	entries := []models.AuditLogEntry{}
+	db.Find(&entries)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, testUserID, entries[0].Actor)
+		assert.True(t, entries[0].Admin)
+		assert.Equal(t, "batman", entries[0].TargetUserID)
+		assert.Equal(t, s1.RemoteID, entries[0].RemoteID)
+	}
+}
+
+func TestListAuditLog(t *testing.T) {
+	clearAuditLog()
+	s1 := &models.Subscription{UserID: "batman", Type: "membership", Plan: "gold", RemoteID: "remote-1"}
+	s2 := &models.Subscription{UserID: "robin", Type: "membership", Plan: "silver", RemoteID: "remote-2"}
+	models.RecordAudit(db, &models.AuditLogEntry{Actor: "batman", Action: models.AuditCreate}, s1)
+	models.RecordAudit(db, &models.AuditLogEntry{Actor: stripeActor, Action: models.AuditCancel}, s2)
+
+	extractError(t, http.StatusForbidden, request(t, "GET", "/admin/audit_log", nil, false))
+
+	entries := []models.AuditLogEntry{}
+	rsp := request(t, "GET", "/admin/audit_log", nil, true)
+	assert.Equal(t, "2", rsp.Header.Get("X-Total-Count"))
+	extractPayload(t, rsp, &entries)
+	assert.Len(t, entries, 2)
+
+	rsp = request(t, "GET", "/admin/audit_log?user_id=robin", nil, true)
+	extractPayload(t, rsp, &entries)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, stripeActor, entries[0].Actor)
+		assert.Equal(t, "silver", entries[0].OldPlan)
+	}
+}
+
+func clearAuditLog() {
+	db.Delete(models.AuditLogEntry{})
+}
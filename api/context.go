@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/sirupsen/logrus"
 	"github.com/netlify/gojoin/conf"
+	"github.com/sirupsen/logrus"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/jinzhu/gorm"
@@ -13,15 +13,20 @@ import (
 )
 
 const (
-	dbKey         = "db"
-	startTimeKey  = "start_time"
-	versionKey    = "app_version"
-	configKey     = "app_config"
-	loggerKey     = "app_logger"
-	reqIDKey      = "request_id"
-	adminFlagKey  = "admin_flag"
-	tokenKey      = "token"
-	payerProxyKey = "payer_proxy"
+	dbKey          = "db"
+	startTimeKey   = "start_time"
+	versionKey     = "app_version"
+	configKey      = "app_config"
+	loggerKey      = "app_logger"
+	reqIDKey       = "request_id"
+	adminFlagKey   = "admin_flag"
+	tokenKey       = "token"
+	payerProxyKey  = "payer_proxy"
+	idempotencyKey = "idempotency_key"
+	targetUserKey  = "target_user"
+	tenantIDKey    = "tenant_id"
+	keepKeyKey     = "keep_idempotency_key"
+	callKeyKey     = "call_idempotency_key"
 )
 
 func setStartTime(ctx context.Context, startTime time.Time) context.Context {
@@ -115,13 +120,91 @@ func setToken(ctx context.Context, token *jwt.Token) context.Context {
 	return context.WithValue(ctx, tokenKey, token)
 }
 
-func setPayerProxy(ctx context.Context, proxy payerProxy) context.Context {
+func setPayerProxy(ctx context.Context, proxy PayerProxy) context.Context {
 	return context.WithValue(ctx, payerProxyKey, proxy)
 }
-func getPayerProxy(ctx context.Context) payerProxy {
+func getPayerProxy(ctx context.Context) PayerProxy {
 	obj := ctx.Value(payerProxyKey)
 	if obj == nil {
 		return &errorProxy{}
 	}
-	return obj.(payerProxy)
+	return obj.(PayerProxy)
+}
+
+func setIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey, key)
+}
+
+// getIdempotencyKey returns the key scoped to the user, it is safe to send to
+// the payer. It is empty if the request didn't have one.
+func getIdempotencyKey(ctx context.Context) string {
+	obj := ctx.Value(idempotencyKey)
+	if obj == nil {
+		return ""
+	}
+	return getClaims(ctx).Subject + ":" + obj.(string)
+}
+
+func setCallKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, callKeyKey, key)
+}
+
+// getCallKey is the idempotency key shared by the attempts of a change with the
+// payer, it is empty outside of one
+func getCallKey(ctx context.Context) string {
+	obj := ctx.Value(callKeyKey)
+	if obj == nil {
+		return ""
+	}
+	return obj.(string)
+}
+
+func setKeepIdempotencyKey(ctx context.Context, keep *bool) context.Context {
+	return context.WithValue(ctx, keepKeyKey, keep)
+}
+
+// keepIdempotencyKey stores the response for the key of the request even if it
+// is a server error. Once a change was rolled back or queued the key can't be
+// used again, the payer would replay the change for it.
+func keepIdempotencyKey(ctx context.Context) {
+	if keep, ok := ctx.Value(keepKeyKey).(*bool); ok {
+		*keep = true
+	}
+}
+
+// targetUser is the user whose subscriptions a request acts on. That is
+// the user in the token, unless an admin acts on behalf of someone else.
+type targetUser struct {
+	ID    string
+	Email string
+}
+
+func setTargetUser(ctx context.Context, user *targetUser) context.Context {
+	return context.WithValue(ctx, targetUserKey, user)
+}
+func getTargetUser(ctx context.Context) *targetUser {
+	obj := ctx.Value(targetUserKey)
+	if obj == nil {
+		claims := getClaims(ctx)
+		return &targetUser{ID: claims.Subject, Email: claims.Email}
+	}
+	return obj.(*targetUser)
+}
+
+// hasTargetUser is true for the admin endpoints that act on a user by id
+func hasTargetUser(ctx context.Context) bool {
+	return ctx.Value(targetUserKey) != nil
+}
+
+func setTenantID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, tenantIDKey, id)
+}
+
+// getTenantID is the tenant the request is for, it is empty with a single tenant
+func getTenantID(ctx context.Context) string {
+	obj := ctx.Value(tenantIDKey)
+	if obj == nil {
+		return ""
+	}
+	return obj.(string)
 }
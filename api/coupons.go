@@ -0,0 +1,32 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/guregu/kami"
+)
+
+// viewCoupon shows the discount of a promotion code or coupon, so it can be
+// shown before subscribing. Promotion codes are tried first since they are
+// what customers get to see.
+func viewCoupon(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	code := kami.Param(ctx, "code")
+	pp := getPayerProxy(ctx)
+
+	coupon, err := pp.GetPromotionCode(ctx, code)
+	if err == ErrCouponNotFound {
+		coupon, err = pp.GetCoupon(ctx, code)
+	}
+	if err != nil {
+		if err == ErrCouponNotFound {
+			notFoundError(w, "No coupon found for %s", code)
+			return
+		}
+		getLogger(ctx).WithError(err).WithField("coupon", code).Warn("Failed to look up coupon in stripe")
+		writeError(w, http.StatusInternalServerError, "Error communicating with stripe: %s", err)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, coupon)
+}
@@ -0,0 +1,101 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/netlify/gojoin/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func testCouponProxy() *testProxy {
+	return &testProxy{
+		createSubID:      "remote-id",
+		createCustomerID: "remote-user-id",
+		updateSubID:      "remote-id",
+		coupons: map[string]*Coupon{
+			"half-off": {ID: "half-off", PercentOff: 50, Duration: "once", Valid: true},
+			"expired":  {ID: "expired", PercentOff: 10, Duration: "forever"},
+		},
+		promotionCodes: map[string]*Coupon{
+			"WELCOME": {ID: "half-off", PromotionCode: "promo_welcome", PercentOff: 50, Duration: "once", Valid: true},
+		},
+	}
+}
+
+func TestViewCoupon(t *testing.T) {
+	api.payerProxy = testCouponProxy()
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	coupon := new(Coupon)
+	extractPayload(t, request(t, "GET", "/coupons/WELCOME", nil, false), coupon)
+	assert.Equal(t, "half-off", coupon.ID)
+	assert.Equal(t, "promo_welcome", coupon.PromotionCode)
+	assert.Equal(t, 50, coupon.PercentOff)
+
+	coupon = new(Coupon)
+	extractPayload(t, request(t, "GET", "/coupons/expired", nil, false), coupon)
+	assert.Equal(t, "expired", coupon.ID)
+	assert.False(t, coupon.Valid)
+
+	extractError(t, http.StatusNotFound, request(t, "GET", "/coupons/nonsense", nil, false))
+}
+
+func TestCreateSubscriptionWithPromotionCode(t *testing.T) {
+	tp := testCouponProxy()
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	payload := &subscriptionRequest{StripeKey: "something", Plan: "gold", PromotionCode: "WELCOME"}
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "PUT", "/subscriptions/membership", payload, false), sub)
+	defer cleanup(sub, &models.User{ID: testUserID})
+
+	if assert.Len(t, tp.createCalls, 1) {
+		assert.Equal(t, "promo_welcome", tp.createCalls[0].promotionCode)
+		assert.Empty(t, tp.createCalls[0].coupon)
+	}
+	stored, _ := getSubscriptionForTest(testUserID, "membership")
+	if assert.NotNil(t, stored) {
+		assert.Equal(t, "half-off", stored.Coupon)
+		assert.Equal(t, "WELCOME", stored.PromotionCode)
+	}
+}
+
+func TestModifySubscriptionWithCoupon(t *testing.T) {
+	tp := testCouponProxy()
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "silver")
+	defer cleanup(s1, tu)
+
+	payload := &subscriptionRequest{Plan: "gold", Coupon: "half-off"}
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "PUT", "/subscriptions/membership", payload, false), sub)
+	assert.Equal(t, "half-off", sub.Coupon)
+	assert.Empty(t, sub.PromotionCode)
+	if assert.Len(t, tp.updateCalls, 1) {
+		assert.Equal(t, "half-off", tp.updateCalls[0].coupon)
+	}
+}
+
+func TestSubscribeWithInvalidCoupon(t *testing.T) {
+	tp := testCouponProxy()
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	payload := &subscriptionRequest{StripeKey: "something", Plan: "gold", Coupon: "nonsense"}
+	extractError(t, http.StatusBadRequest, request(t, "PUT", "/subscriptions/membership", payload, false))
+
+	payload.Coupon = "expired"
+	extractError(t, http.StatusBadRequest, request(t, "PUT", "/subscriptions/membership", payload, false))
+
+	payload.Coupon = "half-off"
+	payload.PromotionCode = "WELCOME"
+	extractError(t, http.StatusBadRequest, request(t, "PUT", "/subscriptions/membership", payload, false))
+
+	assert.Empty(t, tp.createCustomerCalls)
+	assert.Empty(t, tp.createCalls)
+}
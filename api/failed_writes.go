@@ -0,0 +1,338 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/guregu/kami"
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gojoin/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	failedWriteRetryInterval = time.Minute
+	// a write that still fails after this many retries is abandoned
+	maxFailedWriteAttempts = 10
+	// stripe forgets idempotency keys after a day, after that repeating a create
+	// whose result is unknown could create it twice
+	idempotencyKeyLifetime = 24 * time.Hour
+
+	// the actor in the audit log for writes that landed on a retry
+	failedWriteActor = "failed_write_retry"
+)
+
+// compensateCreate is called when a subscription was created with the payer, but
+// we failed to store it. We try to cancel it with the payer, if that fails too the
+// write is queued to be retried so we don't lose track of a billing subscription.
+func compensateCreate(ctx context.Context, sub *models.Subscription, dbErr error) *HTTPError {
+	log := getLogger(ctx).WithField("remote_id", sub.RemoteID)
+	fw := newFailedWrite(models.OperationCreate, sub, dbErr)
+	keepIdempotencyKey(ctx)
+
+	if err := getPayerProxy(ctx).Delete(ctx, sub.RemoteID); err != nil {
+		log.WithError(err).Error("Failed to roll back subscription in stripe, queueing the db write to be retried")
+		fw.Status = models.FailedWritePending
+		recordFailedWrite(getDB(ctx), log, fw)
+		return httpError(http.StatusInternalServerError, "Error while creating db entry, but stripe call was successful. The write will be retried")
+	}
+
+	log.Warn("Rolled back subscription in stripe after failing to create the db entry")
+	fw.Status = models.FailedWriteRolledBack
+	recordFailedWrite(getDB(ctx), log, fw)
+	return httpError(http.StatusInternalServerError, "Error while creating db entry, the subscription was not created")
+}
+
+// compensateUpdate reverts the subscription to its old plan, seats and discount with
+// the payer when we failed to store the change. If that fails the write is queued
+// to be retried.
+func compensateUpdate(ctx context.Context, old models.Subscription, updated *models.Subscription, dbErr error) *HTTPError {
+	return compensateChange(ctx, old, updated, dbErr, func() error {
+		_, err := getPayerProxy(ctx).Update(ctx, updated.RemoteID, &SubscriptionParams{
+			Plan:         old.Plan,
+			Quantity:     old.Quantity,
+			ItemID:       old.RemoteItemID,
+			Items:        itemParams(old.Items),
+			Coupon:       old.Coupon,
+			RemoveCoupon: old.Coupon == "" && updated.Coupon != "",
+		})
+		return err
+	})
+}
+
+// compensateChange undoes a change of the subscription with the payer when we
+// failed to store it, revert makes the call that undoes it. If that fails the
+// write is queued to be retried.
+func compensateChange(ctx context.Context, old models.Subscription, changed *models.Subscription, dbErr error, revert func() error) *HTTPError {
+	log := getLogger(ctx).WithField("remote_id", changed.RemoteID)
+	fw := newFailedWrite(models.OperationUpdate, changed, dbErr)
+	keepIdempotencyKey(ctx)
+
+	if err := revert(); err != nil {
+		log.WithError(err).Error("Failed to revert subscription in stripe, queueing the db write to be retried")
+		fw.Status = models.FailedWritePending
+		recordFailedWrite(getDB(ctx), log, fw)
+		return httpError(http.StatusInternalServerError, "Error while updating db entry, but stripe call was successful. The write will be retried")
+	}
+
+	log.Warn("Reverted subscription in stripe after failing to update the db entry")
+	fw.Status = models.FailedWriteRolledBack
+	recordFailedWrite(getDB(ctx), log, fw)
+	*changed = old
+	return httpError(http.StatusInternalServerError, "Error while updating db entry, the subscription was not changed")
+}
+
+// createCall is a create with the payer that can be repeated
+type createCall struct {
+	CustomerID string              `json:"customer_id"`
+	Params     *SubscriptionParams `json:"params"`
+}
+
+// unknownCreate is called when a create with the payer failed in a way that
+// doesn't tell us if the subscription was created. The write is queued and the
+// retry repeats the create with the same idempotency key to get the subscription.
+func unknownCreate(ctx context.Context, sub *models.Subscription, call *createCall, callErr error) *HTTPError {
+	log := getLogger(ctx)
+	fw := newFailedWrite(models.OperationCreate, sub, callErr)
+	fw.Status = models.FailedWritePending
+	// the params are plain structs, they will always serialize
+	raw, _ := json.Marshal(call)
+	fw.RemoteCall = string(raw)
+	keepIdempotencyKey(ctx)
+
+	log.WithError(callErr).Error("Don't know if the subscription was created in stripe, queueing the create to be retried")
+	recordFailedWrite(getDB(ctx), log, fw)
+	return httpError(http.StatusInternalServerError, "Error while creating the subscription in stripe. The write will be retried")
+}
+
+func newFailedWrite(op string, sub *models.Subscription, dbErr error) *models.FailedWrite {
+	// the subscription is a plain struct, it will always serialize
+	raw, _ := json.Marshal(sub)
+	return &models.FailedWrite{
+		UserID:       sub.UserID,
+		Type:         sub.Type,
+		Operation:    op,
+		RemoteID:     sub.RemoteID,
+		TenantID:     sub.TenantID,
+		Error:        dbErr.Error(),
+		Subscription: string(raw),
+	}
+}
+
+// recordFailedWrite stores the failed write. The db has just failed us, so if this
+// fails as well we put everything needed to repair it by hand in the logs.
+func recordFailedWrite(db *gorm.DB, log *logrus.Entry, fw *models.FailedWrite) {
+	if rsp := db.Create(fw); rsp.Error != nil {
+		log.WithError(rsp.Error).WithFields(logrus.Fields{
+			"failed_write_status": fw.Status,
+			"operation":           fw.Operation,
+			"subscription":        fw.Subscription,
+		}).Error("Failed to record failed write")
+		return
+	}
+	log.WithField("failed_write_id", fw.ID).Infof("Recorded failed write as %s", fw.Status)
+}
+
+// errNotPending is returned when a failed write was settled by someone else
+// before we got to retry it
+var errNotPending = errors.New("failed write is no longer pending")
+
+// retryFailedWrite tries to store the subscription of a pending failed write again.
+// The context has the db and the payer of the tenant of the write. The user is
+// locked while retrying, so several instances don't retry the same write at once.
+// After maxFailedWriteAttempts the write is abandoned and must be repaired by hand.
+func retryFailedWrite(ctx context.Context, fw *models.FailedWrite) error {
+	db := getDB(ctx)
+	lock, err := models.TryLockUser(db, fw.TenantID, fw.UserID)
+	if err != nil {
+		return err
+	}
+	defer releaseUser(ctx, lock)
+
+	// another instance might have retried it while we waited for the lock
+	if rsp := db.Where("id = ?", fw.ID).First(fw); rsp.Error != nil {
+		return rsp.Error
+	}
+	if fw.Status != models.FailedWritePending {
+		return errNotPending
+	}
+
+	sub := new(models.Subscription)
+	superseded := false
+	err = json.Unmarshal([]byte(fw.Subscription), sub)
+	if err == nil && fw.RemoteID == "" && fw.RemoteCall != "" {
+		err = repeatCreate(ctx, fw, sub)
+	}
+	if err == nil {
+		if fw.Operation == models.OperationCreate {
+			err = models.CreateSubscription(db, sub)
+		} else {
+			superseded, err = supersededWrite(db, fw, sub)
+			if err == nil && !superseded {
+				err = models.SaveSubscription(db, sub)
+			}
+		}
+	}
+
+	fw.Attempts++
+	if err != nil {
+		fw.Error = err.Error()
+		if fw.Attempts >= maxFailedWriteAttempts {
+			fw.Status = models.FailedWriteAbandoned
+			getLogger(ctx).WithError(err).WithFields(logrus.Fields{
+				"failed_write_id": fw.ID,
+				"subscription":    fw.Subscription,
+			}).Error("Giving up on failed write, it must be repaired by hand")
+		}
+	} else {
+		now := time.Now()
+		fw.Status = models.FailedWriteResolved
+		fw.ResolvedAt = &now
+
+		if !superseded {
+			action := models.AuditCreate
+			if fw.Operation == models.OperationUpdate {
+				action = models.AuditUpdate
+			}
+			entry := &models.AuditLogEntry{Actor: failedWriteActor, Action: action}
+			if err := models.RecordAudit(db, entry, sub); err != nil {
+				logrus.WithError(err).Warnf("Failed to write audit log entry: %+v", entry)
+			}
+		}
+	}
+
+	if rsp := db.Save(fw); rsp.Error != nil {
+		return rsp.Error
+	}
+	return err
+}
+
+// supersededWrite checks if the subscription was changed or canceled after the
+// write failed. The stored subscription is older than what is in the db then, and
+// writing it would undo the later change.
+func supersededWrite(db *gorm.DB, fw *models.FailedWrite, sub *models.Subscription) (bool, error) {
+	current := new(models.Subscription)
+	rsp := db.Where("id = ?", sub.ID).First(current)
+	if rsp.RecordNotFound() {
+		return true, nil
+	}
+	if rsp.Error != nil {
+		return false, rsp.Error
+	}
+	return current.UpdatedAt.After(fw.CreatedAt), nil
+}
+
+// repeatCreate repeats a create whose result is unknown, stripe answers with the
+// subscription it created the first time if it did
+func repeatCreate(ctx context.Context, fw *models.FailedWrite, sub *models.Subscription) error {
+	if time.Since(fw.CreatedAt) > idempotencyKeyLifetime {
+		return fmt.Errorf("The idempotency key of the create has expired, check stripe for a subscription of user %s", fw.UserID)
+	}
+
+	call := new(createCall)
+	if err := json.Unmarshal([]byte(fw.RemoteCall), call); err != nil {
+		return err
+	}
+	remote, err := getPayerProxy(ctx).Create(ctx, call.CustomerID, call.Params)
+	if err != nil {
+		return err
+	}
+	remote.Apply(sub)
+	fw.RemoteID = sub.RemoteID
+	raw, _ := json.Marshal(sub)
+	fw.Subscription = string(raw)
+	return nil
+}
+
+// retryFailedWrites periodically retries all the pending failed writes
+func (a *API) retryFailedWrites(interval time.Duration) {
+	log := a.log.WithField("component", "failed_writes")
+	ctx := setDB(context.Background(), a.db)
+	ctx = setPayerProxy(ctx, a.payerProxy)
+	ctx = setLogger(ctx, log)
+
+	for range time.Tick(interval) {
+		pending := []models.FailedWrite{}
+		if rsp := a.db.Where("status = ?", models.FailedWritePending).Find(&pending); rsp.Error != nil {
+			log.WithError(rsp.Error).Warn("Failed to query pending writes")
+			continue
+		}
+
+		for i := range pending {
+			fw := &pending[i]
+			flog := log.WithFields(logrus.Fields{
+				"failed_write_id": fw.ID,
+				"remote_id":       fw.RemoteID,
+				"attempts":        fw.Attempts + 1,
+			})
+			fwCtx, err := a.tenantContext(ctx, fw.TenantID)
+			if err == nil {
+				err = retryFailedWrite(fwCtx, fw)
+			}
+			switch err {
+			case nil:
+				flog.Info("Retried failed write successfully")
+			case models.ErrLocked, errNotPending:
+				flog.WithError(err).Info("Skipping failed write")
+			default:
+				flog.WithError(err).Warn("Retrying failed write didn't succeed")
+			}
+		}
+	}
+}
+
+func listFailedWrites(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	query := forTenant(ctx, getDB(ctx), "tenant_id").Order("created_at desc")
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	writes := []models.FailedWrite{}
+	if rsp := query.Find(&writes); rsp.Error != nil {
+		log.WithError(rsp.Error).Warn("Failed to query failed writes")
+		writeError(w, http.StatusInternalServerError, "DB error while searching for failed writes")
+		return
+	}
+
+	sendJSON(w, http.StatusOK, writes)
+}
+
+func retryFailedWriteNow(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	id := kami.Param(ctx, "id")
+	log := getLogger(ctx).WithField("failed_write_id", id)
+	db := getDB(ctx)
+
+	fw := new(models.FailedWrite)
+	if rsp := forTenant(ctx, db, "tenant_id").Where("id = ?", id).First(fw); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			notFoundError(w, "No failed write found with id %s", id)
+		} else {
+			log.WithError(rsp.Error).Warn("Failed to find failed write")
+			writeError(w, http.StatusInternalServerError, "DB error while searching for failed write")
+		}
+		return
+	}
+
+	if fw.Status != models.FailedWritePending {
+		writeError(w, http.StatusConflict, "Failed write is %s, only pending writes can be retried", fw.Status)
+		return
+	}
+
+	if err := retryFailedWrite(ctx, fw); err != nil {
+		if err == models.ErrLocked || err == errNotPending {
+			writeError(w, http.StatusConflict, "Failed write is being retried or was settled already")
+			return
+		}
+		log.WithError(err).Warn("Retrying failed write didn't succeed")
+		writeError(w, http.StatusInternalServerError, "Retrying the write failed: %s", err)
+		return
+	}
+
+	log.Info("Retried failed write successfully")
+	sendJSON(w, http.StatusOK, fw)
+}
@@ -0,0 +1,361 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gojoin/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateRollsBackWhenDBFails(t *testing.T) {
+	// an empty remote id will fail validation when saving the subscription
+	tp := &testProxy{createSubID: ""}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	defer cleanup(tu)
+
+	payload := &subscriptionRequest{
+		StripeKey: "something",
+		Plan:      "super-important",
+	}
+	rsp := request(t, "PUT", "/subscriptions/membership", payload, false)
+	extractError(t, http.StatusInternalServerError, rsp)
+
+	assert.Len(t, tp.deleteCalls, 1)
+
+	fw := new(models.FailedWrite)
+	if assert.NoError(t, db.Where("user_id = ?", testUserID).First(fw).Error) {
+		defer cleanup(fw)
+		assert.Equal(t, models.FailedWriteRolledBack, fw.Status)
+		assert.Equal(t, models.OperationCreate, fw.Operation)
+		assert.Equal(t, "membership", fw.Type)
+		assert.NotEmpty(t, fw.Error)
+	}
+}
+
+func TestCreateQueuesRetryWhenRollbackFails(t *testing.T) {
+	tp := &testProxy{createSubID: "", deleteErr: errors.New("stripe is down")}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	defer cleanup(tu)
+
+	payload := &subscriptionRequest{
+		StripeKey: "something",
+		Plan:      "super-important",
+	}
+	rsp := request(t, "PUT", "/subscriptions/membership", payload, false)
+	extractError(t, http.StatusInternalServerError, rsp)
+
+	fw := new(models.FailedWrite)
+	if !assert.NoError(t, db.Where("user_id = ?", testUserID).First(fw).Error) {
+		return
+	}
+	defer cleanup(fw)
+	assert.Equal(t, models.FailedWritePending, fw.Status)
+
+	writes := []models.FailedWrite{}
+	extractPayload(t, request(t, "GET", "/admin/failed_writes?status=pending", nil, true), &writes)
+	if assert.Len(t, writes, 1) {
+		assert.Equal(t, fw.ID, writes[0].ID)
+	}
+
+	// fix up the stored subscription so the retry can land
+	fw.Subscription = `{"Type": "membership", "user_id": "joker", "plan": "super-important", "remote_id": "remote-id"}`
+	db.Save(fw)
+
+	retried := new(models.FailedWrite)
+	extractPayload(t, request(t, "POST", "/admin/failed_writes/"+fw.ID+"/retry", nil, true), retried)
+	assert.Equal(t, models.FailedWriteResolved, retried.Status)
+	assert.Equal(t, 1, retried.Attempts)
+	assert.NotNil(t, retried.ResolvedAt)
+
+	sub := new(models.Subscription)
+	if assert.NoError(t, db.Where("remote_id = ?", "remote-id").First(sub).Error) {
+		defer cleanup(sub)
+		assert.Equal(t, "super-important", sub.Plan)
+	}
+
+	rsp = request(t, "POST", "/admin/failed_writes/"+fw.ID+"/retry", nil, true)
+	extractError(t, http.StatusConflict, rsp)
+}
+
+func TestUnknownCreateIsRepeated(t *testing.T) {
+	fp := &flakyProxy{
+		testProxy: testProxy{createSubID: "remote-id"},
+		failures:  1,
+		err:       context.DeadlineExceeded,
+	}
+	api.payerProxy = fp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	defer cleanup(tu)
+
+	payload := &subscriptionRequest{
+		StripeKey: "something",
+		Plan:      "super-important",
+	}
+	rsp := request(t, "PUT", "/subscriptions/membership", payload, false)
+	extractError(t, http.StatusInternalServerError, rsp)
+
+	fw := new(models.FailedWrite)
+	if !assert.NoError(t, db.Where("user_id = ?", testUserID).First(fw).Error) {
+		return
+	}
+	defer cleanup(fw)
+	assert.Equal(t, models.FailedWritePending, fw.Status)
+	assert.Equal(t, models.OperationCreate, fw.Operation)
+	assert.Empty(t, fw.RemoteID)
+	assert.NotEmpty(t, fw.RemoteCall)
+
+	// subscribing again could create a second one while the first is pending
+	rsp = request(t, "PUT", "/subscriptions/membership", payload, false)
+	extractError(t, http.StatusConflict, rsp)
+	assert.Equal(t, 1, fp.calls)
+
+	// the retry repeats the create with the same key and stores what it returns
+	retried := new(models.FailedWrite)
+	extractPayload(t, request(t, "POST", "/admin/failed_writes/"+fw.ID+"/retry", nil, true), retried)
+	assert.Equal(t, models.FailedWriteResolved, retried.Status)
+	assert.Equal(t, "remote-id", retried.RemoteID)
+	assert.Equal(t, 2, fp.calls)
+	if assert.Len(t, fp.createCalls, 1) {
+		assert.Equal(t, "stripe-given-value", fp.createCalls[0].userID)
+		assert.NotEmpty(t, fp.createCalls[0].idempotencyKey)
+		assert.Contains(t, fw.RemoteCall, fp.createCalls[0].idempotencyKey)
+	}
+
+	sub := new(models.Subscription)
+	if assert.NoError(t, db.Where("remote_id = ?", "remote-id").First(sub).Error) {
+		defer cleanup(sub)
+		assert.Equal(t, testUserID, sub.UserID)
+		assert.Equal(t, "super-important", sub.Plan)
+	}
+}
+
+// failSubscriptionUpdates makes saving changed subscriptions fail until the
+// returned func is called
+func failSubscriptionUpdates() func() {
+	db.Callback().Update().Before("gorm:update").Register("test:fail_updates", func(scope *gorm.Scope) {
+		if _, ok := scope.Value.(*models.Subscription); ok {
+			scope.Err(errors.New("db is down"))
+		}
+	})
+	return func() { db.Callback().Update().Remove("test:fail_updates") }
+}
+
+func TestUpdateRevertsCouponWhenDBFails(t *testing.T) {
+	tp := testCouponProxy()
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "silver")
+	s1.RemoteID = "remote-id"
+	db.Save(s1)
+	defer cleanup(s1, tu)
+	defer db.Where("user_id = ?", testUserID).Delete(models.FailedWrite{})
+
+	defer failSubscriptionUpdates()()
+	payload := &subscriptionRequest{Plan: "gold", Coupon: "half-off"}
+	extractError(t, http.StatusInternalServerError, request(t, "PUT", "/subscriptions/membership", payload, false))
+
+	if assert.Len(t, tp.updateCalls, 2) {
+		revert := tp.updateCalls[1]
+		assert.Equal(t, "silver", revert.plan)
+		assert.Empty(t, revert.coupon)
+		assert.True(t, revert.removeCoupon)
+	}
+}
+
+func TestUpdateRevertsSeatsWhenDBFails(t *testing.T) {
+	tp := &testProxy{updateSubID: "remote-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "silver")
+	s1.RemoteID = "remote-id"
+	s1.Quantity = 3
+	db.Save(s1)
+	defer cleanup(s1, tu)
+	defer db.Where("user_id = ?", testUserID).Delete(models.FailedWrite{})
+
+	defer failSubscriptionUpdates()()
+	payload := &subscriptionRequest{Plan: "silver", Quantity: 10}
+	extractError(t, http.StatusInternalServerError, request(t, "PUT", "/subscriptions/membership", payload, false))
+
+	if assert.Len(t, tp.updateCalls, 2) {
+		assert.Equal(t, 10, tp.updateCalls[0].quantity)
+		assert.Equal(t, 3, tp.updateCalls[1].quantity)
+	}
+}
+
+func TestCancelAtPeriodEndRevertedWhenDBFails(t *testing.T) {
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "silver")
+	defer cleanup(s1, tu)
+	defer db.Where("user_id = ?", testUserID).Delete(models.FailedWrite{})
+
+	stopFailing := failSubscriptionUpdates()
+	extractError(t, http.StatusInternalServerError, request(t, "DELETE", "/subscriptions/membership?at_period_end=true", nil, false))
+	assert.Equal(t, []string{s1.RemoteID}, tp.cancelAtEndCalls)
+	assert.Equal(t, []string{s1.RemoteID}, tp.reactivateCalls)
+	stopFailing()
+
+	fw := new(models.FailedWrite)
+	if assert.NoError(t, db.Where("user_id = ?", testUserID).First(fw).Error) {
+		assert.Equal(t, models.FailedWriteRolledBack, fw.Status)
+	}
+
+	// and undoing the cancellation is canceled again
+	db.Model(s1).Update("cancel_at", s1.CurrentPeriodEnd)
+	defer failSubscriptionUpdates()()
+	extractError(t, http.StatusInternalServerError, request(t, "POST", "/subscriptions/membership/reactivate", nil, false))
+	assert.Len(t, tp.reactivateCalls, 2)
+	assert.Len(t, tp.cancelAtEndCalls, 2)
+}
+
+func TestPauseRevertedWhenDBFails(t *testing.T) {
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "silver")
+	defer cleanup(s1, tu)
+	defer db.Where("user_id = ?", testUserID).Delete(models.FailedWrite{})
+
+	stopFailing := failSubscriptionUpdates()
+	extractError(t, http.StatusInternalServerError, request(t, "POST", "/subscriptions/membership/pause", nil, false))
+	assert.Len(t, tp.pauseCalls, 1)
+	assert.Equal(t, []string{s1.RemoteID}, tp.resumeCalls)
+	stopFailing()
+
+	fw := new(models.FailedWrite)
+	if assert.NoError(t, db.Where("user_id = ?", testUserID).First(fw).Error) {
+		assert.Equal(t, models.FailedWriteRolledBack, fw.Status)
+	}
+
+	// and resuming is paused again
+	db.Model(s1).Update("status", models.StatusPaused)
+	defer failSubscriptionUpdates()()
+	extractError(t, http.StatusInternalServerError, request(t, "POST", "/subscriptions/membership/resume", nil, false))
+	assert.Len(t, tp.resumeCalls, 2)
+	assert.Len(t, tp.pauseCalls, 2)
+}
+
+func TestResumeRevertedToTheSamePause(t *testing.T) {
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "silver")
+	defer cleanup(s1, tu)
+	defer db.Where("user_id = ?", testUserID).Delete(models.FailedWrite{})
+
+	// an open-ended pause stays open-ended
+	db.Model(s1).UpdateColumn("status", models.StatusPaused)
+	stopFailing := failSubscriptionUpdates()
+	extractError(t, http.StatusInternalServerError, request(t, "POST", "/subscriptions/membership/resume", nil, false))
+	if assert.Len(t, tp.pauseCalls, 1) {
+		assert.Nil(t, tp.pauseCalls[0])
+	}
+	stored := new(models.Subscription)
+	if assert.NoError(t, db.Where("id = ?", s1.ID).First(stored).Error) {
+		assert.Equal(t, models.StatusPaused, stored.Status)
+		assert.Nil(t, stored.ResumeAt)
+	}
+
+	// and one with a date ends on that date
+	stopFailing()
+	resumeAt := time.Now().Add(48 * time.Hour).UTC().Truncate(time.Second)
+	db.Model(s1).UpdateColumn("resume_at", resumeAt)
+	defer failSubscriptionUpdates()()
+	extractError(t, http.StatusInternalServerError, request(t, "POST", "/subscriptions/membership/resume", nil, false))
+	if assert.Len(t, tp.pauseCalls, 2) && assert.NotNil(t, tp.pauseCalls[1]) {
+		assert.True(t, resumeAt.Equal(*tp.pauseCalls[1]))
+	}
+}
+
+func TestFailedWritesRequiresAdmin(t *testing.T) {
+	rsp := request(t, "GET", "/admin/failed_writes", nil, false)
+	extractError(t, http.StatusForbidden, rsp)
+}
+
+func TestFailedWriteAbandonedAfterMaxAttempts(t *testing.T) {
+	// the stored subscription has no remote id, so storing it fails every time
+	fw := &models.FailedWrite{
+		UserID:       testUserID,
+		Type:         "membership",
+		Operation:    models.OperationCreate,
+		Status:       models.FailedWritePending,
+		Attempts:     maxFailedWriteAttempts - 1,
+		Subscription: `{"Type": "membership", "user_id": "joker", "plan": "super-important"}`,
+	}
+	db.Create(fw)
+	defer cleanup(fw)
+
+	extractError(t, http.StatusInternalServerError, request(t, "POST", "/admin/failed_writes/"+fw.ID+"/retry", nil, true))
+
+	stored := new(models.FailedWrite)
+	if assert.NoError(t, db.Where("id = ?", fw.ID).First(stored).Error) {
+		assert.Equal(t, models.FailedWriteAbandoned, stored.Status)
+		assert.Equal(t, maxFailedWriteAttempts, stored.Attempts)
+	}
+	extractError(t, http.StatusConflict, request(t, "POST", "/admin/failed_writes/"+fw.ID+"/retry", nil, true))
+}
+
+func TestFailedWriteNotRetriedWhileUserIsLocked(t *testing.T) {
+	fw := &models.FailedWrite{
+		UserID:       testUserID,
+		Type:         "membership",
+		Operation:    models.OperationCreate,
+		Status:       models.FailedWritePending,
+		Subscription: `{"Type": "membership", "user_id": "joker", "plan": "super-important", "remote_id": "remote-id"}`,
+	}
+	db.Create(fw)
+	defer cleanup(fw)
+
+	lock, err := models.TryLockUser(db, "", testUserID)
+	if !assert.NoError(t, err) {
+		return
+	}
+	extractError(t, http.StatusConflict, request(t, "POST", "/admin/failed_writes/"+fw.ID+"/retry", nil, true))
+	assert.NoError(t, lock.Release())
+
+	stored := new(models.FailedWrite)
+	if assert.NoError(t, db.Where("id = ?", fw.ID).First(stored).Error) {
+		assert.Equal(t, models.FailedWritePending, stored.Status)
+		assert.Equal(t, 0, stored.Attempts)
+	}
+}
+
+func TestFailedWriteDoesntUndoLaterChange(t *testing.T) {
+	s1 := createSubscription(testUserID, "membership", "pro")
+	defer cleanup(s1)
+
+	stale := *s1
+	stale.Plan = "basic"
+	fw := newFailedWrite(models.OperationUpdate, &stale, errors.New("db is down"))
+	fw.Status = models.FailedWritePending
+	db.Create(fw)
+	defer cleanup(fw)
+	// the subscription was changed after the write failed
+	db.Model(fw).UpdateColumn("created_at", time.Now().Add(-time.Hour))
+
+	retried := new(models.FailedWrite)
+	extractPayload(t, request(t, "POST", "/admin/failed_writes/"+fw.ID+"/retry", nil, true), retried)
+	assert.Equal(t, models.FailedWriteResolved, retried.Status)
+
+	stored := new(models.Subscription)
+	if assert.NoError(t, db.Where("id = ?", s1.ID).First(stored).Error) {
+		assert.Equal(t, "pro", stored.Plan)
+	}
+}
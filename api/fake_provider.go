@@ -0,0 +1,678 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gojoin/conf"
+	"github.com/netlify/gojoin/models"
+	"github.com/pborman/uuid"
+)
+
+const fakeProvider = "fake"
+
+// fakeDeclinedToken is a payment token the fake provider refuses, like the
+// test token of the same name in stripe
+const fakeDeclinedToken = "tok_chargeDeclined"
+
+var errFakeDeclined = errors.New("Your card was declined")
+
+// The fake provider knows every coupon named like 20OFF, it takes that percentage
+// off forever. Every coupon can also be redeemed with a promotion code that has
+// PROMO- in front of it.
+const (
+	fakeCouponSuffix    = "OFF"
+	fakePromoCodePrefix = "PROMO-"
+	fakePromoIDPrefix   = "fake_promo_"
+)
+
+// FakeProxy is a payment provider for local development. It keeps its customers
+// and subscriptions in the db and never talks to the network, every plan is
+// accepted and billed monthly. The first period of a subscription is invoiced
+// right away with the prices of the plans in the config.
+type FakeProxy struct {
+	db    *gorm.DB
+	plans conf.PlansConfig
+}
+
+func newFakeProxy(config *conf.Config, db *gorm.DB) (PayerProxy, error) {
+	if db == nil {
+		return nil, errors.New("The fake provider requires a db")
+	}
+	if err := db.AutoMigrate(models.FakeCustomer{}, models.FakeSubscription{}, models.FakeSubscriptionItem{}, models.FakePaymentMethod{}, models.FakeInvoice{}, models.FakeInvoiceLine{}).Error; err != nil {
+		return nil, err
+	}
+	return &FakeProxy{db: db, plans: config.Plans}, nil
+}
+
+func (f *FakeProxy) CreateCustomer(ctx context.Context, userID, email, payToken, idempotencyKey string) (string, error) {
+	if strings.HasPrefix(payToken, fakeDeclinedToken) {
+		return "", errFakeDeclined
+	}
+
+	c := new(models.FakeCustomer)
+	if found, err := f.findByIdempotencyKey(c, idempotencyKey); err != nil {
+		return "", err
+	} else if found {
+		return c.ID, nil
+	}
+
+	c.ID = "fake_cus_" + uuid.NewRandom().String()
+	c.UserID = userID
+	c.Email = email
+	c.IdempotencyKey = idempotencyKey
+	if rsp := f.db.Create(c); rsp.Error != nil {
+		return "", rsp.Error
+	}
+	if err := f.setPaymentMethod(c.ID, payToken); err != nil {
+		return "", err
+	}
+	return c.ID, nil
+}
+
+func (f *FakeProxy) Create(ctx context.Context, customerID string, params *SubscriptionParams) (*RemoteSubscription, error) {
+	if strings.HasPrefix(params.Token, fakeDeclinedToken) {
+		return nil, errFakeDeclined
+	}
+
+	s := new(models.FakeSubscription)
+	if found, err := f.findByIdempotencyKey(s, params.IdempotencyKey); err != nil {
+		return nil, err
+	} else if found {
+		if rsp := f.db.Where("subscription_id = ?", s.ID).Find(&s.Items); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+		return fromFakeSub(s), nil
+	}
+
+	if err := f.setPaymentMethod(customerID, params.Token); err != nil {
+		return nil, err
+	}
+	coupon, err := f.discount(params)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	s.ID = "fake_sub_" + uuid.NewRandom().String()
+	s.CustomerID = customerID
+	s.Type = params.Type
+	s.Plan = params.Plan
+	s.Quantity = params.Quantity
+	if s.Quantity == 0 {
+		s.Quantity = 1
+	}
+	s.Status = models.StatusActive
+	s.PeriodStart = now
+	s.PeriodEnd = now.AddDate(0, 1, 0)
+	if params.TrialDays > 0 {
+		// like stripe, the trial is the first period
+		trialEnd := now.AddDate(0, 0, params.TrialDays)
+		s.Status = models.StatusTrialing
+		s.PeriodEnd = trialEnd
+		s.TrialEnd = &trialEnd
+	}
+	s.Coupon = coupon
+	s.IdempotencyKey = params.IdempotencyKey
+	if rsp := f.db.Create(s); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if err := f.setItems(s, params.Items); err != nil {
+		return nil, err
+	}
+	if err := f.invoice(s); err != nil {
+		return nil, err
+	}
+	return fromFakeSub(s), nil
+}
+
+func (f *FakeProxy) Update(ctx context.Context, subID string, params *SubscriptionParams) (*RemoteSubscription, error) {
+	if strings.HasPrefix(params.Token, fakeDeclinedToken) {
+		return nil, errFakeDeclined
+	}
+
+	s, err := f.findSub(subID)
+	if err != nil {
+		return nil, err
+	}
+	coupon, err := f.discount(params)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.setPaymentMethod(s.CustomerID, params.Token); err != nil {
+		return nil, err
+	}
+
+	s.Plan = params.Plan
+	if params.Quantity > 0 {
+		s.Quantity = params.Quantity
+	}
+	if coupon != "" || params.RemoveCoupon {
+		s.Coupon = coupon
+	}
+	if rsp := f.db.Save(s); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	if params.Items != nil {
+		if err := f.setItems(s, params.Items); err != nil {
+			return nil, err
+		}
+	}
+	return fromFakeSub(s), nil
+}
+
+func (f *FakeProxy) UpdatePaymentMethod(ctx context.Context, customerID, token, idempotencyKey string) error {
+	if strings.HasPrefix(token, fakeDeclinedToken) {
+		return errFakeDeclined
+	}
+	return f.setPaymentMethod(customerID, token)
+}
+
+func (f *FakeProxy) ListPaymentMethods(ctx context.Context, customerID string) ([]*PaymentMethod, error) {
+	c, err := f.findCustomer(customerID)
+	if err != nil {
+		return nil, err
+	}
+
+	cards := []models.FakePaymentMethod{}
+	if rsp := f.db.Where("customer_id = ?", customerID).Order("created_at asc").Find(&cards); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	methods := make([]*PaymentMethod, len(cards))
+	for i := range cards {
+		methods[i] = fromFakeCard(&cards[i], c)
+	}
+	return methods, nil
+}
+
+func (f *FakeProxy) AddPaymentMethod(ctx context.Context, customerID, token, idempotencyKey string) (*PaymentMethod, error) {
+	if strings.HasPrefix(token, fakeDeclinedToken) {
+		return nil, errFakeDeclined
+	}
+
+	c, err := f.findCustomer(customerID)
+	if err != nil {
+		return nil, err
+	}
+
+	card := new(models.FakePaymentMethod)
+	if found, err := f.findByIdempotencyKey(card, idempotencyKey); err != nil {
+		return nil, err
+	} else if found {
+		return fromFakeCard(card, c), nil
+	}
+
+	card = newFakeCard(customerID, token)
+	card.IdempotencyKey = idempotencyKey
+	if rsp := f.db.Create(card); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	// like stripe, the first card becomes the default
+	if c.DefaultPaymentMethod == "" {
+		c.DefaultPaymentMethod = card.ID
+		if rsp := f.db.Save(c); rsp.Error != nil {
+			return nil, rsp.Error
+		}
+	}
+	return fromFakeCard(card, c), nil
+}
+
+func (f *FakeProxy) DeletePaymentMethod(ctx context.Context, customerID, methodID string) error {
+	c, card, err := f.findCard(customerID, methodID)
+	if err != nil {
+		return err
+	}
+	if rsp := f.db.Delete(card); rsp.Error != nil {
+		return rsp.Error
+	}
+	if c.DefaultPaymentMethod != card.ID {
+		return nil
+	}
+
+	// the newest card left takes over as the default
+	c.DefaultPaymentMethod = ""
+	next := new(models.FakePaymentMethod)
+	rsp := f.db.Where("customer_id = ?", customerID).Order("created_at desc").First(next)
+	if rsp.Error != nil && !rsp.RecordNotFound() {
+		return rsp.Error
+	} else if rsp.Error == nil {
+		c.DefaultPaymentMethod = next.ID
+	}
+	return f.db.Save(c).Error
+}
+
+func (f *FakeProxy) SetDefaultPaymentMethod(ctx context.Context, customerID, methodID string) error {
+	c, card, err := f.findCard(customerID, methodID)
+	if err != nil {
+		return err
+	}
+	c.DefaultPaymentMethod = card.ID
+	return f.db.Save(c).Error
+}
+
+func (f *FakeProxy) Delete(ctx context.Context, subID string) error {
+	s, err := f.findSub(subID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	s.Status = models.StatusCanceled
+	s.CanceledAt = &now
+	return f.db.Save(s).Error
+}
+
+func (f *FakeProxy) GetCoupon(ctx context.Context, id string) (*Coupon, error) {
+	percent, err := strconv.Atoi(strings.TrimSuffix(id, fakeCouponSuffix))
+	if !strings.HasSuffix(id, fakeCouponSuffix) || err != nil || percent <= 0 || percent > 100 {
+		return nil, ErrCouponNotFound
+	}
+	return &Coupon{
+		ID:         id,
+		PercentOff: percent,
+		Duration:   "forever",
+		Valid:      true,
+	}, nil
+}
+
+func (f *FakeProxy) GetPromotionCode(ctx context.Context, code string) (*Coupon, error) {
+	if !strings.HasPrefix(code, fakePromoCodePrefix) {
+		return nil, ErrCouponNotFound
+	}
+	c, err := f.GetCoupon(ctx, strings.TrimPrefix(code, fakePromoCodePrefix))
+	if err != nil {
+		return nil, err
+	}
+	c.PromotionCode = fakePromoIDPrefix + code
+	return c, nil
+}
+
+// discount is the id of the coupon the params ask for, if any
+func (f *FakeProxy) discount(params *SubscriptionParams) (string, error) {
+	switch {
+	case params.Coupon != "":
+		c, err := f.GetCoupon(context.Background(), params.Coupon)
+		if err != nil {
+			return "", err
+		}
+		return c.ID, nil
+	case params.PromotionCode != "":
+		c, err := f.GetPromotionCode(context.Background(), strings.TrimPrefix(params.PromotionCode, fakePromoIDPrefix))
+		if err != nil {
+			return "", err
+		}
+		return c.ID, nil
+	}
+	return "", nil
+}
+
+func (f *FakeProxy) CancelAtPeriodEnd(ctx context.Context, subID string) (*RemoteSubscription, error) {
+	return f.setCancelAtEnd(subID, true)
+}
+
+func (f *FakeProxy) Reactivate(ctx context.Context, subID, itemID string) (*RemoteSubscription, error) {
+	return f.setCancelAtEnd(subID, false)
+}
+
+func (f *FakeProxy) Pause(ctx context.Context, subID string, resumeAt *time.Time) (*RemoteSubscription, error) {
+	s, err := f.findSub(subID)
+	if err != nil {
+		return nil, err
+	}
+	s.Status = models.StatusPaused
+	s.ResumeAt = resumeAt
+	if rsp := f.db.Save(s); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return fromFakeSub(s), nil
+}
+
+func (f *FakeProxy) Resume(ctx context.Context, subID string) (*RemoteSubscription, error) {
+	s, err := f.findSub(subID)
+	if err != nil {
+		return nil, err
+	}
+	s.Status = models.StatusActive
+	s.ResumeAt = nil
+	if rsp := f.db.Save(s); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return fromFakeSub(s), nil
+}
+
+func (f *FakeProxy) setCancelAtEnd(subID string, cancel bool) (*RemoteSubscription, error) {
+	s, err := f.findSub(subID)
+	if err != nil {
+		return nil, err
+	}
+	s.CancelAtEnd = cancel
+	if rsp := f.db.Save(s); rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	return fromFakeSub(s), nil
+}
+
+// setItems replaces the add-ons of the subscription
+func (f *FakeProxy) setItems(s *models.FakeSubscription, items []ItemParams) error {
+	if rsp := f.db.Where("subscription_id = ?", s.ID).Delete(models.FakeSubscriptionItem{}); rsp.Error != nil {
+		return rsp.Error
+	}
+	s.Items = []models.FakeSubscriptionItem{}
+	for _, item := range items {
+		added := models.FakeSubscriptionItem{
+			ID:             "fake_si_" + uuid.NewRandom().String(),
+			SubscriptionID: s.ID,
+			Plan:           item.Plan,
+			Quantity:       item.Quantity,
+		}
+		if added.Quantity == 0 {
+			added.Quantity = 1
+		}
+		if rsp := f.db.Create(&added); rsp.Error != nil {
+			return rsp.Error
+		}
+		s.Items = append(s.Items, added)
+	}
+	return nil
+}
+
+// invoice bills the first period of a new subscription
+func (f *FakeProxy) invoice(s *models.FakeSubscription) error {
+	inv := f.newInvoice(s)
+	if rsp := f.db.Create(inv); rsp.Error != nil {
+		return rsp.Error
+	}
+	for i := range inv.Lines {
+		if rsp := f.db.Create(&inv.Lines[i]); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return nil
+}
+
+// newInvoice bills the current period of the subscription with the prices of
+// the plans in the config, trials are free. It isn't saved.
+func (f *FakeProxy) newInvoice(s *models.FakeSubscription) *models.FakeInvoice {
+	inv := &models.FakeInvoice{
+		ID:             "fake_in_" + uuid.NewRandom().String(),
+		CustomerID:     s.CustomerID,
+		SubscriptionID: s.ID,
+		Status:         "paid",
+		Currency:       "usd",
+		PeriodStart:    s.PeriodStart,
+		PeriodEnd:      s.PeriodEnd,
+	}
+	lines := []models.FakeInvoiceLine{{Plan: s.Plan, Quantity: s.Quantity}}
+	for _, item := range s.Items {
+		lines = append(lines, models.FakeInvoiceLine{Plan: item.Plan, Quantity: item.Quantity})
+	}
+	for i := range lines {
+		line := &lines[i]
+		plan := f.plans[s.Type][line.Plan]
+		name := plan.Name
+		if name == "" {
+			name = line.Plan
+		}
+		line.ID = "fake_il_" + uuid.NewRandom().String()
+		line.InvoiceID = inv.ID
+		line.Description = fmt.Sprintf("%d x %s", line.Quantity, name)
+		if s.TrialEnd == nil {
+			line.Amount = plan.Price * line.Quantity
+		}
+		if plan.Currency != "" {
+			inv.Currency = plan.Currency
+		}
+		inv.Amount += line.Amount
+	}
+	if s.Coupon != "" {
+		if c, err := f.GetCoupon(context.Background(), s.Coupon); err == nil {
+			inv.Amount -= inv.Amount * c.PercentOff / 100
+		}
+	}
+	inv.Lines = lines
+	return inv
+}
+
+// PreviewInvoice bills the next period with the changes, the fake provider
+// doesn't prorate
+func (f *FakeProxy) PreviewInvoice(ctx context.Context, customerID, subID string, params *SubscriptionParams) (*Invoice, error) {
+	s := &models.FakeSubscription{CustomerID: customerID, Type: params.Type, Quantity: 1}
+	start := time.Now().UTC().Truncate(time.Second)
+	if subID != "" {
+		found, err := f.findSub(subID)
+		if err != nil {
+			return nil, err
+		}
+		s = found
+		start = s.PeriodEnd
+	} else if _, err := f.findCustomer(customerID); err != nil {
+		return nil, err
+	}
+	coupon, err := f.discount(params)
+	if err != nil {
+		return nil, err
+	}
+
+	// nothing is saved, the changes only go into the invoice
+	if params.Plan != "" {
+		s.Plan = params.Plan
+	}
+	if params.Quantity > 0 {
+		s.Quantity = params.Quantity
+	}
+	if coupon != "" {
+		s.Coupon = coupon
+	}
+	if params.Items != nil {
+		s.Items = []models.FakeSubscriptionItem{}
+		for _, item := range params.Items {
+			if item.Quantity == 0 {
+				item.Quantity = 1
+			}
+			s.Items = append(s.Items, models.FakeSubscriptionItem{Plan: item.Plan, Quantity: item.Quantity})
+		}
+	}
+	s.PeriodStart = start
+	s.PeriodEnd = start.AddDate(0, 1, 0)
+	s.TrialEnd = nil
+	if subID == "" && params.TrialDays > 0 {
+		trialEnd := start.AddDate(0, 0, params.TrialDays)
+		s.PeriodEnd = trialEnd
+		s.TrialEnd = &trialEnd
+	}
+
+	inv := f.newInvoice(s)
+	inv.ID = ""
+	inv.Status = "draft"
+	inv.CreatedAt = start
+	return fromFakeInvoice(inv), nil
+}
+
+func (f *FakeProxy) ListInvoices(ctx context.Context, customerID string, limit int) ([]*Invoice, error) {
+	found := []models.FakeInvoice{}
+	rsp := f.db.Preload("Lines").Where("customer_id = ?", customerID).Order("created_at desc").Limit(limit).Find(&found)
+	if rsp.Error != nil {
+		return nil, rsp.Error
+	}
+	invoices := make([]*Invoice, len(found))
+	for i := range found {
+		invoices[i] = fromFakeInvoice(&found[i])
+	}
+	return invoices, nil
+}
+
+func (f *FakeProxy) GetInvoice(ctx context.Context, customerID, id string) (*Invoice, error) {
+	inv := new(models.FakeInvoice)
+	if rsp := f.db.Preload("Lines").Where("id = ? AND customer_id = ?", id, customerID).First(inv); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, ErrInvoiceNotFound
+		}
+		return nil, rsp.Error
+	}
+	return fromFakeInvoice(inv), nil
+}
+
+// setPaymentMethod checks the customer exists and makes a card from the token its
+// default payment method, if there is a token
+func (f *FakeProxy) setPaymentMethod(customerID, token string) error {
+	c, err := f.findCustomer(customerID)
+	if err != nil || token == "" {
+		return err
+	}
+
+	card := newFakeCard(customerID, token)
+	if rsp := f.db.Create(card); rsp.Error != nil {
+		return rsp.Error
+	}
+	c.DefaultPaymentMethod = card.ID
+	return f.db.Save(c).Error
+}
+
+func (f *FakeProxy) findCustomer(customerID string) (*models.FakeCustomer, error) {
+	c := new(models.FakeCustomer)
+	if rsp := f.db.Where("id = ?", customerID).First(c); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, fmt.Errorf("No such customer: %s", customerID)
+		}
+		return nil, rsp.Error
+	}
+	return c, nil
+}
+
+// findCard finds a card of the customer, and the customer with it
+func (f *FakeProxy) findCard(customerID, methodID string) (*models.FakeCustomer, *models.FakePaymentMethod, error) {
+	c, err := f.findCustomer(customerID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	card := new(models.FakePaymentMethod)
+	if rsp := f.db.Where("id = ? AND customer_id = ?", methodID, customerID).First(card); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil, ErrPaymentMethodNotFound
+		}
+		return nil, nil, rsp.Error
+	}
+	return c, card, nil
+}
+
+// findSub finds a subscription that can still be changed
+func (f *FakeProxy) findSub(subID string) (*models.FakeSubscription, error) {
+	s := new(models.FakeSubscription)
+	if rsp := f.db.Preload("Items").Where("id = ?", subID).First(s); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, ErrSubscriptionNotFound
+		}
+		return nil, rsp.Error
+	}
+	// like stripe, a canceled subscription is gone
+	if s.Status == models.StatusCanceled {
+		return nil, ErrSubscriptionNotFound
+	}
+	return s, nil
+}
+
+// findByIdempotencyKey loads the object created with the key before, if there is one
+func (f *FakeProxy) findByIdempotencyKey(out interface{}, idempotencyKey string) (bool, error) {
+	if idempotencyKey == "" {
+		return false, nil
+	}
+	rsp := f.db.Where("idempotency_key = ?", idempotencyKey).First(out)
+	if rsp.RecordNotFound() {
+		return false, nil
+	}
+	return rsp.Error == nil, rsp.Error
+}
+
+// fakeCards are the stripe test tokens we know, anything else is a visa
+var fakeCards = map[string]struct{ brand, last4 string }{
+	"tok_visa":       {"Visa", "4242"},
+	"tok_mastercard": {"MasterCard", "4444"},
+	"tok_amex":       {"American Express", "0005"},
+}
+
+func newFakeCard(customerID, token string) *models.FakePaymentMethod {
+	known, ok := fakeCards[token]
+	if !ok {
+		known = fakeCards["tok_visa"]
+	}
+	return &models.FakePaymentMethod{
+		ID:         "fake_card_" + uuid.NewRandom().String(),
+		CustomerID: customerID,
+		Brand:      known.brand,
+		Last4:      known.last4,
+		ExpMonth:   12,
+		ExpYear:    time.Now().Year() + 1,
+	}
+}
+
+func fromFakeCard(card *models.FakePaymentMethod, c *models.FakeCustomer) *PaymentMethod {
+	return &PaymentMethod{
+		ID:       card.ID,
+		Brand:    card.Brand,
+		Last4:    card.Last4,
+		ExpMonth: card.ExpMonth,
+		ExpYear:  card.ExpYear,
+		Default:  card.ID == c.DefaultPaymentMethod,
+	}
+}
+
+func fromFakeSub(s *models.FakeSubscription) *RemoteSubscription {
+	start := s.PeriodStart
+	end := s.PeriodEnd
+	remote := &RemoteSubscription{
+		ID:          s.ID,
+		Status:      s.Status,
+		Quantity:    s.Quantity,
+		PeriodStart: &start,
+		PeriodEnd:   &end,
+		TrialEnd:    s.TrialEnd,
+		ResumeAt:    s.ResumeAt,
+		Coupon:      s.Coupon,
+	}
+	if s.CancelAtEnd {
+		remote.CancelAt = &end
+	}
+	// the plan is an item too, its id is made up from the subscription
+	remote.Items = []RemoteItem{{ID: "fake_si_" + s.ID, Plan: s.Plan, Quantity: s.Quantity}}
+	for _, item := range s.Items {
+		remote.Items = append(remote.Items, RemoteItem{ID: item.ID, Plan: item.Plan, Quantity: item.Quantity})
+	}
+	return remote
+}
+
+func fromFakeInvoice(inv *models.FakeInvoice) *Invoice {
+	start := inv.PeriodStart
+	end := inv.PeriodEnd
+	created := inv.CreatedAt
+	invoice := &Invoice{
+		ID:             inv.ID,
+		SubscriptionID: inv.SubscriptionID,
+		Status:         inv.Status,
+		Amount:         inv.Amount,
+		Currency:       inv.Currency,
+		PeriodStart:    &start,
+		PeriodEnd:      &end,
+		Lines:          []InvoiceLine{},
+		CreatedAt:      &created,
+	}
+	if inv.Status == "paid" {
+		invoice.AmountPaid = inv.Amount
+	}
+	for _, line := range inv.Lines {
+		invoice.Lines = append(invoice.Lines, InvoiceLine{
+			Description: line.Description,
+			Plan:        line.Plan,
+			Quantity:    line.Quantity,
+			Amount:      line.Amount,
+			PeriodStart: &start,
+			PeriodEnd:   &end,
+		})
+	}
+	return invoice
+}
@@ -0,0 +1,336 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/netlify/gojoin/conf"
+	"github.com/netlify/gojoin/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFakeProvider(t *testing.T) {
+	ctx := context.Background()
+	provider, err := NewProvider(&conf.Config{Provider: "fake"}, db)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	customerID, err := provider.CreateCustomer(ctx, "batman", "bruce@dc.com", "tok_visa", "key")
+	if !assert.NoError(t, err) {
+		return
+	}
+	again, err := provider.CreateCustomer(ctx, "batman", "bruce@dc.com", "tok_visa", "key")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, customerID, again)
+
+	_, err = provider.Create(ctx, "nonsense", &SubscriptionParams{Type: "membership", Plan: "gold"})
+	assert.Error(t, err)
+	_, err = provider.Create(ctx, customerID, &SubscriptionParams{Type: "membership", Plan: "gold", Token: fakeDeclinedToken})
+	assert.Error(t, err)
+
+	remote, err := provider.Create(ctx, customerID, &SubscriptionParams{Type: "membership", Plan: "gold"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, models.StatusActive, remote.Status)
+	assert.Equal(t, 1, remote.Quantity)
+	if assert.NotNil(t, remote.PeriodEnd) {
+		assert.Equal(t, remote.PeriodStart.AddDate(0, 1, 0), *remote.PeriodEnd)
+	}
+
+	updated, err := provider.Update(ctx, remote.ID, &SubscriptionParams{Plan: "silver", Quantity: 3})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, remote.ID, updated.ID)
+	assert.Equal(t, 3, updated.Quantity)
+	stored := new(models.FakeSubscription)
+	db.Where("id = ?", remote.ID).First(stored)
+	assert.Equal(t, "silver", stored.Plan)
+
+	canceling, err := provider.CancelAtPeriodEnd(ctx, remote.ID)
+	if assert.NoError(t, err) && assert.NotNil(t, canceling.CancelAt) {
+		assert.Equal(t, *canceling.PeriodEnd, *canceling.CancelAt)
+		assert.Equal(t, models.StatusActive, canceling.Status)
+	}
+	reactivated, err := provider.Reactivate(ctx, remote.ID, "")
+	if assert.NoError(t, err) {
+		assert.Nil(t, reactivated.CancelAt)
+	}
+
+	paused, err := provider.Pause(ctx, remote.ID, nil)
+	if assert.NoError(t, err) {
+		assert.Equal(t, models.StatusPaused, paused.Status)
+	}
+	resumed, err := provider.Resume(ctx, remote.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, models.StatusActive, resumed.Status)
+	}
+
+	assert.NoError(t, provider.Delete(ctx, remote.ID))
+	assert.Error(t, provider.Delete(ctx, remote.ID))
+	_, err = provider.Update(ctx, remote.ID, &SubscriptionParams{Plan: "gold"})
+	assert.Error(t, err)
+
+	trial, err := provider.Create(ctx, customerID, &SubscriptionParams{Type: "pokemon", Plan: "gold", TrialDays: 14})
+	if assert.NoError(t, err) && assert.NotNil(t, trial.TrialEnd) {
+		assert.Equal(t, models.StatusTrialing, trial.Status)
+		assert.Equal(t, trial.PeriodStart.AddDate(0, 0, 14), *trial.TrialEnd)
+	}
+
+	db.Delete(models.FakeSubscription{})
+	db.Delete(models.FakeCustomer{})
+}
+
+func TestSubscribeWithFakeProvider(t *testing.T) {
+	provider, err := NewProvider(&conf.Config{Provider: "fake"}, db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	api.payerProxy = provider
+	defer func() { api.payerProxy = &errorProxy{} }()
+	defer db.Delete(models.FakeSubscription{})
+	defer db.Delete(models.FakeCustomer{})
+
+	payload := &subscriptionRequest{StripeKey: "tok_visa", Plan: "gold"}
+	rsp := request(t, "PUT", "/subscriptions/membership", payload, false)
+	sub := new(models.Subscription)
+	extractPayload(t, rsp, sub)
+	user := &models.User{ID: testUserID}
+	defer cleanup(sub, user)
+
+	remote := new(models.FakeSubscription)
+	if assert.NoError(t, db.Where("id = ?", sub.RemoteID).First(remote).Error) {
+		assert.Equal(t, "gold", remote.Plan)
+		assert.Equal(t, "membership", remote.Type)
+	}
+
+	rsp = request(t, "DELETE", "/subscriptions/membership", nil, false)
+	assert.Equal(t, 202, rsp.StatusCode)
+	db.Where("id = ?", sub.RemoteID).First(remote)
+	assert.Equal(t, models.StatusCanceled, remote.Status)
+}
+
+func TestFakeProviderPaymentMethods(t *testing.T) {
+	ctx := context.Background()
+	provider, err := NewProvider(&conf.Config{Provider: "fake"}, db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Delete(models.FakePaymentMethod{})
+	defer db.Delete(models.FakeCustomer{})
+
+	customerID, err := provider.CreateCustomer(ctx, "batman", "bruce@dc.com", "tok_visa", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	amex, err := provider.AddPaymentMethod(ctx, customerID, "tok_amex", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "American Express", amex.Brand)
+		assert.False(t, amex.Default)
+	}
+
+	methods, err := provider.ListPaymentMethods(ctx, customerID)
+	if assert.NoError(t, err) && assert.Len(t, methods, 2) {
+		assert.Equal(t, "4242", methods[0].Last4)
+		assert.True(t, methods[0].Default)
+	}
+
+	assert.NoError(t, provider.SetDefaultPaymentMethod(ctx, customerID, amex.ID))
+	assert.Equal(t, ErrPaymentMethodNotFound, provider.SetDefaultPaymentMethod(ctx, customerID, "nonsense"))
+
+	// removing the default makes the other card the default
+	assert.NoError(t, provider.DeletePaymentMethod(ctx, customerID, amex.ID))
+	assert.Equal(t, ErrPaymentMethodNotFound, provider.DeletePaymentMethod(ctx, customerID, amex.ID))
+	methods, err = provider.ListPaymentMethods(ctx, customerID)
+	if assert.NoError(t, err) && assert.Len(t, methods, 1) {
+		assert.True(t, methods[0].Default)
+	}
+}
+
+func TestFakeProviderCoupons(t *testing.T) {
+	ctx := context.Background()
+	provider, err := NewProvider(&conf.Config{Provider: "fake"}, db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer db.Delete(models.FakeSubscription{})
+	defer db.Delete(models.FakeCustomer{})
+
+	c, err := provider.GetCoupon(ctx, "20OFF")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 20, c.PercentOff)
+		assert.True(t, c.Valid)
+	}
+	_, err = provider.GetCoupon(ctx, "FREE")
+	assert.Equal(t, ErrCouponNotFound, err)
+	_, err = provider.GetCoupon(ctx, "200OFF")
+	assert.Equal(t, ErrCouponNotFound, err)
+
+	promo, err := provider.GetPromotionCode(ctx, "PROMO-50OFF")
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "50OFF", promo.ID)
+	assert.NotEmpty(t, promo.PromotionCode)
+
+	customerID, err := provider.CreateCustomer(ctx, "batman", "bruce@dc.com", "tok_visa", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = provider.Create(ctx, customerID, &SubscriptionParams{Type: "membership", Plan: "gold", Coupon: "FREE"})
+	assert.Equal(t, ErrCouponNotFound, err)
+
+	remote, err := provider.Create(ctx, customerID, &SubscriptionParams{Type: "membership", Plan: "gold", PromotionCode: promo.PromotionCode})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "50OFF", remote.Coupon)
+	}
+	updated, err := provider.Update(ctx, remote.ID, &SubscriptionParams{Plan: "silver", Coupon: "10OFF"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "10OFF", updated.Coupon)
+	}
+}
+
+func TestFakeProviderItems(t *testing.T) {
+	ctx := context.Background()
+	provider, err := NewProvider(&conf.Config{Provider: "fake"}, db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	customerID, err := provider.CreateCustomer(ctx, "batman", "bruce@dc.com", "tok_visa", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	remote, err := provider.Create(ctx, customerID, &SubscriptionParams{
+		Type:  "membership",
+		Plan:  "gold",
+		Items: []ItemParams{{Plan: "storage", Quantity: 2}},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	// the plan is an item too
+	if assert.Len(t, remote.Items, 2) {
+		assert.Equal(t, "gold", remote.Items[0].Plan)
+		assert.Equal(t, "storage", remote.Items[1].Plan)
+		assert.Equal(t, 2, remote.Items[1].Quantity)
+	}
+
+	// without items the add-ons stay
+	updated, err := provider.Update(ctx, remote.ID, &SubscriptionParams{Plan: "silver"})
+	if assert.NoError(t, err) {
+		assert.Len(t, updated.Items, 2)
+	}
+
+	updated, err = provider.Update(ctx, remote.ID, &SubscriptionParams{Plan: "silver", Items: []ItemParams{{Plan: "support"}}})
+	if assert.NoError(t, err) && assert.Len(t, updated.Items, 2) {
+		assert.Equal(t, "silver", updated.Items[0].Plan)
+		assert.Equal(t, "support", updated.Items[1].Plan)
+		assert.Equal(t, 1, updated.Items[1].Quantity)
+	}
+
+	sub := &models.Subscription{Plan: "silver"}
+	updated.Apply(sub)
+	assert.Equal(t, updated.Items[0].ID, sub.RemoteItemID)
+	if assert.Len(t, sub.Items, 1) {
+		assert.Equal(t, "support", sub.Items[0].Plan)
+	}
+}
+
+func TestFakeProviderInvoices(t *testing.T) {
+	ctx := context.Background()
+	plans := conf.PlansConfig{"membership": {
+		"gold":    {Name: "Gold", Price: 2000, Currency: "eur"},
+		"storage": {Name: "Extra storage", Price: 500},
+	}}
+	provider, err := NewProvider(&conf.Config{Provider: "fake", Plans: plans}, db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	customerID, err := provider.CreateCustomer(ctx, "batman", "bruce@dc.com", "tok_visa", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	remote, err := provider.Create(ctx, customerID, &SubscriptionParams{
+		Type:   "membership",
+		Plan:   "gold",
+		Items:  []ItemParams{{Plan: "storage", Quantity: 2}},
+		Coupon: "50OFF",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	invoices, err := provider.ListInvoices(ctx, customerID, 10)
+	if !assert.NoError(t, err) || !assert.Len(t, invoices, 1) {
+		return
+	}
+	invoice := invoices[0]
+	assert.Equal(t, remote.ID, invoice.SubscriptionID)
+	assert.Equal(t, "paid", invoice.Status)
+	assert.Equal(t, "eur", invoice.Currency)
+	assert.Equal(t, 1500, invoice.Amount)
+	if assert.Len(t, invoice.Lines, 2) {
+		assert.Equal(t, "1 x Gold", invoice.Lines[0].Description)
+		assert.Equal(t, 2000, invoice.Lines[0].Amount)
+		assert.Equal(t, 1000, invoice.Lines[1].Amount)
+	}
+
+	found, err := provider.GetInvoice(ctx, customerID, invoice.ID)
+	if assert.NoError(t, err) {
+		assert.Equal(t, invoice.ID, found.ID)
+	}
+	_, err = provider.GetInvoice(ctx, "someone-else", invoice.ID)
+	assert.Equal(t, ErrInvoiceNotFound, err)
+}
+
+func TestFakeProviderPreview(t *testing.T) {
+	ctx := context.Background()
+	plans := conf.PlansConfig{"membership": {
+		"gold":     {Price: 2000},
+		"platinum": {Price: 5000},
+	}}
+	provider, err := NewProvider(&conf.Config{Provider: "fake", Plans: plans}, db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	customerID, err := provider.CreateCustomer(ctx, "batman", "bruce@dc.com", "tok_visa", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	preview, err := provider.PreviewInvoice(ctx, customerID, "", &SubscriptionParams{Type: "membership", Plan: "gold"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2000, preview.Amount)
+		assert.Equal(t, "draft", preview.Status)
+	}
+
+	remote, err := provider.Create(ctx, customerID, &SubscriptionParams{Type: "membership", Plan: "gold"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	preview, err = provider.PreviewInvoice(ctx, customerID, remote.ID, &SubscriptionParams{Plan: "platinum", Quantity: 2})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 10000, preview.Amount)
+		// it is the invoice of the next period
+		if assert.NotNil(t, preview.PeriodStart) {
+			assert.Equal(t, *remote.PeriodEnd, *preview.PeriodStart)
+		}
+	}
+
+	// nothing changed
+	stored := new(models.FakeSubscription)
+	db.Where("id = ?", remote.ID).First(stored)
+	assert.Equal(t, "gold", stored.Plan)
+	assert.Equal(t, 1, stored.Quantity)
+	invoices, err := provider.ListInvoices(ctx, customerID, 10)
+	if assert.NoError(t, err) {
+		assert.Len(t, invoices, 1)
+	}
+}
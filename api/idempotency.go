@@ -0,0 +1,153 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/guregu/kami"
+	"github.com/netlify/gojoin/models"
+)
+
+const (
+	idempotencyKeyHeader    = "Idempotency-Key"
+	idempotentReplayHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength = 255
+
+	// how long we keep replaying a response, after that the key can be reused
+	idempotencyKeyTTL = 24 * time.Hour
+)
+
+// idempotent wraps a handler so that requests with an Idempotency-Key header are
+// only processed once. Retries with the same key and the same request get the
+// stored response, retries with a different request are refused.
+func idempotent(handler kami.HandlerFunc) kami.HandlerFunc {
+	return func(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			handler(ctx, w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			writeError(w, http.StatusBadRequest, "Idempotency-Key must be at most %d characters", maxIdempotencyKeyLength)
+			return
+		}
+
+		log := getLogger(ctx).WithField("idempotency_key", key)
+		db := getDB(ctx)
+		claims := getClaims(ctx)
+
+		body, err := ioutil.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Failed to read request body")
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		fingerprint := requestFingerprint(r, body)
+
+		existing := new(models.IdempotencyKey)
+		rsp := db.Where("tenant_id = ? AND user_id = ? AND idempotency_key = ?", getTenantID(ctx), claims.Subject, key).First(existing)
+		switch {
+		case rsp.Error == nil && time.Since(existing.CreatedAt) > idempotencyKeyTTL:
+			log.Debug("Idempotency key expired, processing request again")
+			if rsp := db.Delete(existing); rsp.Error != nil {
+				log.WithError(rsp.Error).Warn("Failed to remove expired idempotency key")
+				writeError(w, http.StatusInternalServerError, "DB error while checking idempotency key")
+				return
+			}
+		case rsp.Error == nil:
+			replayIdempotentResponse(ctx, w, existing, fingerprint)
+			return
+		case !rsp.RecordNotFound():
+			log.WithError(rsp.Error).Warn("Failed to look up idempotency key")
+			writeError(w, http.StatusInternalServerError, "DB error while checking idempotency key")
+			return
+		}
+
+		// claim the key before doing anything, the unique index makes sure only one
+		// request with the same key gets through.
+		record := &models.IdempotencyKey{
+			TenantID:    getTenantID(ctx),
+			UserID:      claims.Subject,
+			Key:         key,
+			Fingerprint: fingerprint,
+		}
+		if rsp := db.Create(record); rsp.Error != nil {
+			log.WithError(rsp.Error).Info("Failed to claim idempotency key")
+			writeError(w, http.StatusConflict, "A request with this Idempotency-Key is already being processed")
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: w}
+		keep := false
+		handler(setKeepIdempotencyKey(setIdempotencyKey(ctx, key), &keep), recorder, r)
+
+		// server errors aren't stored so the client can retry them, unless the
+		// change was already rolled back or queued with the payer
+		if recorder.status == 0 || (recorder.status >= http.StatusInternalServerError && !keep) {
+			if rsp := db.Delete(record); rsp.Error != nil {
+				log.WithError(rsp.Error).Warn("Failed to release idempotency key")
+			}
+			return
+		}
+
+		record.StatusCode = recorder.status
+		record.Response = recorder.body.String()
+		if rsp := db.Save(record); rsp.Error != nil {
+			log.WithError(rsp.Error).Warn("Failed to store response for idempotency key")
+		}
+	}
+}
+
+func replayIdempotentResponse(ctx context.Context, w http.ResponseWriter, existing *models.IdempotencyKey, fingerprint string) {
+	log := getLogger(ctx).WithField("idempotency_key", existing.Key)
+	if existing.Fingerprint != fingerprint {
+		log.Info("Idempotency key reused for a different request")
+		writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request")
+		return
+	}
+
+	if existing.StatusCode == 0 {
+		writeError(w, http.StatusConflict, "A request with this Idempotency-Key is already being processed")
+		return
+	}
+
+	log.Info("Replaying stored response for idempotency key")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(idempotentReplayHeader, "true")
+	w.WriteHeader(existing.StatusCode)
+	w.Write([]byte(existing.Response))
+}
+
+func requestFingerprint(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder passes everything through to the real writer and keeps
+// a copy of the status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/netlify/gojoin/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotentCreateIsReplayed(t *testing.T) {
+	tp := &testProxy{createSubID: "remote-id", createCustomerID: "remote-user-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	headers := map[string]string{idempotencyKeyHeader: "create-membership-1"}
+	payload := &subscriptionRequest{
+		StripeKey: "something",
+		Plan:      "super-important",
+	}
+
+	first := requestWithHeaders(t, "PUT", "/subscriptions/membership", payload, false, headers)
+	firstSub := new(models.Subscription)
+	extractPayload(t, first, firstSub)
+	defer cleanup(firstSub, &models.User{ID: testUserID})
+	defer db.Unscoped().Where("user_id = ?", testUserID).Delete(models.IdempotencyKey{})
+
+	second := requestWithHeaders(t, "PUT", "/subscriptions/membership", payload, false, headers)
+	assert.Equal(t, "true", second.Header.Get(idempotentReplayHeader))
+	secondSub := new(models.Subscription)
+	extractPayload(t, second, secondSub)
+
+	assert.Equal(t, firstSub.ID, secondSub.ID)
+	assert.Len(t, tp.createCalls, 1)
+	assert.Len(t, tp.createCustomerCalls, 1)
+	assert.Equal(t, testUserID+":create-membership-1", tp.createCalls[0].idempotencyKey)
+	assert.Empty(t, tp.updateCalls)
+
+	// same key, different request
+	payload.Plan = "something-else"
+	rsp := requestWithHeaders(t, "PUT", "/subscriptions/membership", payload, false, headers)
+	extractError(t, http.StatusUnprocessableEntity, rsp)
+	assert.Len(t, tp.createCalls, 1)
+	assert.Empty(t, tp.updateCalls)
+}
+
+func TestIdempotentDeleteIsReplayed(t *testing.T) {
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "nonsense")
+	defer cleanup(s1, tu)
+	defer db.Unscoped().Where("user_id = ?", testUserID).Delete(models.IdempotencyKey{})
+
+	headers := map[string]string{idempotencyKeyHeader: "delete-membership-1"}
+	for i := 0; i < 2; i++ {
+		rsp := requestWithHeaders(t, "DELETE", "/subscriptions/membership", nil, false, headers)
+		b, _ := ioutil.ReadAll(rsp.Body)
+		assert.Equal(t, "{}\n", string(b))
+		assert.Equal(t, http.StatusAccepted, rsp.StatusCode)
+	}
+
+	assert.Len(t, tp.deleteCalls, 1)
+}
+
+func TestIdempotencyKeyNotStoredOnServerError(t *testing.T) {
+	api.payerProxy = errorProxy{}
+	headers := map[string]string{idempotencyKeyHeader: "fails"}
+	payload := &subscriptionRequest{
+		StripeKey: "something",
+		Plan:      "unicorn",
+	}
+
+	rsp := requestWithHeaders(t, "PUT", "/subscriptions/membership", payload, false, headers)
+	extractError(t, http.StatusInternalServerError, rsp)
+
+	count := 0
+	db.Model(&models.IdempotencyKey{}).Where("user_id = ?", testUserID).Count(&count)
+	assert.Equal(t, 0, count)
+}
+
+func TestIdempotencyKeyStoredWhenChangeRolledBack(t *testing.T) {
+	// an empty remote id will fail validation when saving the subscription
+	tp := &testProxy{createSubID: ""}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	defer cleanup(tu)
+	defer db.Unscoped().Where("user_id = ?", testUserID).Delete(models.FailedWrite{})
+	defer db.Unscoped().Where("user_id = ?", testUserID).Delete(models.IdempotencyKey{})
+
+	headers := map[string]string{idempotencyKeyHeader: "rolled-back"}
+	payload := &subscriptionRequest{
+		StripeKey: "something",
+		Plan:      "super-important",
+	}
+
+	// the payer would replay the deleted subscription for the key
+	extractError(t, http.StatusInternalServerError, requestWithHeaders(t, "PUT", "/subscriptions/membership", payload, false, headers))
+	rsp := requestWithHeaders(t, "PUT", "/subscriptions/membership", payload, false, headers)
+	assert.Equal(t, "true", rsp.Header.Get(idempotentReplayHeader))
+	extractError(t, http.StatusInternalServerError, rsp)
+	assert.Len(t, tp.createCalls, 1)
+	assert.Len(t, tp.deleteCalls, 1)
+}
@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/guregu/kami"
+)
+
+const (
+	defaultInvoiceLimit = 24
+	maxInvoiceLimit     = 100
+)
+
+// listInvoices returns the last invoices of the customer, newest first. The
+// number can be set with ?limit=. Users that never subscribed don't have any.
+func listInvoices(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	limit := defaultInvoiceLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxInvoiceLimit {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and %d", maxInvoiceLimit)
+			return
+		}
+	}
+
+	target := getTargetUser(ctx)
+	user, httpErr := getUser(ctx, target.ID)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	if user == nil {
+		sendJSON(w, http.StatusOK, []*Invoice{})
+		return
+	}
+
+	invoices, err := getPayerProxy(ctx).ListInvoices(ctx, user.RemoteID, limit)
+	if err != nil {
+		getLogger(ctx).WithError(err).Warn("Failed to list invoices in stripe")
+		writeError(w, http.StatusInternalServerError, "Error communicating with stripe: %s", err)
+		return
+	}
+	sendJSON(w, http.StatusOK, invoices)
+}
+
+// viewInvoice returns an invoice of the customer, the invoices of other
+// customers aren't found
+func viewInvoice(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	id := kami.Param(ctx, "id")
+	target := getTargetUser(ctx)
+	user, httpErr := getUser(ctx, target.ID)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	if user == nil {
+		notFoundError(w, "No invoice found with id %s", id)
+		return
+	}
+
+	invoice, err := getPayerProxy(ctx).GetInvoice(ctx, user.RemoteID, id)
+	if err != nil {
+		if err == ErrInvoiceNotFound {
+			notFoundError(w, "No invoice found with id %s", id)
+			return
+		}
+		getLogger(ctx).WithError(err).WithField("invoice", id).Warn("Failed to get invoice from stripe")
+		writeError(w, http.StatusInternalServerError, "Error communicating with stripe: %s", err)
+		return
+	}
+	sendJSON(w, http.StatusOK, invoice)
+}
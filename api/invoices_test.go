@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListAndViewInvoices(t *testing.T) {
+	tp := &testProxy{invoices: map[string][]*Invoice{
+		"stripe-given-value": {
+			{ID: "in_2", Status: "open", Amount: 2000, Currency: "usd", Lines: []InvoiceLine{{Plan: "gold", Quantity: 1, Amount: 2000}}},
+			{ID: "in_1", Status: "paid", Amount: 2000, AmountPaid: 2000, Currency: "usd", Lines: []InvoiceLine{}},
+		},
+		"someone-else": {{ID: "in_3", Status: "paid"}},
+	}}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	// no customer yet, so no invoices
+	invoices := []*Invoice{}
+	extractPayload(t, request(t, "GET", "/invoices", nil, false), &invoices)
+	assert.Empty(t, invoices)
+	extractError(t, http.StatusNotFound, request(t, "GET", "/invoices/in_1", nil, false))
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	defer cleanup(tu)
+
+	extractPayload(t, request(t, "GET", "/invoices", nil, false), &invoices)
+	if assert.Len(t, invoices, 2) {
+		assert.Equal(t, "in_2", invoices[0].ID)
+		if assert.Len(t, invoices[0].Lines, 1) {
+			assert.Equal(t, "gold", invoices[0].Lines[0].Plan)
+		}
+	}
+	assert.Equal(t, []int{defaultInvoiceLimit}, tp.invoiceCalls)
+
+	extractPayload(t, request(t, "GET", "/invoices?limit=1", nil, false), &invoices)
+	assert.Len(t, invoices, 1)
+	extractError(t, http.StatusBadRequest, request(t, "GET", "/invoices?limit=0", nil, false))
+	extractError(t, http.StatusBadRequest, request(t, "GET", "/invoices?limit=1000", nil, false))
+
+	invoice := new(Invoice)
+	extractPayload(t, request(t, "GET", "/invoices/in_1", nil, false), invoice)
+	assert.Equal(t, "paid", invoice.Status)
+	assert.Equal(t, 2000, invoice.AmountPaid)
+
+	// the invoices of other customers aren't there
+	extractError(t, http.StatusNotFound, request(t, "GET", "/invoices/in_3", nil, false))
+}
+
+func TestAdminListInvoices(t *testing.T) {
+	tp := &testProxy{invoices: map[string][]*Invoice{"eulav-epits-emos": {{ID: "in_1"}}}}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser("batman", "bruce@dc.com", "eulav-epits-emos")
+	defer cleanup(tu)
+
+	extractError(t, http.StatusForbidden, request(t, "GET", "/admin/users/batman/invoices", nil, false))
+
+	invoices := []*Invoice{}
+	extractPayload(t, request(t, "GET", "/admin/users/batman/invoices", nil, true), &invoices)
+	assert.Len(t, invoices, 1)
+	invoice := new(Invoice)
+	extractPayload(t, request(t, "GET", "/admin/users/batman/invoices/in_1", nil, true), invoice)
+	assert.Equal(t, "in_1", invoice.ID)
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/guregu/kami"
+	"github.com/netlify/gojoin/models"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v1/json"
+)
+
+// addItem adds an add-on to the subscription, or sets the quantity of one it
+// already has
+func addItem(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	payload := new(itemRequest)
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(payload); err != nil {
+		writeError(w, http.StatusBadRequest, "failed to decode payload: "+err.Error())
+		return
+	}
+	if err := payload.Valid(); err != nil {
+		writeError(w, http.StatusBadRequest, "Failed to provide a valid request: "+err.Error())
+		return
+	}
+	subType := kami.Param(ctx, "type")
+	if !getConfig(ctx).Plans.Allows(subType, payload.Plan) {
+		writeError(w, http.StatusBadRequest, "The add-on %s isn't available for subscriptions of type %s", payload.Plan, subType)
+		return
+	}
+
+	sub, lock, httpErr := lockSubscription(ctx)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	defer releaseUser(ctx, lock)
+
+	if payload.Plan == sub.Plan {
+		writeError(w, http.StatusBadRequest, "The plan %s can only be in the subscription once", payload.Plan)
+		return
+	}
+
+	quantity := payload.Quantity
+	if quantity == 0 {
+		quantity = 1
+	}
+	items := itemParams(sub.Items)
+	found := false
+	for i := range items {
+		if items[i].Plan == payload.Plan {
+			items[i].Quantity = quantity
+			found = true
+		}
+	}
+	if !found {
+		items = append(items, ItemParams{Plan: payload.Plan, Quantity: quantity})
+	}
+
+	changeItems(ctx, w, sub, items)
+}
+
+// removeItem removes an add-on from the subscription
+func removeItem(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	plan := kami.Param(ctx, "plan")
+	sub, lock, httpErr := lockSubscription(ctx)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	defer releaseUser(ctx, lock)
+
+	items := []ItemParams{}
+	for _, item := range itemParams(sub.Items) {
+		if item.Plan != plan {
+			items = append(items, item)
+		}
+	}
+	if len(items) == len(sub.Items) {
+		notFoundError(w, "The subscription has no add-on %s", plan)
+		return
+	}
+
+	changeItems(ctx, w, sub, items)
+}
+
+// changeItems gives the subscription the add-ons with the payer and stores them
+func changeItems(ctx context.Context, w http.ResponseWriter, sub *models.Subscription, items []ItemParams) {
+	log := getLogger(ctx).WithFields(logrus.Fields{
+		"type":      sub.Type,
+		"remote_id": sub.RemoteID,
+	})
+	remote, err := getPayerProxy(ctx).Update(ctx, sub.RemoteID, &SubscriptionParams{
+		Plan:   sub.Plan,
+		Items:  items,
+		ItemID: sub.RemoteItemID,
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error communicating with stripe: %s", err)
+		return
+	}
+	log.Info("Changed the add-ons in stripe")
+
+	old := *sub
+	remote.Apply(sub)
+	if httpErr := saveUpdate(setLogger(ctx, log), old, sub); httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	sendJSON(w, http.StatusOK, sub)
+}
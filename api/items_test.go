@@ -0,0 +1,263 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gojoin/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/stripe-go"
+)
+
+func TestCreateWithItems(t *testing.T) {
+	tp := &testProxy{createSubID: "remote-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	defer cleanup(tu)
+	defer db.Delete(models.SubscriptionItem{})
+
+	payload := &subscriptionRequest{
+		Plan:  "gold",
+		Items: []itemRequest{{Plan: "storage", Quantity: 2}, {Plan: "support"}},
+	}
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "PUT", "/subscriptions/membership", payload, false), sub)
+	defer cleanup(&models.Subscription{ID: sub.ID})
+
+	assert.Equal(t, "gold", sub.Plan)
+	assert.Equal(t, "si-gold", sub.RemoteItemID)
+	if assert.Len(t, sub.Items, 2) {
+		assert.Equal(t, "storage", sub.Items[0].Plan)
+		assert.Equal(t, 2, sub.Items[0].Quantity)
+		assert.Equal(t, "si-storage", sub.Items[0].RemoteID)
+		assert.Equal(t, "support", sub.Items[1].Plan)
+		assert.Equal(t, 1, sub.Items[1].Quantity)
+	}
+	if assert.Len(t, tp.createCalls, 1) {
+		assert.Equal(t, []ItemParams{{Plan: "storage", Quantity: 2}, {Plan: "support"}}, tp.createCalls[0].items)
+	}
+
+	found := new(models.Subscription)
+	if assert.NoError(t, db.Preload("Items").Where("id = ?", sub.ID).First(found).Error) {
+		assert.Len(t, found.Items, 2)
+	}
+
+	body := new(getAllResponse)
+	extractPayload(t, request(t, "GET", "/subscriptions", nil, false), body)
+	claims := decodeToken(t, body.Token, config.JWTSecret)
+	if assert.NotNil(t, claims) {
+		meta, _ := claims["app_metadata"].(map[string]interface{})
+		details, _ := meta["subscription_details"].(map[string]interface{})
+		membership, _ := details["membership"].(map[string]interface{})
+		assert.Equal(t, "gold", membership["plan"])
+		assert.Equal(t, map[string]interface{}{"storage": float64(2), "support": float64(1)}, membership["items"])
+	}
+}
+
+func TestAddAndRemoveItems(t *testing.T) {
+	clearAuditLog()
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "gold")
+	defer cleanup(s1, tu)
+	defer db.Delete(models.SubscriptionItem{})
+	tp.updateSubID = s1.RemoteID
+
+	extractError(t, http.StatusNotFound, request(t, "POST", "/subscriptions/pokemon/items", &itemRequest{Plan: "storage"}, false))
+	extractError(t, http.StatusBadRequest, request(t, "POST", "/subscriptions/membership/items", &itemRequest{}, false))
+	extractError(t, http.StatusBadRequest, request(t, "POST", "/subscriptions/membership/items", &itemRequest{Plan: "gold"}, false))
+
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "POST", "/subscriptions/membership/items", &itemRequest{Plan: "storage"}, false), sub)
+	if assert.Len(t, sub.Items, 1) {
+		assert.Equal(t, "storage", sub.Items[0].Plan)
+		assert.Equal(t, 1, sub.Items[0].Quantity)
+	}
+	assert.Equal(t, "gold", sub.Plan)
+	if assert.Len(t, tp.updateCalls, 1) {
+		assert.Equal(t, "gold", tp.updateCalls[0].plan)
+		assert.Equal(t, []ItemParams{{Plan: "storage", Quantity: 1}}, tp.updateCalls[0].items)
+	}
+
+	// adding it again sets the quantity
+	sub = new(models.Subscription)
+	extractPayload(t, request(t, "POST", "/subscriptions/membership/items", &itemRequest{Plan: "storage", Quantity: 3}, false), sub)
+	if assert.Len(t, sub.Items, 1) {
+		assert.Equal(t, 3, sub.Items[0].Quantity)
+	}
+	if assert.Len(t, tp.updateCalls, 2) {
+		// the item of the plan is known by now
+		assert.Equal(t, "si-gold", tp.updateCalls[1].itemID)
+	}
+
+	extractError(t, http.StatusNotFound, request(t, "DELETE", "/subscriptions/membership/items/support", nil, false))
+
+	sub = new(models.Subscription)
+	extractPayload(t, request(t, "DELETE", "/subscriptions/membership/items/storage", nil, false), sub)
+	assert.Empty(t, sub.Items)
+	if assert.Len(t, tp.updateCalls, 3) {
+		assert.Equal(t, []ItemParams{}, tp.updateCalls[2].items)
+	}
+
+	count := 0
+	db.Model(&models.SubscriptionItem{}).Where("subscription_id = ?", s1.ID).Count(&count)
+	assert.Equal(t, 0, count)
+
+	entries := []models.AuditLogEntry{}
+	db.Find(&entries)
+	assert.Len(t, entries, 3)
+}
+
+func TestUpdateKeepsItems(t *testing.T) {
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "gold")
+	defer cleanup(s1, tu)
+	defer db.Delete(models.SubscriptionItem{})
+	tp.updateSubID = s1.RemoteID
+
+	payload := &subscriptionRequest{Plan: "gold", Items: []itemRequest{{Plan: "storage", Quantity: 2}}}
+	extractPayload(t, request(t, "PUT", "/subscriptions/membership", payload, false), new(models.Subscription))
+
+	// without items the add-ons stay, the plan changes on its item
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "PUT", "/subscriptions/membership", &subscriptionRequest{Plan: "platinum"}, false), sub)
+	assert.Equal(t, "platinum", sub.Plan)
+	if assert.Len(t, sub.Items, 1) {
+		assert.Equal(t, "storage", sub.Items[0].Plan)
+	}
+	if assert.Len(t, tp.updateCalls, 2) {
+		assert.Nil(t, tp.updateCalls[1].items)
+		assert.Equal(t, "si-gold", tp.updateCalls[1].itemID)
+	}
+
+	// an empty list removes them
+	sub = new(models.Subscription)
+	extractPayload(t, request(t, "PUT", "/subscriptions/membership", &subscriptionRequest{Plan: "platinum", Items: []itemRequest{}}, false), sub)
+	assert.Empty(t, sub.Items)
+}
+
+func TestSaveKeepsOldOnFailure(t *testing.T) {
+	s1 := createSubscription(testUserID, "membership", "gold")
+	defer cleanup(s1)
+	defer db.Delete(models.SubscriptionItem{})
+	s1.Items = []models.SubscriptionItem{{Plan: "storage", Quantity: 1}}
+	if !assert.NoError(t, models.SaveSubscription(db, s1)) {
+		return
+	}
+
+	db.Callback().Create().Before("gorm:create").Register("test:fail_items", func(scope *gorm.Scope) {
+		if item, ok := scope.Value.(*models.SubscriptionItem); ok && item.Plan == "broken" {
+			scope.Err(errors.New("db is down"))
+		}
+	})
+	defer db.Callback().Create().Remove("test:fail_items")
+
+	s1.Plan = "platinum"
+	s1.Items = []models.SubscriptionItem{{Plan: "backups", Quantity: 1}, {Plan: "broken", Quantity: 1}}
+	assert.Error(t, models.SaveSubscription(db, s1))
+
+	stored := []models.SubscriptionItem{}
+	db.Where("subscription_id = ?", s1.ID).Find(&stored)
+	if assert.Len(t, stored, 1) {
+		assert.Equal(t, "storage", stored[0].Plan)
+	}
+	// and the subscription keeps its plan
+	storedSub := new(models.Subscription)
+	if assert.NoError(t, db.Where("id = ?", s1.ID).First(storedSub).Error) {
+		assert.Equal(t, "gold", storedSub.Plan)
+	}
+}
+
+func TestCreateRolledBackWhenItemsFail(t *testing.T) {
+	tp := &testProxy{createSubID: "remote-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	defer cleanup(tu)
+	defer db.Where("user_id = ?", testUserID).Delete(models.FailedWrite{})
+
+	db.Callback().Create().Before("gorm:create").Register("test:fail_items", func(scope *gorm.Scope) {
+		if _, ok := scope.Value.(*models.SubscriptionItem); ok {
+			scope.Err(errors.New("db is down"))
+		}
+	})
+	defer db.Callback().Create().Remove("test:fail_items")
+
+	payload := &subscriptionRequest{Plan: "gold", Items: []itemRequest{{Plan: "storage"}}}
+	extractError(t, http.StatusInternalServerError, request(t, "PUT", "/subscriptions/membership", payload, false))
+	assert.Equal(t, []string{"remote-id"}, tp.deleteCalls)
+
+	// the subscription isn't stored without its add-ons
+	count := 0
+	db.Model(&models.Subscription{}).Where("user_id = ?", testUserID).Count(&count)
+	assert.Equal(t, 0, count)
+}
+
+func TestInvalidItems(t *testing.T) {
+	for _, payload := range []*subscriptionRequest{
+		{Plan: "gold", Items: []itemRequest{{Plan: "gold"}}},
+		{Plan: "gold", Items: []itemRequest{{Plan: "storage"}, {Plan: "storage"}}},
+		{Plan: "gold", Items: []itemRequest{{Quantity: 1}}},
+		{Plan: "gold", Items: []itemRequest{{Plan: "storage", Quantity: -1}}},
+		{Plan: "gold", ChangeAt: changeAtPeriodEnd, Items: []itemRequest{}},
+	} {
+		assert.Error(t, payload.Valid(), "%+v", payload)
+	}
+}
+
+func TestWebhookUpdatesItems(t *testing.T) {
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "gold")
+	defer cleanup(s1, tu)
+	defer db.Delete(models.SubscriptionItem{})
+	s1.RemoteItemID = "si_plan"
+	db.Save(s1)
+
+	// with several items stripe has no plan for the subscription
+	body := fmt.Sprintf(`{"id": "evt_11", "type": "customer.subscription.updated", "data": {"object": {"id": "%s", "status": "active", "plan": null, "items": {"data": [
+		{"id": "si_plan", "plan": {"id": "platinum"}, "quantity": 4},
+		{"id": "si_storage", "plan": {"id": "storage"}, "quantity": 2}
+	]}}}}`, s1.RemoteID)
+	rsp := webhookRequest(t, body, time.Now(), config.StripeWebhookSecret)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	found := new(models.Subscription)
+	if assert.NoError(t, db.Preload("Items").Where("id = ?", s1.ID).First(found).Error) {
+		assert.Equal(t, "platinum", found.Plan)
+		assert.Equal(t, 4, found.Quantity)
+		if assert.Len(t, found.Items, 1) {
+			assert.Equal(t, "si_storage", found.Items[0].RemoteID)
+			assert.Equal(t, 2, found.Items[0].Quantity)
+		}
+	}
+}
+
+func TestReactivateSetsThePlanOnItsItem(t *testing.T) {
+	current := &stripe.Sub{ID: "remote-id", Items: &stripe.SubItemList{Values: []*stripe.SubItem{
+		{ID: "item-storage", Plan: &stripe.Plan{ID: "storage"}},
+		{ID: "item-gold", Plan: &stripe.Plan{ID: "gold"}},
+	}}}
+
+	params, err := reactivateParams(current, "item-gold")
+	if assert.NoError(t, err) && assert.Len(t, params.Items, 1) {
+		assert.Equal(t, "item-gold", params.Items[0].ID)
+		assert.Equal(t, "gold", params.Items[0].Plan)
+	}
+
+	// with add-ons we can't guess which item is the plan
+	_, err = reactivateParams(current, "")
+	assert.Error(t, err)
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+)
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 200
+)
+
+type pagination struct {
+	page    int
+	perPage int
+}
+
+// paginate reads the page and per_page query params
+func paginate(r *http.Request) (*pagination, *HTTPError) {
+	p := &pagination{page: 1, perPage: defaultPerPage}
+	query := r.URL.Query()
+
+	if v := query.Get("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page < 1 {
+			return nil, httpError(http.StatusBadRequest, "page must be a positive number")
+		}
+		p.page = page
+	}
+
+	if v := query.Get("per_page"); v != "" {
+		perPage, err := strconv.Atoi(v)
+		if err != nil || perPage < 1 || perPage > maxPerPage {
+			return nil, httpError(http.StatusBadRequest, "per_page must be between 1 and %d", maxPerPage)
+		}
+		p.perPage = perPage
+	}
+
+	return p, nil
+}
+
+func (p *pagination) apply(query *gorm.DB) *gorm.DB {
+	return query.Offset((p.page - 1) * p.perPage).Limit(p.perPage)
+}
+
+// setHeaders adds the X-Total-Count and Link headers to the response
+func (p *pagination) setHeaders(w http.ResponseWriter, r *http.Request, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+	lastPage := (total + p.perPage - 1) / p.perPage
+	if lastPage < 1 {
+		lastPage = 1
+	}
+
+	links := []string{
+		p.link(r, 1, "first"),
+		p.link(r, lastPage, "last"),
+	}
+	if p.page > 1 {
+		links = append(links, p.link(r, p.page-1, "prev"))
+	}
+	if p.page < lastPage {
+		links = append(links, p.link(r, p.page+1, "next"))
+	}
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+func (p *pagination) link(r *http.Request, page int, rel string) string {
+	u := *r.URL
+	query := u.Query()
+	query.Set("page", strconv.Itoa(page))
+	query.Set("per_page", strconv.Itoa(p.perPage))
+	u.RawQuery = query.Encode()
+	return fmt.Sprintf(`<%s>; rel="%s"`, u.RequestURI(), rel)
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/guregu/kami"
+	"github.com/netlify/gojoin/models"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v1/json"
+)
+
+type pauseRequest struct {
+	// ResumeAt is optional, without it the subscription stays paused until it is resumed
+	ResumeAt *time.Time `json:"resume_at,omitempty"`
+}
+
+// pauseSub stops billing a subscription for a while, e.g. for seasonal customers.
+// It keeps its history, but doesn't grant the plan until it is resumed.
+func pauseSub(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	payload := new(pauseRequest)
+	if r.ContentLength != 0 {
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(payload); err != nil {
+			writeError(w, http.StatusBadRequest, "failed to decode payload: "+err.Error())
+			return
+		}
+	}
+	if payload.ResumeAt != nil && !payload.ResumeAt.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, "resume_at must be in the future")
+		return
+	}
+
+	sub, lock, httpErr := lockSubscription(ctx)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	defer releaseUser(ctx, lock)
+
+	if sub.Status != models.StatusActive && sub.Status != models.StatusTrialing {
+		writeError(w, http.StatusBadRequest, "Only active subscriptions can be paused, this one is %s", sub.Status)
+		return
+	}
+
+	log := getLogger(ctx).WithFields(logrus.Fields{
+		"type":      sub.Type,
+		"remote_id": sub.RemoteID,
+		"resume_at": payload.ResumeAt,
+	})
+	remote, err := getPayerProxy(ctx).Pause(ctx, sub.RemoteID, payload.ResumeAt)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error communicating with stripe: %s", err)
+		return
+	}
+	log.Info("Paused subscription in stripe")
+
+	old := *sub
+	remote.Apply(sub)
+	if rsp := getDB(ctx).Save(sub); rsp.Error != nil {
+		log.WithError(rsp.Error).Warnf("Error while saving subscription %+v", sub)
+		httpErr := compensateChange(ctx, old, sub, rsp.Error, func() error {
+			_, err := getPayerProxy(ctx).Resume(ctx, sub.RemoteID)
+			return err
+		})
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
+	audit(ctx, models.AuditPause, sub, "")
+	sendJSON(w, http.StatusOK, sub)
+}
+
+func resumeSub(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	sub, lock, httpErr := lockSubscription(ctx)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	defer releaseUser(ctx, lock)
+
+	if sub.Status != models.StatusPaused {
+		writeError(w, http.StatusBadRequest, "The subscription isn't paused")
+		return
+	}
+
+	log := getLogger(ctx).WithFields(logrus.Fields{
+		"type":      sub.Type,
+		"remote_id": sub.RemoteID,
+	})
+	remote, err := getPayerProxy(ctx).Resume(ctx, sub.RemoteID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error communicating with stripe: %s", err)
+		return
+	}
+	log.Info("Resumed subscription in stripe")
+
+	old := *sub
+	remote.Apply(sub)
+	if rsp := getDB(ctx).Save(sub); rsp.Error != nil {
+		log.WithError(rsp.Error).Warnf("Error while saving subscription %+v", sub)
+		httpErr := compensateChange(ctx, old, sub, rsp.Error, func() error {
+			return pauseAgain(ctx, &old)
+		})
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
+	audit(ctx, models.AuditResume, sub, "")
+	sendJSON(w, http.StatusOK, sub)
+}
+
+// pauseAgain undoes a resume, the subscription is paused like it was before:
+// until the same date, or until it is resumed if the pause was open-ended
+func pauseAgain(ctx context.Context, old *models.Subscription) error {
+	var resumeAt *time.Time
+	if old.ResumeAt != nil {
+		at := *old.ResumeAt
+		resumeAt = &at
+	}
+	_, err := getPayerProxy(ctx).Pause(ctx, old.RemoteID, resumeAt)
+	return err
+}
+
+// lockSubscription locks the target user and finds their subscription of the
+// type in the path, which must exist
+func lockSubscription(ctx context.Context) (*models.Subscription, *models.UserLock, *HTTPError) {
+	target := getTargetUser(ctx)
+	lock, httpErr := lockUser(ctx, target.ID)
+	if httpErr != nil {
+		return nil, nil, httpErr
+	}
+
+	sub, httpErr := getSubscription(ctx, target.ID, kami.Param(ctx, "type"))
+	if httpErr == nil && sub == nil {
+		httpErr = httpError(http.StatusNotFound, "No subscription found")
+	}
+	if httpErr != nil {
+		releaseUser(ctx, lock)
+		return nil, nil, httpErr
+	}
+	return sub, lock, nil
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/netlify/gojoin/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPauseAndResume(t *testing.T) {
+	clearAuditLog()
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "gold")
+	defer cleanup(s1, tu)
+
+	extractError(t, http.StatusNotFound, request(t, "POST", "/subscriptions/pokemon/pause", nil, false))
+	extractError(t, http.StatusBadRequest, request(t, "POST", "/subscriptions/membership/resume", nil, false))
+	past := &pauseRequest{ResumeAt: &time.Time{}}
+	extractError(t, http.StatusBadRequest, request(t, "POST", "/subscriptions/membership/pause", past, false))
+
+	resumeAt := time.Now().AddDate(0, 3, 0).UTC().Truncate(time.Second)
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "POST", "/subscriptions/membership/pause", &pauseRequest{ResumeAt: &resumeAt}, false), sub)
+	assert.Equal(t, models.StatusPaused, sub.Status)
+	if assert.NotNil(t, sub.ResumeAt) {
+		assert.Equal(t, resumeAt.Unix(), sub.ResumeAt.Unix())
+	}
+	assert.Len(t, tp.pauseCalls, 1)
+	extractError(t, http.StatusBadRequest, request(t, "POST", "/subscriptions/membership/pause", nil, false))
+
+	// the token doesn't grant the plan while paused
+	body := new(getAllResponse)
+	extractPayload(t, request(t, "GET", "/subscriptions", nil, false), body)
+	claims := decodeToken(t, body.Token, config.JWTSecret)
+	if assert.NotNil(t, claims) {
+		meta, _ := claims["app_metadata"].(map[string]interface{})
+		subs, _ := meta["subscriptions"].(map[string]interface{})
+		assert.NotContains(t, subs, "membership")
+		details, _ := meta["subscription_details"].(map[string]interface{})
+		membership, _ := details["membership"].(map[string]interface{})
+		assert.Equal(t, models.StatusPaused, membership["status"])
+		assert.Nil(t, membership["plan"])
+		assert.Equal(t, float64(resumeAt.Unix()), membership["resume_at"])
+	}
+
+	sub = new(models.Subscription)
+	extractPayload(t, request(t, "POST", "/subscriptions/membership/resume", nil, false), sub)
+	assert.Equal(t, models.StatusActive, sub.Status)
+	assert.Nil(t, sub.ResumeAt)
+	assert.Equal(t, []string{s1.RemoteID}, tp.resumeCalls)
+
+	entries := []models.AuditLogEntry{}
+	db.Order("created_at asc").Find(&entries)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, models.AuditPause, entries[0].Action)
+		assert.Equal(t, models.AuditResume, entries[1].Action)
+	}
+}
+
+func TestWebhookKeepsPausedSubscription(t *testing.T) {
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "gold")
+	defer cleanup(s1, tu)
+
+	resumeAt := time.Now().AddDate(0, 1, 0).Unix()
+	body := fmt.Sprintf(`{"id": "evt_9", "type": "customer.subscription.updated", "data": {"object": {"id": "%s", "status": "active", "plan": {"id": "gold"}, "pause_collection": {"behavior": "void", "resumes_at": %d}}}}`, s1.RemoteID, resumeAt)
+	rsp := webhookRequest(t, body, time.Now(), config.StripeWebhookSecret)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	found := &models.Subscription{ID: s1.ID}
+	if assert.NoError(t, db.Find(found).Error) {
+		assert.Equal(t, models.StatusPaused, found.Status)
+		if assert.NotNil(t, found.ResumeAt) {
+			assert.Equal(t, resumeAt, found.ResumeAt.Unix())
+		}
+	}
+
+	// stripe resumed it
+	body = fmt.Sprintf(`{"id": "evt_10", "type": "customer.subscription.updated", "data": {"object": {"id": "%s", "status": "active", "plan": {"id": "gold"}}}}`, s1.RemoteID)
+	rsp = webhookRequest(t, body, time.Now(), config.StripeWebhookSecret)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	found = &models.Subscription{ID: s1.ID}
+	if assert.NoError(t, db.Find(found).Error) {
+		assert.Equal(t, models.StatusActive, found.Status)
+		assert.Nil(t, found.ResumeAt)
+	}
+}
@@ -1,65 +1,950 @@
 package api
 
 import (
+	"context"
 	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gojoin/conf"
+	"github.com/netlify/gojoin/models"
 	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/card"
+	"github.com/stripe/stripe-go/coupon"
 	"github.com/stripe/stripe-go/customer"
 	"github.com/stripe/stripe-go/sub"
 )
 
-type payerProxy interface {
-	createCustomer(userID, email, payToken string) (string, error)
-	create(userID, plan, token string) (string, error)
-	update(subID, plan, token string) (string, error)
-	delete(subID string) error
+// PayerProxy is a payment provider that bills the subscriptions. The idempotency
+// key is empty when the request didn't send one, otherwise the provider should make
+// sure that retrying a call with the same key only has an effect once.
+type PayerProxy interface {
+	// CreateCustomer registers the user with the provider and returns its id for them
+	CreateCustomer(ctx context.Context, userID, email, payToken, idempotencyKey string) (string, error)
+	// UpdatePaymentMethod makes the token the customer's default payment method
+	UpdatePaymentMethod(ctx context.Context, customerID, token, idempotencyKey string) error
+	// ListPaymentMethods lists the customer's payment methods with the default one marked
+	ListPaymentMethods(ctx context.Context, customerID string) ([]*PaymentMethod, error)
+	// AddPaymentMethod adds the token as a payment method of the customer
+	AddPaymentMethod(ctx context.Context, customerID, token, idempotencyKey string) (*PaymentMethod, error)
+	// DeletePaymentMethod removes a payment method, ErrPaymentMethodNotFound means the customer doesn't have it
+	DeletePaymentMethod(ctx context.Context, customerID, methodID string) error
+	// SetDefaultPaymentMethod makes a payment method the customer's default, ErrPaymentMethodNotFound
+	// means the customer doesn't have it
+	SetDefaultPaymentMethod(ctx context.Context, customerID, methodID string) error
+	// Create subscribes the customer to the plan and its add-ons
+	Create(ctx context.Context, customerID string, params *SubscriptionParams) (*RemoteSubscription, error)
+	// Update moves the subscription to another plan, a token replaces the customer's payment method,
+	// a quantity the number of seats and a coupon or promotion code the discount. Items replace
+	// the add-ons if they are set.
+	Update(ctx context.Context, subID string, params *SubscriptionParams) (*RemoteSubscription, error)
+	// Delete cancels the subscription, ErrSubscriptionNotFound means there is none
+	Delete(ctx context.Context, subID string) error
+	// CancelAtPeriodEnd cancels the subscription when the current period ends, until then it
+	// stays active
+	CancelAtPeriodEnd(ctx context.Context, subID string) (*RemoteSubscription, error)
+	// Reactivate undoes a cancellation at the end of the period, itemID is the item of the plan
+	// if the subscription has add-ons
+	Reactivate(ctx context.Context, subID, itemID string) (*RemoteSubscription, error)
+	// Pause stops billing the subscription until it is resumed, or until resumeAt if it is set
+	Pause(ctx context.Context, subID string, resumeAt *time.Time) (*RemoteSubscription, error)
+	// Resume starts billing a paused subscription again
+	Resume(ctx context.Context, subID string) (*RemoteSubscription, error)
+	// GetCoupon looks up a coupon by its id, ErrCouponNotFound means there is none
+	GetCoupon(ctx context.Context, id string) (*Coupon, error)
+	// GetPromotionCode looks up the coupon behind an active promotion code, ErrCouponNotFound
+	// means there is none
+	GetPromotionCode(ctx context.Context, code string) (*Coupon, error)
+	// ListInvoices lists the last invoices of the customer, newest first
+	ListInvoices(ctx context.Context, customerID string, limit int) ([]*Invoice, error)
+	// GetInvoice looks up an invoice of the customer, ErrInvoiceNotFound means the customer
+	// doesn't have it
+	GetInvoice(ctx context.Context, customerID, id string) (*Invoice, error)
+	// PreviewInvoice is the next invoice of the subscription if it was changed with the params,
+	// nothing is changed. An empty subID previews a new subscription.
+	PreviewInvoice(ctx context.Context, customerID, subID string, params *SubscriptionParams) (*Invoice, error)
 }
 
+// SubscriptionParams describe a new subscription
+type SubscriptionParams struct {
+	Type string
+	Plan string
+	// Token replaces the customer's payment method if it is set
+	Token string
+	// TrialDays is the length of the free trial, 0 means no trial
+	TrialDays int
+	// Quantity is the number of seats, 0 leaves it to the provider: 1 for new
+	// subscriptions and unchanged for updates
+	Quantity int
+	// Proration is how a plan change is billed, empty is the provider's default
+	Proration string
+	// Coupon is the id of a coupon to apply, PromotionCode the id of a promotion
+	// code. Only one of them is set. RemoveCoupon takes the discount off instead.
+	Coupon        string
+	PromotionCode string
+	RemoveCoupon  bool
+	// Items are all the add-ons the subscription should have, nil keeps the ones
+	// it has. ItemID is the id of the item of the plan, if it is known.
+	Items          []ItemParams
+	ItemID         string
+	IdempotencyKey string
+}
+
+// ItemParams is an add-on billed with the plan
+type ItemParams struct {
+	Plan     string
+	Quantity int
+}
+
+// RemoteItem is an item of a subscription as the payer knows it, the plan of the
+// subscription is one of them
+type RemoteItem struct {
+	ID       string
+	Plan     string
+	Quantity int
+}
+
+// The ways a plan change can be billed: not at all, with the difference added to
+// the next invoice, or with the difference invoiced right away
+const (
+	ProrationNone          = "none"
+	ProrationCreate        = "create_prorations"
+	ProrationAlwaysInvoice = "always_invoice"
+)
+
+// ErrCouponNotFound is returned when there is no coupon or promotion code by that name
+var ErrCouponNotFound = errors.New("No such coupon")
+
+// Coupon is a discount that can be applied to a subscription. Either PercentOff or
+// AmountOff is set, the amount is in the smallest unit of the currency.
+type Coupon struct {
+	ID string `json:"id"`
+	// PromotionCode is the id of the promotion code the coupon was found with
+	PromotionCode    string `json:"promotion_code,omitempty"`
+	PercentOff       int    `json:"percent_off,omitempty"`
+	AmountOff        int    `json:"amount_off,omitempty"`
+	Currency         string `json:"currency,omitempty"`
+	Duration         string `json:"duration"`
+	DurationInMonths int    `json:"duration_in_months,omitempty"`
+	Valid            bool   `json:"valid"`
+}
+
+// ErrInvoiceNotFound is returned when the customer doesn't have the invoice
+var ErrInvoiceNotFound = errors.New("No such invoice")
+
+// Invoice is a bill of the customer, the amounts are in the smallest unit of the
+// currency. The URLs are the payer's pages for the invoice and its PDF.
+type Invoice struct {
+	ID             string        `json:"id"`
+	Number         string        `json:"number,omitempty"`
+	SubscriptionID string        `json:"subscription_id,omitempty"`
+	Status         string        `json:"status"`
+	Amount         int           `json:"amount"`
+	AmountPaid     int           `json:"amount_paid"`
+	Currency       string        `json:"currency"`
+	PeriodStart    *time.Time    `json:"period_start,omitempty"`
+	PeriodEnd      *time.Time    `json:"period_end,omitempty"`
+	HostedURL      string        `json:"hosted_url,omitempty"`
+	PDFURL         string        `json:"pdf_url,omitempty"`
+	Lines          []InvoiceLine `json:"lines"`
+	CreatedAt      *time.Time    `json:"created_at,omitempty"`
+}
+
+// InvoiceLine is something that was billed on an invoice. Proration lines are
+// the credit or charge for a change in the middle of a period.
+type InvoiceLine struct {
+	Description string     `json:"description,omitempty"`
+	Plan        string     `json:"plan,omitempty"`
+	Quantity    int        `json:"quantity"`
+	Amount      int        `json:"amount"`
+	Proration   bool       `json:"proration,omitempty"`
+	PeriodStart *time.Time `json:"period_start,omitempty"`
+	PeriodEnd   *time.Time `json:"period_end,omitempty"`
+}
+
+// ErrSubscriptionNotFound is returned when the payer doesn't have the subscription
+var ErrSubscriptionNotFound = errors.New("No such subscription")
+
+// ErrPaymentMethodNotFound is returned when the customer doesn't have the payment method
+var ErrPaymentMethodNotFound = errors.New("No such payment method")
+
+// PaymentMethod is a card the customer can pay with
+type PaymentMethod struct {
+	ID       string `json:"id"`
+	Brand    string `json:"brand"`
+	Last4    string `json:"last4"`
+	ExpMonth int    `json:"exp_month"`
+	ExpYear  int    `json:"exp_year"`
+	Default  bool   `json:"default"`
+}
+
+// RemoteSubscription is the state of a subscription as the payer knows it
+type RemoteSubscription struct {
+	ID          string
+	Status      string
+	Quantity    int
+	PeriodStart *time.Time
+	PeriodEnd   *time.Time
+	CancelAt    *time.Time
+	TrialEnd    *time.Time
+	ResumeAt    *time.Time
+	// Coupon is the id of the coupon that is applied, DiscountEnd when it stops
+	// applying. Discounts that last forever don't end.
+	Coupon      string
+	DiscountEnd *time.Time
+	// Items are left alone when they are nil
+	Items []RemoteItem
+}
+
+// Apply copies the remote state onto our version of the subscription
+func (r *RemoteSubscription) Apply(sub *models.Subscription) {
+	sub.RemoteID = r.ID
+	sub.Status = r.Status
+	sub.Quantity = r.Quantity
+	sub.CurrentPeriodStart = r.PeriodStart
+	sub.CurrentPeriodEnd = r.PeriodEnd
+	sub.CancelAt = r.CancelAt
+	sub.TrialEnd = r.TrialEnd
+	sub.ResumeAt = r.ResumeAt
+	if sub.Coupon != r.Coupon {
+		// the promotion code only makes sense with the coupon it was for
+		sub.PromotionCode = ""
+	}
+	sub.Coupon = r.Coupon
+	sub.DiscountEnd = r.DiscountEnd
+	r.applyItems(sub)
+}
+
+// applyItems tells the item of the plan apart from the add-ons by its id, or by
+// the plan of the subscription while we don't know the id yet
+func (r *RemoteSubscription) applyItems(sub *models.Subscription) {
+	if r.Items == nil {
+		return
+	}
+	planItemID := sub.RemoteItemID
+	sub.Items = []models.SubscriptionItem{}
+	for _, item := range r.Items {
+		if item.ID == planItemID || (planItemID == "" && item.Plan == sub.Plan) {
+			sub.RemoteItemID = item.ID
+			sub.Quantity = item.Quantity
+			continue
+		}
+		sub.Items = append(sub.Items, models.SubscriptionItem{
+			RemoteID: item.ID,
+			Plan:     item.Plan,
+			Quantity: item.Quantity,
+		})
+	}
+}
+
+// UnixTime converts the timestamps stripe uses, 0 means it isn't set
+func UnixTime(ts int64) *time.Time {
+	if ts == 0 {
+		return nil
+	}
+	t := time.Unix(ts, 0).UTC()
+	return &t
+}
+
+// the url of the stripe api, the same one the default backend uses
+const stripeAPIURL = "https://api.stripe.com/v1"
+
+// StripeProxy bills subscriptions with stripe. It has its own key, so every
+// tenant can bill with its own stripe account.
 type StripeProxy struct {
+	key       string
+	backend   stripe.Backend
+	subs      *sub.Client
+	customers *customer.Client
+	cards     *card.Client
+	coupons   *coupon.Client
+}
+
+func newStripeProxy(config *conf.Config, _ *gorm.DB) (PayerProxy, error) {
+	if config.StripeKey == "" {
+		return nil, errors.New("The stripe provider requires a stripe_key")
+	}
+	backend := stripe.GetBackend(stripe.APIBackend)
+	if config.ProviderCalls.TimeoutMs > 0 {
+		// stripe calls can't be canceled, this makes sure the abandoned ones end too.
+		// Every proxy gets its own client, so each tenant keeps its own timeout.
+		backend = &stripe.BackendConfiguration{
+			Type: stripe.APIBackend,
+			URL:  stripeAPIURL,
+			HTTPClient: &http.Client{
+				Timeout: time.Duration(config.ProviderCalls.TimeoutMs) * time.Millisecond,
+			},
+		}
+	}
+	return &StripeProxy{
+		key:       config.StripeKey,
+		backend:   backend,
+		subs:      &sub.Client{B: backend, Key: config.StripeKey},
+		customers: &customer.Client{B: backend, Key: config.StripeKey},
+		cards:     &card.Client{B: backend, Key: config.StripeKey},
+		coupons:   &coupon.Client{B: backend, Key: config.StripeKey},
+	}, nil
 }
 
-func (StripeProxy) create(userID, plan, token string) (string, error) {
-	s, err := sub.New(&stripe.SubParams{
-		Customer: userID,
-		Plan:     plan,
+func (sp *StripeProxy) Create(ctx context.Context, customerID string, p *SubscriptionParams) (*RemoteSubscription, error) {
+	params := &stripe.SubParams{
+		Customer: customerID,
+		Plan:     p.Plan,
+		Token:    p.Token,
+		Quantity: uint64(p.Quantity),
+	}
+	if len(p.Items) > 0 {
+		// with add-ons the plan is just the first item
+		params.Plan = ""
+		params.Quantity = 0
+		params.Items = []*stripe.SubItemsParams{{Plan: p.Plan, Quantity: uint64(p.Quantity)}}
+		for _, item := range p.Items {
+			params.Items = append(params.Items, &stripe.SubItemsParams{Plan: item.Plan, Quantity: uint64(item.Quantity)})
+		}
+	}
+	// the type lets us restore the subscription if it never makes it into the db
+	params.Meta = map[string]string{"nf_type": p.Type}
+	if p.TrialDays > 0 {
+		params.TrialEnd = time.Now().AddDate(0, 0, p.TrialDays).Unix()
+	}
+	setStripeDiscount(params, p)
+	if p.IdempotencyKey != "" {
+		params.IdempotencyKey = p.IdempotencyKey + ":subscription"
+	}
+	var s *stripe.Sub
+	err := callWithContext(ctx, func() (err error) {
+		s, err = sp.subs.New(params)
+		return err
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return s.ID, nil
+	return FromStripeSub(s), nil
 }
 
-func (StripeProxy) update(subID, plan, token string) (string, error) {
-	s, err := sub.Update(subID, &stripe.SubParams{
-		Plan: plan,
+func (sp *StripeProxy) Update(ctx context.Context, subID string, p *SubscriptionParams) (*RemoteSubscription, error) {
+	params := &stripe.SubParams{
+		Plan:     p.Plan,
+		Token:    p.Token,
+		Quantity: uint64(p.Quantity),
+	}
+	setStripeDiscount(params, p)
+	setStripeCallKey(ctx, &params.Params, "subscription")
+	if p.Proration != "" {
+		params.AddExtra("proration_behavior", p.Proration)
+	}
+	if p.Items == nil && p.ItemID != "" {
+		// stripe won't change the plan of a subscription with several items
+		// directly, only the item of the plan
+		params.Plan = ""
+		params.Quantity = 0
+		params.Items = []*stripe.SubItemsParams{{ID: p.ItemID, Plan: p.Plan, Quantity: uint64(p.Quantity)}}
+	}
+
+	var s *stripe.Sub
+	err := callWithContext(ctx, func() (err error) {
+		if p.Items != nil {
+			current, err := sp.subs.Get(subID, nil)
+			if err != nil {
+				return err
+			}
+			if params.Items, err = stripeItems(current, p); err != nil {
+				return err
+			}
+			params.Plan = ""
+			params.Quantity = 0
+		}
+		s, err = sp.subs.Update(subID, params)
+		return err
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	return s.ID, nil
+	return FromStripeSub(s), nil
 }
 
-func (StripeProxy) delete(subID string) error {
-	_, err := sub.Cancel(subID, &stripe.SubParams{})
+// stripeItems turns the add-ons we want into changes to the items the subscription
+// has: the ones we have are updated, the others removed and the new ones added
+func stripeItems(current *stripe.Sub, p *SubscriptionParams) ([]*stripe.SubItemsParams, error) {
+	existing := []*stripe.SubItem{}
+	if current.Items != nil {
+		existing = current.Items.Values
+	}
+	planItemID := p.ItemID
+	if planItemID == "" && len(existing) == 1 {
+		planItemID = existing[0].ID
+	}
+	if planItemID == "" {
+		return nil, errors.New("Subscription " + current.ID + " has no item for its plan")
+	}
+
+	wanted := map[string]int{}
+	for _, item := range p.Items {
+		wanted[item.Plan] = item.Quantity
+	}
+
+	items := []*stripe.SubItemsParams{{ID: planItemID, Plan: p.Plan, Quantity: uint64(p.Quantity)}}
+	for _, item := range existing {
+		if item.ID == planItemID || item.Plan == nil {
+			continue
+		}
+		quantity, ok := wanted[item.Plan.ID]
+		if !ok {
+			items = append(items, &stripe.SubItemsParams{ID: item.ID, Deleted: true})
+			continue
+		}
+		items = append(items, &stripe.SubItemsParams{ID: item.ID, Quantity: uint64(quantity)})
+		delete(wanted, item.Plan.ID)
+	}
+	for _, item := range p.Items {
+		if _, ok := wanted[item.Plan]; ok {
+			items = append(items, &stripe.SubItemsParams{Plan: item.Plan, Quantity: uint64(item.Quantity)})
+		}
+	}
+	return items, nil
+}
+
+// setStripeDiscount adds the coupon or promotion code, this version of the client
+// doesn't know about promotion codes so it is sent as an extra
+func setStripeDiscount(params *stripe.SubParams, p *SubscriptionParams) {
+	params.Coupon = p.Coupon
+	if p.RemoveCoupon {
+		params.AddExtra("coupon", "")
+	}
+	if p.PromotionCode != "" {
+		params.AddExtra("promotion_code", p.PromotionCode)
+	}
+}
+
+// FromStripeSub is the state of a stripe subscription. This version of the client
+// can't see that a subscription is paused, stripe has it as active.
+func FromStripeSub(s *stripe.Sub) *RemoteSubscription {
+	remote := &RemoteSubscription{
+		ID:          s.ID,
+		Status:      string(s.Status),
+		Quantity:    int(s.Quantity),
+		PeriodStart: UnixTime(s.PeriodStart),
+		PeriodEnd:   UnixTime(s.PeriodEnd),
+		TrialEnd:    UnixTime(s.TrialEnd),
+	}
+	if s.EndCancel {
+		remote.CancelAt = remote.PeriodEnd
+	}
+	if s.Discount != nil && s.Discount.Coupon != nil {
+		remote.Coupon = s.Discount.Coupon.ID
+		remote.DiscountEnd = UnixTime(s.Discount.End)
+	}
+	if s.Items != nil {
+		remote.Items = []RemoteItem{}
+		for _, item := range s.Items.Values {
+			if item.Plan == nil {
+				continue
+			}
+			remote.Items = append(remote.Items, RemoteItem{
+				ID:       item.ID,
+				Plan:     item.Plan.ID,
+				Quantity: int(item.Quantity),
+			})
+		}
+	}
+	return remote
+}
+
+func (sp *StripeProxy) Delete(ctx context.Context, subID string) error {
+	return callWithContext(ctx, func() error {
+		_, err := sp.subs.Cancel(subID, &stripe.SubParams{})
+		return stripeSubErr(err)
+	})
+}
+
+func stripeSubErr(err error) error {
+	if stripeErr, ok := err.(*stripe.Error); ok {
+		if stripeErr.HTTPStatusCode == http.StatusNotFound || stripeErr.Code == "resource_missing" {
+			return ErrSubscriptionNotFound
+		}
+	}
 	return err
 }
 
-func (StripeProxy) createCustomer(userID, email, payToken string) (string, error) {
+// setStripeCallKey sends the idempotency key of the change with a call that isn't
+// given a key of its own, so stripe doesn't make it twice when it is retried
+func setStripeCallKey(ctx context.Context, params *stripe.Params, suffix string) {
+	if key := getCallKey(ctx); key != "" {
+		params.IdempotencyKey = key + ":" + suffix
+	}
+}
+
+func (sp *StripeProxy) CancelAtPeriodEnd(ctx context.Context, subID string) (*RemoteSubscription, error) {
+	var s *stripe.Sub
+	err := callWithContext(ctx, func() (err error) {
+		s, err = sp.subs.Cancel(subID, &stripe.SubParams{EndCancel: true})
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return FromStripeSub(s), nil
+}
+
+// Reactivate sets the plan the subscription already has, that is how stripe
+// undoes a cancellation at the end of the period
+func (sp *StripeProxy) Reactivate(ctx context.Context, subID, itemID string) (*RemoteSubscription, error) {
+	var s *stripe.Sub
+	err := callWithContext(ctx, func() error {
+		current, err := sp.subs.Get(subID, nil)
+		if err != nil {
+			return err
+		}
+		params, err := reactivateParams(current, itemID)
+		if err != nil {
+			return err
+		}
+		setStripeCallKey(ctx, &params.Params, "subscription")
+		s, err = sp.subs.Update(subID, params)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return FromStripeSub(s), nil
+}
+
+// reactivateParams sets the plan again. A subscription with add-ons has no plan
+// of its own, the plan is set on its item instead.
+func reactivateParams(current *stripe.Sub, itemID string) (*stripe.SubParams, error) {
+	if current.Plan != nil {
+		return &stripe.SubParams{Plan: current.Plan.ID}, nil
+	}
+	if current.Items != nil {
+		for _, item := range current.Items.Values {
+			if item.Plan == nil {
+				continue
+			}
+			if item.ID == itemID || (itemID == "" && len(current.Items.Values) == 1) {
+				return &stripe.SubParams{Items: []*stripe.SubItemsParams{{ID: item.ID, Plan: item.Plan.ID}}}, nil
+			}
+		}
+	}
+	return nil, errors.New("Subscription " + current.ID + " has no item for its plan")
+}
+
+// Pause voids the invoices of the subscription while it is paused. This version
+// of the client doesn't know about pausing, so it is sent as an extra and the
+// paused state is set from what we asked for.
+func (sp *StripeProxy) Pause(ctx context.Context, subID string, resumeAt *time.Time) (*RemoteSubscription, error) {
+	params := &stripe.SubParams{}
+	params.AddExtra("pause_collection[behavior]", "void")
+	if resumeAt != nil {
+		params.AddExtra("pause_collection[resumes_at]", strconv.FormatInt(resumeAt.Unix(), 10))
+	}
+	setStripeCallKey(ctx, &params.Params, "subscription")
+
+	var s *stripe.Sub
+	err := callWithContext(ctx, func() (err error) {
+		s, err = sp.subs.Update(subID, params)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	remote := FromStripeSub(s)
+	remote.Status = models.StatusPaused
+	remote.ResumeAt = resumeAt
+	return remote, nil
+}
+
+func (sp *StripeProxy) Resume(ctx context.Context, subID string) (*RemoteSubscription, error) {
+	params := &stripe.SubParams{}
+	params.AddExtra("pause_collection", "")
+	setStripeCallKey(ctx, &params.Params, "subscription")
+
+	var s *stripe.Sub
+	err := callWithContext(ctx, func() (err error) {
+		s, err = sp.subs.Update(subID, params)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return FromStripeSub(s), nil
+}
+
+func (sp *StripeProxy) CreateCustomer(ctx context.Context, userID, email, payToken, idempotencyKey string) (string, error) {
 	params := &stripe.CustomerParams{
 		Email: email,
-		Source: &stripe.SourceParams{
+	}
+	// customers that start with a trial might not have a payment method yet
+	if payToken != "" {
+		params.Source = &stripe.SourceParams{
 			Token: payToken,
-		},
+		}
 	}
 	params.Meta = map[string]string{"nf_id": userID}
-	c, err := customer.New(params)
+	if idempotencyKey != "" {
+		params.IdempotencyKey = idempotencyKey + ":customer"
+	}
+	var c *stripe.Customer
+	err := callWithContext(ctx, func() (err error) {
+		c, err = sp.customers.New(params)
+		return err
+	})
 	if err != nil {
 		return "", err
 	}
 	return c.ID, nil
 }
 
+func (sp *StripeProxy) UpdatePaymentMethod(ctx context.Context, customerID, token, idempotencyKey string) error {
+	params := &stripe.CustomerParams{
+		Source: &stripe.SourceParams{
+			Token: token,
+		},
+	}
+	if idempotencyKey != "" {
+		params.IdempotencyKey = idempotencyKey + ":payment_method"
+	}
+	return callWithContext(ctx, func() error {
+		_, err := sp.customers.Update(customerID, params)
+		return err
+	})
+}
+
+func (sp *StripeProxy) ListPaymentMethods(ctx context.Context, customerID string) ([]*PaymentMethod, error) {
+	methods := []*PaymentMethod{}
+	err := callWithContext(ctx, func() error {
+		c, err := sp.customers.Get(customerID, nil)
+		if err != nil {
+			return err
+		}
+
+		i := sp.cards.List(&stripe.CardListParams{Customer: customerID})
+		for i.Next() {
+			methods = append(methods, fromStripeCard(i.Card(), c))
+		}
+		return i.Err()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return methods, nil
+}
+
+func (sp *StripeProxy) AddPaymentMethod(ctx context.Context, customerID, token, idempotencyKey string) (*PaymentMethod, error) {
+	params := &stripe.CardParams{
+		Customer: customerID,
+		Token:    token,
+	}
+	if idempotencyKey != "" {
+		params.IdempotencyKey = idempotencyKey + ":card"
+	}
+
+	var method *PaymentMethod
+	err := callWithContext(ctx, func() error {
+		added, err := sp.cards.New(params)
+		if err != nil {
+			return err
+		}
+		// the first card of a customer becomes the default
+		c, err := sp.customers.Get(customerID, nil)
+		if err != nil {
+			return err
+		}
+		method = fromStripeCard(added, c)
+		return nil
+	})
+	return method, err
+}
+
+func (sp *StripeProxy) DeletePaymentMethod(ctx context.Context, customerID, methodID string) error {
+	return callWithContext(ctx, func() error {
+		_, err := sp.cards.Del(methodID, &stripe.CardParams{Customer: customerID})
+		return stripePaymentMethodErr(err)
+	})
+}
+
+func (sp *StripeProxy) SetDefaultPaymentMethod(ctx context.Context, customerID, methodID string) error {
+	return callWithContext(ctx, func() error {
+		params := &stripe.CustomerParams{DefaultSource: methodID}
+		setStripeCallKey(ctx, &params.Params, "customer")
+		_, err := sp.customers.Update(customerID, params)
+		return stripePaymentMethodErr(err)
+	})
+}
+
+func fromStripeCard(c *stripe.Card, cust *stripe.Customer) *PaymentMethod {
+	return &PaymentMethod{
+		ID:       c.ID,
+		Brand:    string(c.Brand),
+		Last4:    c.LastFour,
+		ExpMonth: int(c.Month),
+		ExpYear:  int(c.Year),
+		Default:  cust.DefaultSource != nil && cust.DefaultSource.ID == c.ID,
+	}
+}
+
+func stripePaymentMethodErr(err error) error {
+	if stripeErr, ok := err.(*stripe.Error); ok {
+		if stripeErr.HTTPStatusCode == http.StatusNotFound || stripeErr.Code == "resource_missing" {
+			return ErrPaymentMethodNotFound
+		}
+	}
+	return err
+}
+
+func (sp *StripeProxy) GetCoupon(ctx context.Context, id string) (*Coupon, error) {
+	var c *stripe.Coupon
+	err := callWithContext(ctx, func() (err error) {
+		c, err = sp.coupons.Get(id, nil)
+		return err
+	})
+	if err != nil {
+		return nil, stripeCouponErr(err)
+	}
+	return fromStripeCoupon(c), nil
+}
+
+// stripePromotionCodes is the answer to listing promotion codes, the client has no
+// type for them yet
+type stripePromotionCodes struct {
+	Data []struct {
+		ID     string         `json:"id"`
+		Active bool           `json:"active"`
+		Coupon *stripe.Coupon `json:"coupon"`
+	} `json:"data"`
+}
+
+func (sp *StripeProxy) GetPromotionCode(ctx context.Context, code string) (*Coupon, error) {
+	query := url.Values{}
+	query.Set("code", code)
+	query.Set("active", "true")
+
+	codes := new(stripePromotionCodes)
+	err := callWithContext(ctx, func() error {
+		return sp.backend.Call("GET", "/promotion_codes?"+query.Encode(), sp.key, nil, nil, codes)
+	})
+	if err != nil {
+		return nil, stripeCouponErr(err)
+	}
+	for _, promo := range codes.Data {
+		if promo.Active && promo.Coupon != nil {
+			c := fromStripeCoupon(promo.Coupon)
+			c.PromotionCode = promo.ID
+			return c, nil
+		}
+	}
+	return nil, ErrCouponNotFound
+}
+
+// stripeInvoice has the fields of an invoice this version of the client doesn't
+// know about yet, like the status and the URLs
+type stripeInvoice struct {
+	ID               string `json:"id"`
+	Number           string `json:"number"`
+	Customer         string `json:"customer"`
+	Subscription     string `json:"subscription"`
+	Status           string `json:"status"`
+	Total            int64  `json:"total"`
+	AmountPaid       int64  `json:"amount_paid"`
+	Currency         string `json:"currency"`
+	Created          int64  `json:"created"`
+	PeriodStart      int64  `json:"period_start"`
+	PeriodEnd        int64  `json:"period_end"`
+	HostedInvoiceURL string `json:"hosted_invoice_url"`
+	InvoicePDF       string `json:"invoice_pdf"`
+	Lines            struct {
+		Data []struct {
+			Description string `json:"description"`
+			Amount      int64  `json:"amount"`
+			Quantity    int64  `json:"quantity"`
+			Proration   bool   `json:"proration"`
+			Plan        *struct {
+				ID string `json:"id"`
+			} `json:"plan"`
+			Period struct {
+				Start int64 `json:"start"`
+				End   int64 `json:"end"`
+			} `json:"period"`
+		} `json:"data"`
+	} `json:"lines"`
+}
+
+type stripeInvoices struct {
+	Data []*stripeInvoice `json:"data"`
+}
+
+func (sp *StripeProxy) ListInvoices(ctx context.Context, customerID string, limit int) ([]*Invoice, error) {
+	query := url.Values{}
+	query.Set("customer", customerID)
+	query.Set("limit", strconv.Itoa(limit))
+
+	list := new(stripeInvoices)
+	err := callWithContext(ctx, func() error {
+		return sp.backend.Call("GET", "/invoices?"+query.Encode(), sp.key, nil, nil, list)
+	})
+	if err != nil {
+		return nil, err
+	}
+	invoices := make([]*Invoice, len(list.Data))
+	for i, inv := range list.Data {
+		invoices[i] = fromStripeInvoice(inv)
+	}
+	return invoices, nil
+}
+
+func (sp *StripeProxy) GetInvoice(ctx context.Context, customerID, id string) (*Invoice, error) {
+	inv := new(stripeInvoice)
+	err := callWithContext(ctx, func() error {
+		return sp.backend.Call("GET", "/invoices/"+url.PathEscape(id), sp.key, nil, nil, inv)
+	})
+	if err != nil {
+		if stripeErr, ok := err.(*stripe.Error); ok {
+			if stripeErr.HTTPStatusCode == http.StatusNotFound || stripeErr.Code == "resource_missing" {
+				return nil, ErrInvoiceNotFound
+			}
+		}
+		return nil, err
+	}
+	// the ids are guessable enough, the invoice has to be the customer's
+	if inv.Customer != customerID {
+		return nil, ErrInvoiceNotFound
+	}
+	return fromStripeInvoice(inv), nil
+}
+
+// PreviewInvoice asks stripe for the upcoming invoice with the changes. Promotion
+// codes can't be previewed, the coupon behind them has to be passed instead.
+func (sp *StripeProxy) PreviewInvoice(ctx context.Context, customerID, subID string, p *SubscriptionParams) (*Invoice, error) {
+	query := url.Values{}
+	query.Set("customer", customerID)
+	if p.Coupon != "" {
+		query.Set("coupon", p.Coupon)
+	}
+	if p.Proration != "" {
+		query.Set("subscription_proration_behavior", p.Proration)
+	}
+
+	inv := new(stripeInvoice)
+	err := callWithContext(ctx, func() error {
+		items := []*stripe.SubItemsParams{{Plan: p.Plan, Quantity: uint64(p.Quantity)}}
+		if subID != "" {
+			query.Set("subscription", subID)
+			current, err := sp.subs.Get(subID, nil)
+			if err != nil {
+				return err
+			}
+			withItems := *p
+			if withItems.Items == nil {
+				withItems.Items = remoteItemParams(current, p.ItemID)
+			}
+			if items, err = stripeItems(current, &withItems); err != nil {
+				return err
+			}
+		} else {
+			for _, item := range p.Items {
+				items = append(items, &stripe.SubItemsParams{Plan: item.Plan, Quantity: uint64(item.Quantity)})
+			}
+			if p.TrialDays > 0 {
+				query.Set("subscription_trial_end", strconv.FormatInt(time.Now().AddDate(0, 0, p.TrialDays).Unix(), 10))
+			}
+		}
+		for i, item := range items {
+			prefix := "subscription_items[" + strconv.Itoa(i) + "]"
+			if item.ID != "" {
+				query.Set(prefix+"[id]", item.ID)
+			}
+			if item.Deleted {
+				query.Set(prefix+"[deleted]", "true")
+			}
+			if item.Plan != "" {
+				query.Set(prefix+"[plan]", item.Plan)
+			}
+			if item.Quantity > 0 {
+				query.Set(prefix+"[quantity]", strconv.FormatUint(item.Quantity, 10))
+			}
+		}
+		return sp.backend.Call("GET", "/invoices/upcoming?"+query.Encode(), sp.key, nil, nil, inv)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fromStripeInvoice(inv), nil
+}
+
+// remoteItemParams are the add-ons the subscription has with stripe
+func remoteItemParams(s *stripe.Sub, planItemID string) []ItemParams {
+	items := []ItemParams{}
+	if s.Items == nil {
+		return items
+	}
+	if planItemID == "" && len(s.Items.Values) == 1 {
+		return items
+	}
+	for _, item := range s.Items.Values {
+		if item.ID != planItemID && item.Plan != nil {
+			items = append(items, ItemParams{Plan: item.Plan.ID, Quantity: int(item.Quantity)})
+		}
+	}
+	return items
+}
+
+func fromStripeInvoice(inv *stripeInvoice) *Invoice {
+	invoice := &Invoice{
+		ID:             inv.ID,
+		Number:         inv.Number,
+		SubscriptionID: inv.Subscription,
+		Status:         inv.Status,
+		Amount:         int(inv.Total),
+		AmountPaid:     int(inv.AmountPaid),
+		Currency:       inv.Currency,
+		PeriodStart:    UnixTime(inv.PeriodStart),
+		PeriodEnd:      UnixTime(inv.PeriodEnd),
+		HostedURL:      inv.HostedInvoiceURL,
+		PDFURL:         inv.InvoicePDF,
+		Lines:          []InvoiceLine{},
+		CreatedAt:      UnixTime(inv.Created),
+	}
+	for _, line := range inv.Lines.Data {
+		l := InvoiceLine{
+			Description: line.Description,
+			Quantity:    int(line.Quantity),
+			Amount:      int(line.Amount),
+			Proration:   line.Proration,
+			PeriodStart: UnixTime(line.Period.Start),
+			PeriodEnd:   UnixTime(line.Period.End),
+		}
+		if line.Plan != nil {
+			l.Plan = line.Plan.ID
+		}
+		invoice.Lines = append(invoice.Lines, l)
+	}
+	return invoice
+}
+
+func fromStripeCoupon(c *stripe.Coupon) *Coupon {
+	return &Coupon{
+		ID:               c.ID,
+		PercentOff:       int(c.Percent),
+		AmountOff:        int(c.Amount),
+		Currency:         c.Currency,
+		Duration:         string(c.Duration),
+		DurationInMonths: int(c.DurationPeriod),
+		Valid:            c.Valid,
+	}
+}
+
+func stripeCouponErr(err error) error {
+	if stripeErr, ok := err.(*stripe.Error); ok {
+		if stripeErr.HTTPStatusCode == http.StatusNotFound || stripeErr.Code == "resource_missing" {
+			return ErrCouponNotFound
+		}
+	}
+	return err
+}
+
 /*
 
 POST /subscriptions/members/smashing
@@ -84,16 +969,63 @@ else
 type errorProxy struct {
 }
 
-func (errorProxy) createCustomer(_, _, _ string) (string, error) {
+func (errorProxy) CreateCustomer(_ context.Context, _, _, _, _ string) (string, error) {
 	return "", errors.New("No payer proxy provided")
 }
 
-func (errorProxy) create(userID, plan, token string) (string, error) {
-	return "", errors.New("No payer proxy provided")
+func (errorProxy) UpdatePaymentMethod(_ context.Context, _, _, _ string) error {
+	return errors.New("No payer proxy provided")
 }
-func (errorProxy) update(subID, plan, token string) (string, error) {
-	return "", errors.New("No payer proxy provided")
+
+func (errorProxy) ListPaymentMethods(_ context.Context, _ string) ([]*PaymentMethod, error) {
+	return nil, errors.New("No payer proxy provided")
 }
-func (errorProxy) delete(subID string) error {
+
+func (errorProxy) AddPaymentMethod(_ context.Context, _, _, _ string) (*PaymentMethod, error) {
+	return nil, errors.New("No payer proxy provided")
+}
+
+func (errorProxy) DeletePaymentMethod(_ context.Context, _, _ string) error {
 	return errors.New("No payer proxy provided")
 }
+
+func (errorProxy) SetDefaultPaymentMethod(_ context.Context, _, _ string) error {
+	return errors.New("No payer proxy provided")
+}
+
+func (errorProxy) Create(ctx context.Context, customerID string, params *SubscriptionParams) (*RemoteSubscription, error) {
+	return nil, errors.New("No payer proxy provided")
+}
+func (errorProxy) Update(ctx context.Context, subID string, params *SubscriptionParams) (*RemoteSubscription, error) {
+	return nil, errors.New("No payer proxy provided")
+}
+func (errorProxy) Delete(ctx context.Context, subID string) error {
+	return errors.New("No payer proxy provided")
+}
+func (errorProxy) CancelAtPeriodEnd(ctx context.Context, subID string) (*RemoteSubscription, error) {
+	return nil, errors.New("No payer proxy provided")
+}
+func (errorProxy) Reactivate(ctx context.Context, subID, itemID string) (*RemoteSubscription, error) {
+	return nil, errors.New("No payer proxy provided")
+}
+func (errorProxy) Pause(ctx context.Context, subID string, resumeAt *time.Time) (*RemoteSubscription, error) {
+	return nil, errors.New("No payer proxy provided")
+}
+func (errorProxy) Resume(ctx context.Context, subID string) (*RemoteSubscription, error) {
+	return nil, errors.New("No payer proxy provided")
+}
+func (errorProxy) GetCoupon(ctx context.Context, id string) (*Coupon, error) {
+	return nil, errors.New("No payer proxy provided")
+}
+func (errorProxy) GetPromotionCode(ctx context.Context, code string) (*Coupon, error) {
+	return nil, errors.New("No payer proxy provided")
+}
+func (errorProxy) ListInvoices(ctx context.Context, customerID string, limit int) ([]*Invoice, error) {
+	return nil, errors.New("No payer proxy provided")
+}
+func (errorProxy) GetInvoice(ctx context.Context, customerID, id string) (*Invoice, error) {
+	return nil, errors.New("No payer proxy provided")
+}
+func (errorProxy) PreviewInvoice(ctx context.Context, customerID, subID string, params *SubscriptionParams) (*Invoice, error) {
+	return nil, errors.New("No payer proxy provided")
+}
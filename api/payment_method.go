@@ -0,0 +1,201 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/guregu/kami"
+	"github.com/netlify/gojoin/models"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/square/go-jose.v1/json"
+)
+
+type paymentMethodRequest struct {
+	StripeKey string `json:"stripe_key"`
+}
+
+func extractPaymentMethodPayload(r *http.Request) (*paymentMethodRequest, *HTTPError) {
+	payload := new(paymentMethodRequest)
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(payload); err != nil {
+		return nil, httpError(http.StatusBadRequest, "failed to decode payload: "+err.Error())
+	}
+	if payload.StripeKey == "" {
+		return nil, httpError(http.StatusBadRequest, "Failed to provide a valid request: Missing fields: stripe_key")
+	}
+	return payload, nil
+}
+
+// updatePaymentMethod replaces the default payment method of a customer, the
+// existing subscriptions are billed with it from then on
+func updatePaymentMethod(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	payload, httpErr := extractPaymentMethodPayload(r)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
+	user, lock, httpErr := lockCustomer(ctx)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	defer releaseUser(ctx, lock)
+
+	log := getLogger(ctx).WithField("remote_id", user.RemoteID)
+	err := getPayerProxy(ctx).UpdatePaymentMethod(ctx, user.RemoteID, payload.StripeKey, getIdempotencyKey(ctx))
+	if err != nil {
+		log.WithError(err).Info("Failed to update payment method in stripe")
+		writeError(w, http.StatusBadRequest, "Failed to update the payment method: %s", err)
+		return
+	}
+
+	log.Info("Updated payment method")
+	auditPaymentMethod(ctx, models.AuditPaymentMethod, user, user.RemoteID)
+	sendJSON(w, http.StatusOK, user)
+}
+
+// listPaymentMethods returns the cards of the customer. Users that never
+// subscribed don't have any.
+func listPaymentMethods(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	target := getTargetUser(ctx)
+	user, httpErr := getUser(ctx, target.ID)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	if user == nil {
+		sendJSON(w, http.StatusOK, []*PaymentMethod{})
+		return
+	}
+
+	methods, err := getPayerProxy(ctx).ListPaymentMethods(ctx, user.RemoteID)
+	if err != nil {
+		getLogger(ctx).WithError(err).Warn("Failed to list payment methods in stripe")
+		writeError(w, http.StatusInternalServerError, "Error communicating with stripe: %s", err)
+		return
+	}
+	sendJSON(w, http.StatusOK, methods)
+}
+
+func addPaymentMethod(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	payload, httpErr := extractPaymentMethodPayload(r)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
+	user, lock, httpErr := lockCustomer(ctx)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	defer releaseUser(ctx, lock)
+
+	log := getLogger(ctx).WithField("remote_id", user.RemoteID)
+	method, err := getPayerProxy(ctx).AddPaymentMethod(ctx, user.RemoteID, payload.StripeKey, getIdempotencyKey(ctx))
+	if err != nil {
+		log.WithError(err).Info("Failed to add payment method in stripe")
+		writeError(w, http.StatusBadRequest, "Failed to add the payment method: %s", err)
+		return
+	}
+
+	log.WithField("payment_method", method.ID).Info("Added payment method")
+	auditPaymentMethod(ctx, models.AuditAddPaymentMethod, user, method.ID)
+	sendJSON(w, http.StatusOK, method)
+}
+
+func deletePaymentMethod(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	user, lock, httpErr := lockCustomer(ctx)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	defer releaseUser(ctx, lock)
+
+	id := kami.Param(ctx, "id")
+	log := getLogger(ctx).WithFields(logrus.Fields{
+		"remote_id":      user.RemoteID,
+		"payment_method": id,
+	})
+	if err := getPayerProxy(ctx).DeletePaymentMethod(ctx, user.RemoteID, id); err != nil {
+		writePaymentMethodError(w, log, id, err)
+		return
+	}
+
+	log.Info("Removed payment method")
+	auditPaymentMethod(ctx, models.AuditRemovePaymentMethod, user, id)
+	sendJSON(w, http.StatusAccepted, struct{}{})
+}
+
+func setDefaultPaymentMethod(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	user, lock, httpErr := lockCustomer(ctx)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	defer releaseUser(ctx, lock)
+
+	id := kami.Param(ctx, "id")
+	log := getLogger(ctx).WithFields(logrus.Fields{
+		"remote_id":      user.RemoteID,
+		"payment_method": id,
+	})
+	pp := getPayerProxy(ctx)
+	if err := pp.SetDefaultPaymentMethod(ctx, user.RemoteID, id); err != nil {
+		writePaymentMethodError(w, log, id, err)
+		return
+	}
+
+	log.Info("Changed default payment method")
+	auditPaymentMethod(ctx, models.AuditPaymentMethod, user, id)
+
+	methods, err := pp.ListPaymentMethods(ctx, user.RemoteID)
+	if err != nil {
+		log.WithError(err).Warn("Failed to list payment methods in stripe")
+		writeError(w, http.StatusInternalServerError, "The default was changed, but listing the payment methods failed: %s", err)
+		return
+	}
+	sendJSON(w, http.StatusOK, methods)
+}
+
+func writePaymentMethodError(w http.ResponseWriter, log *logrus.Entry, id string, err error) {
+	if err == ErrPaymentMethodNotFound {
+		notFoundError(w, "No payment method found with id %s", id)
+		return
+	}
+	log.WithError(err).Info("Failed to change payment method in stripe")
+	writeError(w, http.StatusBadRequest, "Error communicating with stripe: %s", err)
+}
+
+// lockCustomer locks the target user, who must already be a customer
+func lockCustomer(ctx context.Context) (*models.User, *models.UserLock, *HTTPError) {
+	target := getTargetUser(ctx)
+	lock, httpErr := lockUser(ctx, target.ID)
+	if httpErr != nil {
+		return nil, nil, httpErr
+	}
+
+	user, httpErr := getUser(ctx, target.ID)
+	if httpErr == nil && user == nil {
+		httpErr = httpError(http.StatusNotFound, "No customer found for user %s, a payment method is added with the first subscription", target.ID)
+	}
+	if httpErr != nil {
+		releaseUser(ctx, lock)
+		return nil, nil, httpErr
+	}
+	return user, lock, nil
+}
+
+// getUser finds the user, it is nil if there is none
+func getUser(ctx context.Context, userID string) (*models.User, *HTTPError) {
+	user := &models.User{ID: userID, TenantID: getTenantID(ctx)}
+	if rsp := getDB(ctx).Where(user).First(user); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, nil
+		}
+		getLogger(ctx).WithError(rsp.Error).Warn("Failed to find user")
+		return nil, httpError(http.StatusInternalServerError, "Failed to find the user specified")
+	}
+	return user, nil
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/netlify/gojoin/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdatePaymentMethod(t *testing.T) {
+	clearAuditLog()
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	payload := &paymentMethodRequest{StripeKey: "new-card"}
+	extractError(t, http.StatusNotFound, request(t, "PUT", "/payment_method", payload, false))
+	assert.Empty(t, tp.paymentMethodCalls)
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	defer cleanup(tu)
+
+	extractError(t, http.StatusBadRequest, request(t, "PUT", "/payment_method", &paymentMethodRequest{}, false))
+	assert.Empty(t, tp.paymentMethodCalls)
+
+	user := new(models.User)
+	extractPayload(t, request(t, "PUT", "/payment_method", payload, false), user)
+	assert.Equal(t, "stripe-given-value", user.RemoteID)
+	if assert.Len(t, tp.paymentMethodCalls, 1) {
+		assert.Equal(t, "stripe-given-value", tp.paymentMethodCalls[0].customerID)
+		assert.Equal(t, "new-card", tp.paymentMethodCalls[0].token)
+	}
+
+	entries := []models.AuditLogEntry{}
+	db.Find(&entries)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, models.AuditPaymentMethod, entries[0].Action)
+		assert.Equal(t, testUserID, entries[0].TargetUserID)
+		assert.Equal(t, "stripe-given-value", entries[0].RemoteID)
+	}
+
+	tp.paymentMethodErr = errors.New("Your card was declined")
+	extractError(t, http.StatusBadRequest, request(t, "PUT", "/payment_method", payload, false))
+}
+
+func TestAdminUpdatePaymentMethod(t *testing.T) {
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser("batman", "bruce@dc.com", "eulav-epits-emos")
+	defer cleanup(tu)
+
+	payload := &paymentMethodRequest{StripeKey: "new-card"}
+	extractError(t, http.StatusForbidden, request(t, "PUT", "/admin/users/batman/payment_method", payload, false))
+
+	rsp := request(t, "PUT", "/admin/users/batman/payment_method", payload, true)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	if assert.Len(t, tp.paymentMethodCalls, 1) {
+		assert.Equal(t, "eulav-epits-emos", tp.paymentMethodCalls[0].customerID)
+	}
+}
+
+func TestManagePaymentMethods(t *testing.T) {
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	methods := []*PaymentMethod{}
+	extractPayload(t, request(t, "GET", "/payment_methods", nil, false), &methods)
+	assert.Empty(t, methods)
+	payload := &paymentMethodRequest{StripeKey: "visa"}
+	extractError(t, http.StatusNotFound, request(t, "POST", "/payment_methods", payload, false))
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	defer cleanup(tu)
+
+	method := new(PaymentMethod)
+	extractPayload(t, request(t, "POST", "/payment_methods", payload, false), method)
+	assert.Equal(t, "card_visa", method.ID)
+	assert.True(t, method.Default)
+
+	payload.StripeKey = "amex"
+	extractPayload(t, request(t, "POST", "/payment_methods", payload, false), method)
+	assert.False(t, method.Default)
+
+	extractPayload(t, request(t, "PUT", "/payment_methods/card_amex/default", nil, false), &methods)
+	if assert.Len(t, methods, 2) {
+		assert.False(t, methods[0].Default)
+		assert.True(t, methods[1].Default)
+	}
+	extractError(t, http.StatusNotFound, request(t, "PUT", "/payment_methods/nonsense/default", nil, false))
+
+	rsp := request(t, "DELETE", "/payment_methods/card_visa", nil, false)
+	assert.Equal(t, http.StatusAccepted, rsp.StatusCode)
+	extractError(t, http.StatusNotFound, request(t, "DELETE", "/payment_methods/card_visa", nil, false))
+
+	extractPayload(t, request(t, "GET", "/payment_methods", nil, false), &methods)
+	if assert.Len(t, methods, 1) {
+		assert.Equal(t, "card_amex", methods[0].ID)
+	}
+}
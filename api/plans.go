@@ -0,0 +1,74 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/guregu/kami"
+	"github.com/netlify/gojoin/conf"
+)
+
+// planResponse is a plan from the catalog in the config
+type planResponse struct {
+	ID              string   `json:"id"`
+	Name            string   `json:"name"`
+	Price           int      `json:"price"`
+	Currency        string   `json:"currency"`
+	Interval        string   `json:"interval"`
+	Features        []string `json:"features"`
+	TrialPeriodDays int      `json:"trial_period_days,omitempty"`
+}
+
+// listPlans returns the plans of every subscription type, so the frontends can
+// show them without hard-coding plan names
+func listPlans(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	catalog := map[string][]planResponse{}
+	for subType, plans := range getConfig(ctx).Plans {
+		catalog[subType] = sortedPlans(plans)
+	}
+	sendJSON(w, http.StatusOK, catalog)
+}
+
+func viewPlans(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	subType := kami.Param(ctx, "type")
+	plans, ok := getConfig(ctx).Plans[subType]
+	if !ok {
+		notFoundError(w, "No plans found for type %s", subType)
+		return
+	}
+	sendJSON(w, http.StatusOK, sortedPlans(plans))
+}
+
+// sortedPlans lists the plans from the cheapest to the most expensive
+func sortedPlans(plans map[string]conf.PlanConfig) []planResponse {
+	list := []planResponse{}
+	for id, plan := range plans {
+		features := plan.Features
+		if features == nil {
+			features = []string{}
+		}
+		list = append(list, planResponse{
+			ID:              id,
+			Name:            plan.Name,
+			Price:           plan.Price,
+			Currency:        plan.Currency,
+			Interval:        plan.Interval,
+			Features:        features,
+			TrialPeriodDays: plan.TrialPeriodDays,
+		})
+	}
+	sort.Sort(byPrice(list))
+	return list
+}
+
+type byPrice []planResponse
+
+func (p byPrice) Len() int      { return len(p) }
+func (p byPrice) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byPrice) Less(i, j int) bool {
+	if p[i].Price != p[j].Price {
+		return p[i].Price < p[j].Price
+	}
+	return p[i].ID < p[j].ID
+}
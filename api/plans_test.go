@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/netlify/gojoin/conf"
+	"github.com/netlify/gojoin/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func testCatalog() conf.PlansConfig {
+	return conf.PlansConfig{
+		"membership": {
+			"gold":   {Name: "Gold", Price: 2000, Currency: "usd", Interval: "month", Features: []string{"everything"}},
+			"silver": {Name: "Silver", Price: 1000, Currency: "usd", Interval: "month"},
+		},
+		"team": {
+			"seats": {Name: "Team", Price: 500, Currency: "usd", Interval: "month", TrialPeriodDays: 14},
+		},
+	}
+}
+
+func TestListPlans(t *testing.T) {
+	config.Plans = testCatalog()
+	defer func() { config.Plans = nil }()
+
+	// the catalog doesn't need a token
+	rsp, err := client.Get(serverURL + "/plans")
+	if !assert.NoError(t, err) {
+		return
+	}
+	catalog := map[string][]planResponse{}
+	extractPayload(t, rsp, &catalog)
+	assert.Len(t, catalog, 2)
+	if assert.Len(t, catalog["membership"], 2) {
+		assert.Equal(t, "silver", catalog["membership"][0].ID)
+		assert.Equal(t, []string{}, catalog["membership"][0].Features)
+		assert.Equal(t, "gold", catalog["membership"][1].ID)
+		assert.Equal(t, 2000, catalog["membership"][1].Price)
+	}
+
+	plans := []planResponse{}
+	extractPayload(t, request(t, "GET", "/plans/team", nil, false), &plans)
+	if assert.Len(t, plans, 1) {
+		assert.Equal(t, "Team", plans[0].Name)
+		assert.Equal(t, 14, plans[0].TrialPeriodDays)
+	}
+
+	extractError(t, http.StatusNotFound, request(t, "GET", "/plans/nonsense", nil, false))
+}
+
+func TestOnlyPlansFromTheCatalog(t *testing.T) {
+	config.Plans = testCatalog()
+	defer func() { config.Plans = nil }()
+	tp := &testProxy{createSubID: "remote-id", createCustomerID: "remote-user-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	payload := &subscriptionRequest{StripeKey: "something", Plan: "seats"}
+	extractError(t, http.StatusBadRequest, request(t, "PUT", "/subscriptions/membership", payload, false))
+	extractError(t, http.StatusBadRequest, request(t, "PUT", "/subscriptions/pokemon", payload, false))
+	assert.Empty(t, tp.createCalls)
+
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "PUT", "/subscriptions/team", payload, false), sub)
+	defer cleanup(sub, &models.User{ID: testUserID})
+	assert.Equal(t, "seats", sub.Plan)
+	if assert.Len(t, tp.createCalls, 1) {
+		assert.Equal(t, 14, tp.createCalls[0].trialDays)
+	}
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/guregu/kami"
+	"github.com/sirupsen/logrus"
+)
+
+// previewResponse is what a change would cost. The proration is the sum of the
+// proration lines, it is negative when the change leaves a credit.
+type previewResponse struct {
+	Invoice   *Invoice `json:"invoice"`
+	Proration int      `json:"proration"`
+}
+
+// previewSub shows the next invoice as it would be if the subscription was
+// created or changed with the payload, nothing is changed
+func previewSub(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	payload, httpErr := extractValidPayload(r)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	subType := kami.Param(ctx, "type")
+	if httpErr := checkPlans(ctx, subType, payload); httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	if httpErr := checkTrial(ctx, subType, payload); httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	log := getLogger(ctx).WithFields(logrus.Fields{
+		"plan":     payload.Plan,
+		"quantity": payload.Quantity,
+		"type":     subType,
+	})
+	ctx = setLogger(ctx, log)
+
+	discount, httpErr := findDiscount(ctx, payload)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
+	target := getTargetUser(ctx)
+	user, httpErr := getUser(ctx, target.ID)
+	if httpErr == nil && user == nil {
+		httpErr = httpError(http.StatusNotFound, "No customer found for user %s, there is no invoice to preview before the first subscription", target.ID)
+	}
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	sub, httpErr := getSubscription(ctx, target.ID, subType)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
+	params := &SubscriptionParams{
+		Plan:      payload.Plan,
+		Quantity:  payload.Quantity,
+		Proration: payload.Proration,
+		Items:     requestedItems(payload),
+	}
+	// promotion codes can't be previewed, the coupon behind them is the same
+	if discount != nil {
+		params.Coupon = discount.ID
+	}
+	subID := ""
+	if sub == nil {
+		params.Type = subType
+		if params.TrialDays, httpErr = trialDays(ctx, subType, payload); httpErr != nil {
+			sendJSON(w, httpErr.Code, httpErr)
+			return
+		}
+	} else {
+		subID = sub.RemoteID
+		params.ItemID = sub.RemoteItemID
+		if payload.ChangeAt == changeAtPeriodEnd {
+			// there is nothing left to prorate then
+			params.Proration = ProrationNone
+		}
+	}
+
+	invoice, err := getPayerProxy(ctx).PreviewInvoice(ctx, user.RemoteID, subID, params)
+	if err != nil {
+		log.WithError(err).Info("Failed to preview invoice in stripe")
+		writeError(w, http.StatusBadRequest, "Error communicating with stripe: %s", err)
+		return
+	}
+
+	rsp := &previewResponse{Invoice: invoice}
+	for _, line := range invoice.Lines {
+		if line.Proration {
+			rsp.Proration += line.Amount
+		}
+	}
+	sendJSON(w, http.StatusOK, rsp)
+}
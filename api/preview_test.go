@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/netlify/gojoin/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPreviewPlanChange(t *testing.T) {
+	clearAuditLog()
+	tp := &testProxy{
+		preview: &Invoice{Amount: 3500, Currency: "usd", Lines: []InvoiceLine{
+			{Plan: "gold", Amount: -1000, Proration: true},
+			{Plan: "platinum", Amount: 1500, Proration: true},
+			{Plan: "platinum", Amount: 3000},
+		}},
+		promotionCodes: map[string]*Coupon{"SPRING": {ID: "20OFF", PromotionCode: "promo_1", Valid: true}},
+	}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	payload := &subscriptionRequest{Plan: "platinum", Quantity: 2, PromotionCode: "SPRING"}
+	extractError(t, http.StatusNotFound, request(t, "POST", "/subscriptions/membership/preview", payload, false))
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "gold")
+	defer cleanup(s1, tu)
+
+	preview := new(previewResponse)
+	extractPayload(t, request(t, "POST", "/subscriptions/membership/preview", payload, false), preview)
+	assert.Equal(t, 500, preview.Proration)
+	if assert.NotNil(t, preview.Invoice) {
+		assert.Equal(t, 3500, preview.Invoice.Amount)
+	}
+	if assert.Len(t, tp.previewCalls, 1) {
+		call := tp.previewCalls[0]
+		assert.Equal(t, "stripe-given-value", call.customerID)
+		assert.Equal(t, s1.RemoteID, call.subID)
+		assert.Equal(t, "platinum", call.params.Plan)
+		assert.Equal(t, 2, call.params.Quantity)
+		// the coupon behind the code is previewed
+		assert.Equal(t, "20OFF", call.params.Coupon)
+		assert.Empty(t, call.params.PromotionCode)
+	}
+
+	// a change at the end of the period isn't prorated
+	payload = &subscriptionRequest{Plan: "silver", ChangeAt: changeAtPeriodEnd}
+	extractPayload(t, request(t, "POST", "/subscriptions/membership/preview", payload, false), preview)
+	if assert.Len(t, tp.previewCalls, 2) {
+		assert.Equal(t, ProrationNone, tp.previewCalls[1].params.Proration)
+	}
+
+	// nothing was changed
+	assert.Empty(t, tp.updateCalls)
+	found := &models.Subscription{ID: s1.ID}
+	if assert.NoError(t, db.Find(found).Error) {
+		assert.Equal(t, "gold", found.Plan)
+		assert.False(t, found.HasPendingChange())
+	}
+	count := 0
+	db.Model(&models.AuditLogEntry{}).Count(&count)
+	assert.Equal(t, 0, count)
+}
+
+func TestPreviewNewSubscription(t *testing.T) {
+	tp := &testProxy{preview: &Invoice{Amount: 2000}}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	defer cleanup(tu)
+
+	payload := &subscriptionRequest{Plan: "gold", Items: []itemRequest{{Plan: "storage"}}}
+	preview := new(previewResponse)
+	extractPayload(t, request(t, "POST", "/subscriptions/membership/preview", payload, false), preview)
+	assert.Equal(t, 0, preview.Proration)
+	if assert.Len(t, tp.previewCalls, 1) {
+		call := tp.previewCalls[0]
+		assert.Empty(t, call.subID)
+		assert.Equal(t, "membership", call.params.Type)
+		assert.Equal(t, []ItemParams{{Plan: "storage"}}, call.params.Items)
+	}
+	assert.Empty(t, tp.createCalls)
+
+	extractError(t, http.StatusForbidden, request(t, "POST", "/subscriptions/membership/preview", &subscriptionRequest{Plan: "gold", TrialPeriodDays: 30}, false))
+}
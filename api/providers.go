@@ -0,0 +1,64 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gojoin/conf"
+)
+
+// DefaultProvider is used when the config doesn't name a provider
+const DefaultProvider = "stripe"
+
+// ProviderFactory builds a payment provider from the config. Providers that keep
+// their own state can store it in the db.
+type ProviderFactory func(config *conf.Config, db *gorm.DB) (PayerProxy, error)
+
+var providers = struct {
+	sync.RWMutex
+	factories map[string]ProviderFactory
+}{factories: map[string]ProviderFactory{}}
+
+func init() {
+	RegisterProvider(DefaultProvider, newStripeProxy)
+	RegisterProvider(fakeProvider, newFakeProxy)
+}
+
+// RegisterProvider makes a payment provider available under the name, so it
+// can be selected with the provider field in the config. Registering the same
+// name twice replaces the earlier factory.
+func RegisterProvider(name string, factory ProviderFactory) {
+	providers.Lock()
+	defer providers.Unlock()
+	providers.factories[name] = factory
+}
+
+// NewProvider builds the payment provider selected in the config
+func NewProvider(config *conf.Config, db *gorm.DB) (PayerProxy, error) {
+	name := config.Provider
+	if name == "" {
+		name = DefaultProvider
+	}
+
+	providers.RLock()
+	factory, ok := providers.factories[name]
+	providers.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown provider %s, available providers are %v", name, Providers())
+	}
+	return factory(config, db)
+}
+
+// Providers lists the names of the registered payment providers
+func Providers() []string {
+	providers.RLock()
+	defer providers.RUnlock()
+	names := make([]string, 0, len(providers.factories))
+	for name := range providers.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gojoin/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/stripe-go"
+)
+
+func TestNewProviderDefaultsToStripe(t *testing.T) {
+	provider, err := NewProvider(&conf.Config{StripeKey: "sk_test"}, db)
+	if assert.NoError(t, err) {
+		assert.IsType(t, &StripeProxy{}, provider)
+	}
+
+	_, err = NewProvider(&conf.Config{}, db)
+	assert.Error(t, err)
+}
+
+func TestStripeTimeoutIsPerProxy(t *testing.T) {
+	fast, err := newStripeProxy(&conf.Config{StripeKey: "sk_fast", ProviderCalls: conf.CallConfig{TimeoutMs: 100}}, db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	slow, err := newStripeProxy(&conf.Config{StripeKey: "sk_slow", ProviderCalls: conf.CallConfig{TimeoutMs: 5000}}, db)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	fastBackend, ok := fast.(*StripeProxy).backend.(*stripe.BackendConfiguration)
+	if assert.True(t, ok) {
+		assert.Equal(t, 100*time.Millisecond, fastBackend.HTTPClient.Timeout)
+	}
+	slowBackend, ok := slow.(*StripeProxy).backend.(*stripe.BackendConfiguration)
+	if assert.True(t, ok) {
+		assert.Equal(t, 5*time.Second, slowBackend.HTTPClient.Timeout)
+	}
+}
+
+func TestNewProviderFromRegistry(t *testing.T) {
+	tp := &testProxy{createCustomerID: "remote-user-id"}
+	RegisterProvider("test", func(config *conf.Config, db *gorm.DB) (PayerProxy, error) {
+		return tp, nil
+	})
+	assert.Contains(t, Providers(), "test")
+
+	provider, err := NewProvider(&conf.Config{Provider: "test"}, db)
+	if assert.NoError(t, err) {
+		id, err := provider.CreateCustomer(context.Background(), "batman", "bruce@dc.com", "token", "")
+		assert.NoError(t, err)
+		assert.Equal(t, "remote-user-id", id)
+	}
+
+	_, err = NewProvider(&conf.Config{Provider: "nonsense"}, db)
+	assert.Error(t, err)
+}
@@ -0,0 +1,327 @@
+package api
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/netlify/gojoin/conf"
+	"github.com/pborman/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stripe/stripe-go"
+)
+
+// the time a change can take when the attempts have no timeout
+const defaultChangeTimeout = 2 * time.Minute
+
+// retryingProxy puts a timeout on every call to the payment provider and retries
+// the ones that failed for reasons that are likely to go away.
+type retryingProxy struct {
+	next       PayerProxy
+	timeout    time.Duration
+	maxRetries int
+	retryDelay time.Duration
+}
+
+func withRetries(next PayerProxy, config conf.CallConfig) PayerProxy {
+	return &retryingProxy{
+		next:       next,
+		timeout:    time.Duration(config.TimeoutMs) * time.Millisecond,
+		maxRetries: config.MaxRetries,
+		retryDelay: time.Duration(config.RetryDelayMs) * time.Millisecond,
+	}
+}
+
+// The calls that add something aren't safe to repeat, so the retries share an
+// idempotency key. One is made up if the request didn't send one.
+func (p *retryingProxy) CreateCustomer(ctx context.Context, userID, email, payToken, idempotencyKey string) (string, error) {
+	if idempotencyKey == "" {
+		idempotencyKey = uuid.NewRandom().String()
+	}
+	var id string
+	err := p.change(ctx, "create_customer", func(ctx context.Context) (err error) {
+		id, err = p.next.CreateCustomer(ctx, userID, email, payToken, idempotencyKey)
+		return err
+	})
+	return id, err
+}
+
+func (p *retryingProxy) UpdatePaymentMethod(ctx context.Context, customerID, token, idempotencyKey string) error {
+	if idempotencyKey == "" {
+		idempotencyKey = uuid.NewRandom().String()
+	}
+	return p.change(ctx, "update_payment_method", func(ctx context.Context) error {
+		return p.next.UpdatePaymentMethod(ctx, customerID, token, idempotencyKey)
+	})
+}
+
+func (p *retryingProxy) ListPaymentMethods(ctx context.Context, customerID string) ([]*PaymentMethod, error) {
+	var methods []*PaymentMethod
+	err := p.call(ctx, "list_payment_methods", func(ctx context.Context) (err error) {
+		methods, err = p.next.ListPaymentMethods(ctx, customerID)
+		return err
+	})
+	return methods, err
+}
+
+func (p *retryingProxy) AddPaymentMethod(ctx context.Context, customerID, token, idempotencyKey string) (*PaymentMethod, error) {
+	if idempotencyKey == "" {
+		idempotencyKey = uuid.NewRandom().String()
+	}
+	var method *PaymentMethod
+	err := p.change(ctx, "add_payment_method", func(ctx context.Context) (err error) {
+		method, err = p.next.AddPaymentMethod(ctx, customerID, token, idempotencyKey)
+		return err
+	})
+	return method, err
+}
+
+// Deleting twice fails as the payment method is gone, so if an earlier attempt
+// might have got through that counts as deleted.
+func (p *retryingProxy) DeletePaymentMethod(ctx context.Context, customerID, methodID string) error {
+	tried := false
+	return p.change(ctx, "delete_payment_method", func(ctx context.Context) error {
+		err := p.next.DeletePaymentMethod(ctx, customerID, methodID)
+		if err == ErrPaymentMethodNotFound && tried {
+			return nil
+		}
+		tried = true
+		return err
+	})
+}
+
+func (p *retryingProxy) SetDefaultPaymentMethod(ctx context.Context, customerID, methodID string) error {
+	return p.change(ctx, "set_default_payment_method", func(ctx context.Context) error {
+		return p.next.SetDefaultPaymentMethod(ctx, customerID, methodID)
+	})
+}
+
+func (p *retryingProxy) Create(ctx context.Context, customerID string, params *SubscriptionParams) (*RemoteSubscription, error) {
+	if params.IdempotencyKey == "" {
+		withKey := *params
+		withKey.IdempotencyKey = uuid.NewRandom().String()
+		params = &withKey
+	}
+	var remote *RemoteSubscription
+	err := p.change(ctx, "create", func(ctx context.Context) (err error) {
+		remote, err = p.next.Create(ctx, customerID, params)
+		return err
+	})
+	return remote, err
+}
+
+func (p *retryingProxy) Update(ctx context.Context, subID string, params *SubscriptionParams) (*RemoteSubscription, error) {
+	var remote *RemoteSubscription
+	err := p.change(ctx, "update", func(ctx context.Context) (err error) {
+		remote, err = p.next.Update(ctx, subID, params)
+		return err
+	})
+	return remote, err
+}
+
+// Like deleting a payment method, a subscription that is gone on a retry was
+// canceled by an earlier attempt.
+func (p *retryingProxy) Delete(ctx context.Context, subID string) error {
+	tried := false
+	return p.change(ctx, "delete", func(ctx context.Context) error {
+		err := p.next.Delete(ctx, subID)
+		if err == ErrSubscriptionNotFound && tried {
+			return nil
+		}
+		tried = true
+		return err
+	})
+}
+
+func (p *retryingProxy) CancelAtPeriodEnd(ctx context.Context, subID string) (*RemoteSubscription, error) {
+	var remote *RemoteSubscription
+	err := p.change(ctx, "cancel_at_period_end", func(ctx context.Context) (err error) {
+		remote, err = p.next.CancelAtPeriodEnd(ctx, subID)
+		return err
+	})
+	return remote, err
+}
+
+func (p *retryingProxy) Reactivate(ctx context.Context, subID, itemID string) (*RemoteSubscription, error) {
+	var remote *RemoteSubscription
+	err := p.change(ctx, "reactivate", func(ctx context.Context) (err error) {
+		remote, err = p.next.Reactivate(ctx, subID, itemID)
+		return err
+	})
+	return remote, err
+}
+
+func (p *retryingProxy) Pause(ctx context.Context, subID string, resumeAt *time.Time) (*RemoteSubscription, error) {
+	var remote *RemoteSubscription
+	err := p.change(ctx, "pause", func(ctx context.Context) (err error) {
+		remote, err = p.next.Pause(ctx, subID, resumeAt)
+		return err
+	})
+	return remote, err
+}
+
+func (p *retryingProxy) Resume(ctx context.Context, subID string) (*RemoteSubscription, error) {
+	var remote *RemoteSubscription
+	err := p.change(ctx, "resume", func(ctx context.Context) (err error) {
+		remote, err = p.next.Resume(ctx, subID)
+		return err
+	})
+	return remote, err
+}
+
+func (p *retryingProxy) GetCoupon(ctx context.Context, id string) (*Coupon, error) {
+	var c *Coupon
+	err := p.call(ctx, "get_coupon", func(ctx context.Context) (err error) {
+		c, err = p.next.GetCoupon(ctx, id)
+		return err
+	})
+	return c, err
+}
+
+func (p *retryingProxy) GetPromotionCode(ctx context.Context, code string) (*Coupon, error) {
+	var c *Coupon
+	err := p.call(ctx, "get_promotion_code", func(ctx context.Context) (err error) {
+		c, err = p.next.GetPromotionCode(ctx, code)
+		return err
+	})
+	return c, err
+}
+
+func (p *retryingProxy) ListInvoices(ctx context.Context, customerID string, limit int) ([]*Invoice, error) {
+	var invoices []*Invoice
+	err := p.call(ctx, "list_invoices", func(ctx context.Context) (err error) {
+		invoices, err = p.next.ListInvoices(ctx, customerID, limit)
+		return err
+	})
+	return invoices, err
+}
+
+func (p *retryingProxy) GetInvoice(ctx context.Context, customerID, id string) (*Invoice, error) {
+	var invoice *Invoice
+	err := p.call(ctx, "get_invoice", func(ctx context.Context) (err error) {
+		invoice, err = p.next.GetInvoice(ctx, customerID, id)
+		return err
+	})
+	return invoice, err
+}
+
+func (p *retryingProxy) PreviewInvoice(ctx context.Context, customerID, subID string, params *SubscriptionParams) (*Invoice, error) {
+	var invoice *Invoice
+	err := p.call(ctx, "preview_invoice", func(ctx context.Context) (err error) {
+		invoice, err = p.next.PreviewInvoice(ctx, customerID, subID, params)
+		return err
+	})
+	return invoice, err
+}
+
+// change makes a call that changes something with the payer. It is detached from
+// the request, a change that has started is seen through even if the client goes
+// away, so we can store or undo its result. The attempts share an idempotency key,
+// so a retry of a change that got through isn't made twice.
+func (p *retryingProxy) change(ctx context.Context, name string, fn func(context.Context) error) error {
+	ctx = setCallKey(ctx, uuid.NewRandom().String())
+	ctx, cancel := context.WithTimeout(detached{ctx}, p.changeTimeout())
+	defer cancel()
+	return p.call(ctx, name, fn)
+}
+
+// changeTimeout is the time all the attempts of a change can take
+func (p *retryingProxy) changeTimeout() time.Duration {
+	if p.timeout <= 0 {
+		return defaultChangeTimeout
+	}
+	total := p.timeout
+	for attempt := 0; attempt < p.maxRetries; attempt++ {
+		total += p.timeout + p.retryDelay<<uint(attempt)
+	}
+	return total
+}
+
+func (p *retryingProxy) call(ctx context.Context, name string, fn func(context.Context) error) error {
+	for attempt := 0; ; attempt++ {
+		err := p.attempt(ctx, fn)
+		if err == nil || attempt >= p.maxRetries || ctx.Err() != nil || !isTransient(err) {
+			return err
+		}
+
+		delay := p.backoff(attempt)
+		getLogger(ctx).WithError(err).WithFields(logrus.Fields{
+			"provider_call": name,
+			"attempt":       attempt + 1,
+		}).Warnf("Call to payment provider failed, retrying in %v", delay)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (p *retryingProxy) attempt(ctx context.Context, fn func(context.Context) error) error {
+	if p.timeout <= 0 {
+		return fn(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+	return fn(ctx)
+}
+
+// backoff doubles the delay with every attempt, a random half of it is taken
+// off so clients that failed together don't retry together
+func (p *retryingProxy) backoff(attempt int) time.Duration {
+	delay := p.retryDelay << uint(attempt)
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// isTransient is true for errors where trying again might work: timeouts, network
+// errors, rate limits, server errors and conflicts. Stripe answers with a conflict
+// while another request with the same idempotency key is still in progress.
+func isTransient(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+
+	switch e := err.(type) {
+	case *stripe.Error:
+		return e.HTTPStatusCode == http.StatusTooManyRequests || e.HTTPStatusCode == http.StatusConflict ||
+			e.HTTPStatusCode >= http.StatusInternalServerError
+	case net.Error:
+		return true
+	case interface {
+		Temporary() bool
+	}:
+		return e.Temporary()
+	}
+	return false
+}
+
+// callWithContext runs a call that can't be canceled itself, but stops waiting
+// for it when the context is done.
+func callWithContext(ctx context.Context, fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// detached has the values of a context, but not its deadline or cancellation
+type detached struct {
+	context.Context
+}
+
+func (detached) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detached) Done() <-chan struct{}       { return nil }
+func (detached) Err() error                  { return nil }
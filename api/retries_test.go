@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/netlify/gojoin/conf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/stripe-go"
+)
+
+// flakyProxy fails the first calls with the error it was given
+type flakyProxy struct {
+	testProxy
+	failures int
+	err      error
+	delay    time.Duration
+	calls    int
+}
+
+func (f *flakyProxy) fail(ctx context.Context) error {
+	f.calls++
+	if f.delay > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(f.delay):
+		}
+	}
+	if f.calls <= f.failures {
+		return f.err
+	}
+	return nil
+}
+
+func (f *flakyProxy) Create(ctx context.Context, customerID string, params *SubscriptionParams) (*RemoteSubscription, error) {
+	if err := f.fail(ctx); err != nil {
+		return nil, err
+	}
+	return f.testProxy.Create(ctx, customerID, params)
+}
+
+func (f *flakyProxy) GetCoupon(ctx context.Context, id string) (*Coupon, error) {
+	if err := f.fail(ctx); err != nil {
+		return nil, err
+	}
+	return f.testProxy.GetCoupon(ctx, id)
+}
+
+func (f *flakyProxy) Delete(ctx context.Context, subID string) error {
+	if err := f.fail(ctx); err != nil {
+		return err
+	}
+	return f.testProxy.Delete(ctx, subID)
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	fp := &flakyProxy{
+		testProxy: testProxy{createSubID: "remote-id"},
+		failures:  2,
+		err:       &stripe.Error{HTTPStatusCode: http.StatusTooManyRequests},
+	}
+	proxy := withRetries(fp, conf.CallConfig{MaxRetries: 2, RetryDelayMs: 1})
+
+	remote, err := proxy.Create(context.Background(), "customer", &SubscriptionParams{Type: "membership", Plan: "gold"})
+	if assert.NoError(t, err) {
+		assert.Equal(t, "remote-id", remote.ID)
+	}
+	assert.Equal(t, 3, fp.calls)
+	if assert.Len(t, fp.createCalls, 1) {
+		// a key is made up so the retries can't create it twice
+		assert.NotEmpty(t, fp.createCalls[0].idempotencyKey)
+	}
+
+	fp.calls = 0
+	fp.failures = 3
+	assert.Error(t, proxy.Delete(context.Background(), "remote-id"))
+	assert.Equal(t, 3, fp.calls)
+}
+
+func TestDontRetryPermanentFailures(t *testing.T) {
+	fp := &flakyProxy{
+		failures: 1,
+		err:      &stripe.Error{HTTPStatusCode: http.StatusPaymentRequired},
+	}
+	proxy := withRetries(fp, conf.CallConfig{MaxRetries: 2, RetryDelayMs: 1})
+
+	assert.Error(t, proxy.Delete(context.Background(), "remote-id"))
+	assert.Equal(t, 1, fp.calls)
+}
+
+func TestRetryTimeouts(t *testing.T) {
+	fp := &flakyProxy{delay: 50 * time.Millisecond}
+	proxy := withRetries(fp, conf.CallConfig{TimeoutMs: 5, MaxRetries: 1, RetryDelayMs: 1})
+
+	assert.Equal(t, context.DeadlineExceeded, proxy.Delete(context.Background(), "remote-id"))
+	assert.Equal(t, 2, fp.calls)
+}
+
+func TestStopRetryingWhenCanceled(t *testing.T) {
+	fp := &flakyProxy{failures: 5, err: &stripe.Error{HTTPStatusCode: http.StatusServiceUnavailable}}
+	proxy := withRetries(fp, conf.CallConfig{MaxRetries: 5, RetryDelayMs: 1000})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := proxy.GetCoupon(ctx, "coupon")
+	assert.Equal(t, context.DeadlineExceeded, err)
+	assert.Equal(t, 1, fp.calls)
+}
+
+func TestChangesOutliveTheRequest(t *testing.T) {
+	fp := &flakyProxy{
+		failures: 1,
+		err:      &stripe.Error{HTTPStatusCode: http.StatusConflict},
+		delay:    20 * time.Millisecond,
+	}
+	proxy := withRetries(fp, conf.CallConfig{TimeoutMs: 1000, MaxRetries: 1, RetryDelayMs: 1})
+
+	// the client going away doesn't stop the change or its retries
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, proxy.Delete(ctx, "remote-id"))
+	assert.Equal(t, 2, fp.calls)
+	assert.Equal(t, []string{"remote-id"}, fp.deleteCalls)
+}
+
+// lostReplyProxy makes its changes, but the reply to the first call is lost
+type lostReplyProxy struct {
+	testProxy
+	deleted bool
+	keys    []string
+}
+
+func (l *lostReplyProxy) Delete(ctx context.Context, subID string) error {
+	if l.deleted {
+		return ErrSubscriptionNotFound
+	}
+	l.deleted = true
+	return context.DeadlineExceeded
+}
+
+func (l *lostReplyProxy) Pause(ctx context.Context, subID string, resumeAt *time.Time) (*RemoteSubscription, error) {
+	l.keys = append(l.keys, getCallKey(ctx))
+	if len(l.keys) == 1 {
+		return nil, context.DeadlineExceeded
+	}
+	return l.testProxy.Pause(ctx, subID, resumeAt)
+}
+
+func TestRetriedDeleteThatGotThrough(t *testing.T) {
+	lp := &lostReplyProxy{}
+	proxy := withRetries(lp, conf.CallConfig{MaxRetries: 1, RetryDelayMs: 1})
+
+	assert.NoError(t, proxy.Delete(context.Background(), "remote-id"))
+
+	// without a retry it really is gone
+	assert.Equal(t, ErrSubscriptionNotFound, proxy.Delete(context.Background(), "remote-id"))
+}
+
+func TestRetriesShareTheCallKey(t *testing.T) {
+	lp := &lostReplyProxy{}
+	proxy := withRetries(lp, conf.CallConfig{MaxRetries: 1, RetryDelayMs: 1})
+
+	_, err := proxy.Pause(context.Background(), "remote-id", nil)
+	assert.NoError(t, err)
+	if assert.Len(t, lp.keys, 2) {
+		assert.NotEmpty(t, lp.keys[0])
+		assert.Equal(t, lp.keys[0], lp.keys[1])
+	}
+
+	// the next change gets a key of its own
+	proxy.Pause(context.Background(), "remote-id", nil)
+	if assert.Len(t, lp.keys, 3) {
+		assert.NotEqual(t, lp.keys[0], lp.keys[2])
+	}
+}
+
+func TestIsTransient(t *testing.T) {
+	assert.True(t, isTransient(context.DeadlineExceeded))
+	assert.True(t, isTransient(&stripe.Error{HTTPStatusCode: http.StatusTooManyRequests}))
+	assert.True(t, isTransient(&stripe.Error{HTTPStatusCode: http.StatusBadGateway}))
+	assert.True(t, isTransient(&stripe.Error{HTTPStatusCode: http.StatusConflict}))
+	assert.False(t, isTransient(&stripe.Error{HTTPStatusCode: http.StatusBadRequest}))
+	assert.False(t, isTransient(context.Canceled))
+	assert.False(t, isTransient(errors.New("nope")))
+}
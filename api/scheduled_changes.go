@@ -0,0 +1,129 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gojoin/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// how often we look for scheduled plan changes that are due
+	scheduledChangeInterval = 10 * time.Minute
+
+	// scheduled plan changes are applied this long before the period ends, so
+	// the invoice of the new period bills the new plan. It is longer than the
+	// interval so one check always falls into it.
+	scheduledChangeLead = time.Hour
+
+	// the actor in the audit log for scheduled plan changes that were applied
+	scheduledChangeActor = "scheduled_change"
+)
+
+// scheduleChange stores the plan change to be applied when the current period
+// ends, nothing changes with the payer until then. Asking for the plan the
+// subscription already has drops the scheduled change.
+func scheduleChange(ctx context.Context, existing *models.Subscription, payload *subscriptionRequest) *HTTPError {
+	log := getLogger(ctx)
+	if existing.CurrentPeriodEnd == nil {
+		return httpError(http.StatusBadRequest, "The subscription has no current period to change the plan at the end of")
+	}
+
+	if payload.Plan == existing.Plan && (payload.Quantity == 0 || payload.Quantity == existing.Quantity) {
+		log.Debug("Dropping scheduled plan change")
+		existing.ClearPendingChange()
+	} else {
+		existing.PendingPlan = payload.Plan
+		existing.PendingQuantity = payload.Quantity
+		existing.PendingChangeAt = existing.CurrentPeriodEnd
+	}
+
+	if rsp := getDB(ctx).Save(existing); rsp.Error != nil {
+		log.WithError(rsp.Error).Warnf("Failed to schedule plan change: %+v", existing)
+		return httpError(http.StatusInternalServerError, "Error while scheduling the plan change")
+	}
+
+	if existing.HasPendingChange() {
+		log.WithField("change_at", existing.PendingChangeAt).Info("Scheduled plan change")
+		scheduled := *existing
+		scheduled.Plan = existing.PendingPlan
+		audit(ctx, models.AuditScheduleChange, &scheduled, existing.Plan)
+	}
+	return nil
+}
+
+// applyScheduledChange moves the subscription to its pending plan with the payer.
+// It happens just before the period ends and isn't prorated, the renewal is the
+// first invoice with the new plan.
+func applyScheduledChange(ctx context.Context, sub *models.Subscription) error {
+	lock, httpErr := lockUser(ctx, sub.UserID)
+	if httpErr != nil {
+		return errors.New(httpErr.Message)
+	}
+	defer releaseUser(ctx, lock)
+
+	log := getLogger(ctx).WithFields(logrus.Fields{
+		"user_id":      sub.UserID,
+		"type":         sub.Type,
+		"remote_id":    sub.RemoteID,
+		"pending_plan": sub.PendingPlan,
+	})
+	remote, err := getPayerProxy(ctx).Update(ctx, sub.RemoteID, &SubscriptionParams{
+		Plan:      sub.PendingPlan,
+		Quantity:  sub.PendingQuantity,
+		Proration: ProrationNone,
+		ItemID:    sub.RemoteItemID,
+	})
+	if err != nil {
+		return err
+	}
+
+	oldPlan := sub.Plan
+	sub.Plan = sub.PendingPlan
+	remote.Apply(sub)
+	sub.ClearPendingChange()
+	if rsp := getDB(ctx).Save(sub); rsp.Error != nil {
+		log.WithError(rsp.Error).Warnf("Failed to save scheduled plan change after successful stripe call: %+v", sub)
+		return rsp.Error
+	}
+
+	log.Info("Applied scheduled plan change")
+	auditAs(ctx, scheduledChangeActor, models.AuditUpdate, sub, oldPlan)
+	return nil
+}
+
+// dueScheduledChanges finds the scheduled plan changes that should be applied now
+func dueScheduledChanges(db *gorm.DB, now time.Time) ([]models.Subscription, error) {
+	return models.DueSubscriptionChanges(db, now.Add(scheduledChangeLead))
+}
+
+// applyScheduledChanges periodically applies the scheduled plan changes that
+// are due
+func (a *API) applyScheduledChanges(interval time.Duration) {
+	log := a.log.WithField("component", "scheduled_changes")
+	ctx := setDB(context.Background(), a.db)
+	ctx = setPayerProxy(ctx, a.payerProxy)
+	ctx = setLogger(ctx, log)
+
+	for range time.Tick(interval) {
+		due, err := dueScheduledChanges(a.db, time.Now())
+		if err != nil {
+			log.WithError(err).Warn("Failed to query scheduled plan changes")
+			continue
+		}
+
+		for i := range due {
+			subCtx, err := a.tenantContext(ctx, due[i].TenantID)
+			if err == nil {
+				err = applyScheduledChange(subCtx, &due[i])
+			}
+			if err != nil {
+				log.WithError(err).WithField("remote_id", due[i].RemoteID).Warn("Failed to apply scheduled plan change")
+			}
+		}
+	}
+}
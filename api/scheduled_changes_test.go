@@ -0,0 +1,210 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/netlify/gojoin/conf"
+	"github.com/netlify/gojoin/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangePlanWithProration(t *testing.T) {
+	tp := &testProxy{updateSubID: "remote-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "bronze")
+	defer cleanup(s1, tu)
+
+	payload := &subscriptionRequest{Plan: "gold", Proration: "sometimes"}
+	extractError(t, http.StatusBadRequest, request(t, "PUT", "/subscriptions/membership", payload, false))
+	payload = &subscriptionRequest{Plan: "gold", ChangeAt: "tomorrow"}
+	extractError(t, http.StatusBadRequest, request(t, "PUT", "/subscriptions/membership", payload, false))
+	assert.Empty(t, tp.updateCalls)
+
+	payload = &subscriptionRequest{Plan: "gold", Proration: ProrationAlwaysInvoice, ChangeAt: changeNow}
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "PUT", "/subscriptions/membership", payload, false), sub)
+	assert.Equal(t, "gold", sub.Plan)
+	if assert.Len(t, tp.updateCalls, 1) {
+		assert.Equal(t, ProrationAlwaysInvoice, tp.updateCalls[0].proration)
+	}
+}
+
+func TestScheduleChangeAtPeriodEnd(t *testing.T) {
+	clearAuditLog()
+	tp := &testProxy{updateSubID: "remote-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "gold")
+	defer cleanup(s1, tu)
+
+	payload := &subscriptionRequest{Plan: "bronze", StripeKey: "something", ChangeAt: changeAtPeriodEnd}
+	extractError(t, http.StatusBadRequest, request(t, "PUT", "/subscriptions/membership", payload, false))
+
+	payload.StripeKey = ""
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "PUT", "/subscriptions/membership", payload, false), sub)
+	assert.Equal(t, "gold", sub.Plan)
+	assert.Equal(t, "bronze", sub.PendingPlan)
+	if assert.NotNil(t, sub.PendingChangeAt) {
+		assert.Equal(t, s1.CurrentPeriodEnd.Unix(), sub.PendingChangeAt.Unix())
+	}
+	assert.Empty(t, tp.updateCalls)
+
+	entries := []models.AuditLogEntry{}
+	db.Find(&entries)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, models.AuditScheduleChange, entries[0].Action)
+		assert.Equal(t, "gold", entries[0].OldPlan)
+		assert.Equal(t, "bronze", entries[0].NewPlan)
+	}
+
+	// asking for the current plan drops the change again
+	payload.Plan = "gold"
+	sub = new(models.Subscription)
+	extractPayload(t, request(t, "PUT", "/subscriptions/membership", payload, false), sub)
+	assert.Empty(t, sub.PendingPlan)
+	assert.Nil(t, sub.PendingChangeAt)
+}
+
+func TestWebhookAppliesScheduledChange(t *testing.T) {
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "gold")
+	defer cleanup(s1, tu)
+	// stripe's times are in seconds
+	end := s1.CurrentPeriodEnd.Truncate(time.Second)
+	s1.PendingPlan = "bronze"
+	s1.PendingQuantity = 2
+	s1.PendingChangeAt = &end
+	db.Save(s1)
+
+	// an update in the same period leaves the change for later
+	body := fmt.Sprintf(`{"id": "evt_7", "type": "customer.subscription.updated", "data": {"object": {"id": "%s", "status": "active", "plan": {"id": "gold"}, "current_period_start": %d}}}`,
+		s1.RemoteID, time.Now().Unix())
+	rsp := webhookRequest(t, body, time.Now(), config.StripeWebhookSecret)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	assert.Empty(t, tp.updateCalls)
+
+	body = fmt.Sprintf(`{"id": "evt_8", "type": "customer.subscription.updated", "data": {"object": {"id": "%s", "status": "active", "plan": {"id": "gold"}, "current_period_start": %d}}}`,
+		s1.RemoteID, end.Unix())
+	rsp = webhookRequest(t, body, time.Now(), config.StripeWebhookSecret)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+	if assert.Len(t, tp.updateCalls, 1) {
+		assert.Equal(t, "bronze", tp.updateCalls[0].plan)
+		assert.Equal(t, 2, tp.updateCalls[0].quantity)
+		assert.Equal(t, ProrationNone, tp.updateCalls[0].proration)
+	}
+
+	found := &models.Subscription{ID: s1.ID}
+	if assert.NoError(t, db.Find(found).Error) {
+		assert.Equal(t, "bronze", found.Plan)
+		assert.False(t, found.HasPendingChange())
+	}
+}
+
+func TestApplyDueScheduledChanges(t *testing.T) {
+	tp := &testProxy{}
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	due := createSubscription(testUserID, "membership", "gold")
+	later := createSubscription(testUserID, "revenue", "gold")
+	defer cleanup(due, later, tu)
+
+	past := time.Now().Add(-time.Hour)
+	due.PendingPlan = "bronze"
+	due.PendingChangeAt = &past
+	db.Save(due)
+	later.PendingPlan = "bronze"
+	later.PendingChangeAt = later.CurrentPeriodEnd
+	db.Save(later)
+
+	subs, err := models.DueSubscriptionChanges(db, time.Now())
+	if !assert.NoError(t, err) || !assert.Len(t, subs, 1) {
+		return
+	}
+	assert.Equal(t, due.ID, subs[0].ID)
+
+	ctx := setPayerProxy(setDB(context.Background(), db), tp)
+	ctx = setLogger(ctx, api.log)
+	if assert.NoError(t, applyScheduledChange(ctx, &subs[0])) {
+		assert.Equal(t, "bronze", subs[0].Plan)
+	}
+	subs, err = models.DueSubscriptionChanges(db, time.Now())
+	if assert.NoError(t, err) {
+		assert.Empty(t, subs)
+	}
+}
+
+func TestScheduledChangeIsBilledForNewPeriod(t *testing.T) {
+	ctx := context.Background()
+	plans := conf.PlansConfig{"membership": {
+		"gold":   {Price: 2000},
+		"bronze": {Price: 500},
+	}}
+	provider, err := NewProvider(&conf.Config{Provider: "fake", Plans: plans}, db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	api.payerProxy = provider
+	defer func() { api.payerProxy = &errorProxy{} }()
+	defer db.Delete(models.FakeSubscription{})
+	defer db.Delete(models.FakeCustomer{})
+	defer db.Delete(models.FakeInvoice{})
+	defer db.Delete(models.FakeInvoiceLine{})
+
+	customerID, err := provider.CreateCustomer(ctx, testUserID, testUserEmail, "tok_visa", "")
+	if !assert.NoError(t, err) {
+		return
+	}
+	remote, err := provider.Create(ctx, customerID, &SubscriptionParams{Type: "membership", Plan: "gold"})
+	if !assert.NoError(t, err) {
+		return
+	}
+	tu := createUser(testUserID, testUserEmail, customerID)
+	s1 := createSubscription(testUserID, "membership", "gold")
+	defer cleanup(s1, tu)
+	remote.Apply(s1)
+	db.Save(s1)
+
+	payload := &subscriptionRequest{Plan: "bronze", ChangeAt: changeAtPeriodEnd}
+	extractPayload(t, request(t, "PUT", "/subscriptions/membership", payload, false), new(models.Subscription))
+
+	// it is due just before the period ends
+	due, err := dueScheduledChanges(db, time.Now())
+	if assert.NoError(t, err) {
+		assert.Empty(t, due)
+	}
+	due, err = dueScheduledChanges(db, remote.PeriodEnd.Add(-time.Minute))
+	if !assert.NoError(t, err) || !assert.Len(t, due, 1) {
+		return
+	}
+	ctx = setLogger(setPayerProxy(setDB(ctx, db), provider), api.log)
+	if !assert.NoError(t, applyScheduledChange(ctx, &due[0])) {
+		return
+	}
+
+	// the renewal bills the new plan, and nothing was prorated
+	next, err := provider.PreviewInvoice(ctx, customerID, remote.ID, &SubscriptionParams{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, 500, next.Amount)
+		assert.Equal(t, *remote.PeriodEnd, *next.PeriodStart)
+		if assert.Len(t, next.Lines, 1) {
+			assert.Equal(t, "bronze", next.Lines[0].Plan)
+		}
+	}
+	invoices, err := provider.ListInvoices(ctx, customerID, 10)
+	if assert.NoError(t, err) && assert.Len(t, invoices, 1) {
+		assert.Equal(t, 2000, invoices[0].Amount)
+	}
+}
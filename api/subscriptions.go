@@ -2,28 +2,79 @@ package api
 
 import (
 	"context"
+	"errors"
 	"net/http"
 
 	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/guregu/kami"
 	"github.com/netlify/gojoin/models"
+	"github.com/pborman/uuid"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/square/go-jose.v1/json"
 )
 
 type subscriptionRequest struct {
+	// StripeKey is only required for the first subscription of a user, for returning
+	// customers it replaces their payment method
 	StripeKey string `json:"stripe_key"`
 	Plan      string `json:"plan"`
+
+	// Quantity is the number of seats, new subscriptions start with 1 if it isn't
+	// set and updates keep the number they had
+	Quantity int `json:"quantity,omitempty"`
+
+	// Email is only used when an admin creates the first subscription for another user
+	Email string `json:"email,omitempty"`
+
+	// TrialPeriodDays shortens the trial of the plan from the config, only admins
+	// can give a longer one. It is only used for new subscriptions.
+	TrialPeriodDays int `json:"trial_period_days,omitempty"`
+
+	// Coupon is the id of a coupon, PromotionCode a code the customer typed in.
+	// Only one of them can be used.
+	Coupon        string `json:"coupon,omitempty"`
+	PromotionCode string `json:"promotion_code,omitempty"`
+
+	// Proration and ChangeAt only apply to plan changes. A change at the end of
+	// the period has nothing to prorate.
+	Proration string `json:"proration,omitempty"`
+	ChangeAt  string `json:"change_at,omitempty"`
+
+	// Items are the add-ons billed with the plan, like extra storage. Updates
+	// without them keep the add-ons the subscription has, an empty list removes
+	// them all.
+	Items []itemRequest `json:"items"`
+}
+
+// itemRequest is an add-on, it starts with a quantity of 1 if it isn't set
+type itemRequest struct {
+	Plan     string `json:"plan"`
+	Quantity int    `json:"quantity,omitempty"`
 }
 
+func (i itemRequest) Valid() error {
+	if i.Plan == "" {
+		return errors.New("Missing fields: plan")
+	}
+	if i.Quantity < 0 {
+		return errors.New("quantity can't be negative")
+	}
+	return nil
+}
+
+// When a plan change happens
+const (
+	changeNow         = "now"
+	changeAtPeriodEnd = "period_end"
+)
+
 func (s subscriptionRequest) Valid() error {
 	missing := []string{}
-	if s.StripeKey == "" {
-		missing = append(missing, "stripe_key")
-	}
 	if s.Plan == "" {
 		missing = append(missing, "plan")
 	}
@@ -31,13 +82,97 @@ func (s subscriptionRequest) Valid() error {
 	if len(missing) > 0 {
 		return fmt.Errorf("Missing fields: " + strings.Join(missing, ","))
 	}
+	if s.Quantity < 0 {
+		return errors.New("quantity can't be negative")
+	}
+	if s.TrialPeriodDays < 0 {
+		return errors.New("trial_period_days can't be negative")
+	}
+	if s.Coupon != "" && s.PromotionCode != "" {
+		return errors.New("Only one of coupon and promotion_code can be used")
+	}
+	switch s.Proration {
+	case "", ProrationNone, ProrationCreate, ProrationAlwaysInvoice:
+	default:
+		return fmt.Errorf("proration must be one of %s, %s or %s", ProrationNone, ProrationCreate, ProrationAlwaysInvoice)
+	}
+	switch s.ChangeAt {
+	case "", changeNow:
+	case changeAtPeriodEnd:
+		if s.StripeKey != "" || s.Coupon != "" || s.PromotionCode != "" || s.Items != nil {
+			return errors.New("stripe_key, coupon, promotion_code and items can't be used with a change at the end of the period")
+		}
+	default:
+		return fmt.Errorf("change_at must be %s or %s", changeNow, changeAtPeriodEnd)
+	}
+
+	plans := map[string]bool{s.Plan: true}
+	for _, item := range s.Items {
+		if err := item.Valid(); err != nil {
+			return fmt.Errorf("Invalid item: %v", err)
+		}
+		if plans[item.Plan] {
+			return fmt.Errorf("The plan %s can only be in the subscription once", item.Plan)
+		}
+		plans[item.Plan] = true
+	}
 
 	return nil
 }
 
+// subscriptionClaim is what ends up in the subscription_details of the token for
+// each subscription, next to the plan in subscriptions. The times are unix
+// timestamps like the other times in a JWT. Paused subscriptions don't grant
+// their plan, so it is left out with the add-ons.
+type subscriptionClaim struct {
+	Plan               string `json:"plan,omitempty"`
+	Quantity           int    `json:"quantity,omitempty"`
+	Status             string `json:"status,omitempty"`
+	CurrentPeriodStart int64  `json:"current_period_start,omitempty"`
+	CurrentPeriodEnd   int64  `json:"current_period_end,omitempty"`
+	CancelAt           int64  `json:"cancel_at,omitempty"`
+	TrialEnd           int64  `json:"trial_end,omitempty"`
+	ResumeAt           int64  `json:"resume_at,omitempty"`
+
+	// Items maps the plans of the add-ons to their quantity
+	Items map[string]int `json:"items,omitempty"`
+}
+
+func newSubscriptionClaim(sub *models.Subscription) subscriptionClaim {
+	if sub.Status == models.StatusPaused {
+		return subscriptionClaim{
+			Status:   sub.Status,
+			ResumeAt: unixTimestamp(sub.ResumeAt),
+		}
+	}
+	claim := subscriptionClaim{
+		Plan:               sub.Plan,
+		Quantity:           sub.Quantity,
+		Status:             sub.Status,
+		CurrentPeriodStart: unixTimestamp(sub.CurrentPeriodStart),
+		CurrentPeriodEnd:   unixTimestamp(sub.CurrentPeriodEnd),
+		CancelAt:           unixTimestamp(sub.CancelAt),
+		TrialEnd:           unixTimestamp(sub.TrialEnd),
+	}
+	if len(sub.Items) > 0 {
+		claim.Items = map[string]int{}
+		for _, item := range sub.Items {
+			claim.Items[item.Plan] = item.Quantity
+		}
+	}
+	return claim
+}
+
+func unixTimestamp(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.Unix()
+}
+
 type getAllResponse struct {
 	Subscriptions []models.Subscription `json:"subscriptions"`
-	Token         string                `json:"token"`
+	Token         string                `json:"token,omitempty"`
 }
 
 // listSubs will query stripe for all the subscriptions for a given user.
@@ -45,21 +180,13 @@ type getAllResponse struct {
 func listSubs(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	log := getLogger(ctx)
 	claims := getClaims(ctx)
-	db := getDB(ctx)
 
-	subs := []models.Subscription{}
-	if rsp := db.Where("user_id = ? ", claims.Subject).Find(&subs); rsp.Error != nil {
-		if rsp.RecordNotFound() {
-			notFoundError(w, "Found no records associated with user id %s", claims.Subject)
-		} else {
-			log.WithError(rsp.Error).Warnf("Failed to find records associated with %s", claims.Subject)
-			writeError(w, http.StatusInternalServerError, "DB error while searching for subscriptions")
-		}
+	subs, httpErr := findSubscriptions(ctx, claims.Subject)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
 		return
 	}
 
-	log.Debugf("Found %d subscriptions associated with id %s", len(subs), claims.Subject)
-
 	response := &getAllResponse{
 		Subscriptions: subs,
 	}
@@ -75,9 +202,14 @@ func listSubs(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	}
 	subsClaim := map[string]string{}
 	metadata["subscriptions"] = subsClaim
+	detailsClaim := map[string]subscriptionClaim{}
+	metadata["subscription_details"] = detailsClaim
 
 	for _, sub := range subs {
-		subsClaim[sub.Type] = sub.Plan
+		if sub.Status != models.StatusPaused {
+			subsClaim[sub.Type] = sub.Plan
+		}
+		detailsClaim[sub.Type] = newSubscriptionClaim(&sub)
 	}
 	claimsMap["app_metadata"] = app_metadata
 
@@ -93,12 +225,40 @@ func listSubs(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	sendJSON(w, http.StatusOK, response)
 }
 
+// adminListSubs lists the subscriptions of another user. Unlike listSubs
+// there is no token, the admin's token has nothing to do with that user.
+func adminListSubs(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	subs, httpErr := findSubscriptions(ctx, getTargetUser(ctx).ID)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, &getAllResponse{Subscriptions: subs})
+}
+
+func findSubscriptions(ctx context.Context, userID string) ([]models.Subscription, *HTTPError) {
+	log := getLogger(ctx)
+	subs := []models.Subscription{}
+	if rsp := forTenant(ctx, getDB(ctx), "tenant_id").Preload("Items").Where("user_id = ? ", userID).Find(&subs); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return nil, httpError(http.StatusNotFound, "Found no records associated with user id %s", userID)
+		}
+		log.WithError(rsp.Error).Warnf("Failed to find records associated with %s", userID)
+		return nil, httpError(http.StatusInternalServerError, "DB error while searching for subscriptions")
+	}
+
+	log.Debugf("Found %d subscriptions associated with id %s", len(subs), userID)
+	return subs, nil
+}
+
 func viewSub(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	subType := kami.Param(ctx, "type")
-	claims := getClaims(ctx)
-	sub, err := getSubscription(ctx, claims.Subject, subType)
+	user := getTargetUser(ctx)
+	sub, err := getSubscription(ctx, user.ID, subType)
 	if err != nil {
 		sendJSON(w, err.Code, err)
+		return
 	}
 	if sub == nil {
 		writeError(w, http.StatusNotFound, "No subscription found")
@@ -108,19 +268,43 @@ func viewSub(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	sendJSON(w, http.StatusOK, sub)
 }
 
+// deleteSub cancels a subscription right away, or at the end of the period with
+// at_period_end=true. The default for that comes from the config.
 func deleteSub(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	atPeriodEnd := getConfig(ctx).CancelAtPeriodEnd
+	if param := r.URL.Query().Get("at_period_end"); param != "" {
+		var err error
+		if atPeriodEnd, err = strconv.ParseBool(param); err != nil {
+			writeError(w, http.StatusBadRequest, "at_period_end must be true or false")
+			return
+		}
+	}
+
 	subType := kami.Param(ctx, "type")
-	claims := getClaims(ctx)
-	sub, err := getSubscription(ctx, claims.Subject, subType)
+	user := getTargetUser(ctx)
+	lock, httpErr := lockUser(ctx, user.ID)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	defer releaseUser(ctx, lock)
+
+	sub, err := getSubscription(ctx, user.ID, subType)
 	if err != nil {
 		sendJSON(w, err.Code, err)
+		return
+	}
+
+	if sub != nil && atPeriodEnd {
+		scheduleCancel(ctx, w, sub)
+		return
 	}
 
 	if sub != nil {
 		log := getLogger(ctx).WithField("type", subType)
 
 		pp := getPayerProxy(ctx)
-		err := pp.delete(sub.RemoteID)
+		err := pp.Delete(ctx, sub.RemoteID)
 		if err != nil {
 			writeError(w, http.StatusBadRequest, "Error communicating with stripe: %s", err)
 			return
@@ -135,11 +319,99 @@ func deleteSub(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 		}
 
 		log.Info("Removed subscription from db")
+		audit(ctx, models.AuditCancel, sub, "")
 	}
 
 	sendJSON(w, http.StatusAccepted, struct{}{})
 }
 
+// scheduleCancel cancels the subscription at the end of the period. The row is
+// kept with the cancel_at time, the webhook removes it when stripe cancels it.
+func scheduleCancel(ctx context.Context, w http.ResponseWriter, sub *models.Subscription) {
+	log := getLogger(ctx).WithFields(logrus.Fields{
+		"type":      sub.Type,
+		"remote_id": sub.RemoteID,
+	})
+	if sub.CancelAt != nil {
+		sendJSON(w, http.StatusOK, sub)
+		return
+	}
+
+	remote, err := getPayerProxy(ctx).CancelAtPeriodEnd(ctx, sub.RemoteID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error communicating with stripe: %s", err)
+		return
+	}
+	log.Info("Scheduled the cancellation in stripe")
+
+	old := *sub
+	remote.Apply(sub)
+	if rsp := getDB(ctx).Save(sub); rsp.Error != nil {
+		log.WithError(rsp.Error).Warnf("Error while saving subscription %+v", sub)
+		httpErr := compensateChange(ctx, old, sub, rsp.Error, func() error {
+			_, err := getPayerProxy(ctx).Reactivate(ctx, sub.RemoteID, sub.RemoteItemID)
+			return err
+		})
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
+	audit(ctx, models.AuditScheduleCancel, sub, "")
+	sendJSON(w, http.StatusOK, sub)
+}
+
+// reactivateSub undoes a cancellation at the end of the period
+func reactivateSub(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	subType := kami.Param(ctx, "type")
+	user := getTargetUser(ctx)
+	lock, httpErr := lockUser(ctx, user.ID)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	defer releaseUser(ctx, lock)
+
+	sub, httpErr := getSubscription(ctx, user.ID, subType)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	if sub == nil {
+		notFoundError(w, "No subscription found")
+		return
+	}
+	if sub.CancelAt == nil {
+		writeError(w, http.StatusBadRequest, "The subscription isn't scheduled to be canceled")
+		return
+	}
+
+	log := getLogger(ctx).WithFields(logrus.Fields{
+		"type":      subType,
+		"remote_id": sub.RemoteID,
+	})
+	remote, err := getPayerProxy(ctx).Reactivate(ctx, sub.RemoteID, sub.RemoteItemID)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Error communicating with stripe: %s", err)
+		return
+	}
+	log.Info("Reactivated subscription in stripe")
+
+	old := *sub
+	remote.Apply(sub)
+	if rsp := getDB(ctx).Save(sub); rsp.Error != nil {
+		log.WithError(rsp.Error).Warnf("Error while saving subscription %+v", sub)
+		httpErr := compensateChange(ctx, old, sub, rsp.Error, func() error {
+			_, err := getPayerProxy(ctx).CancelAtPeriodEnd(ctx, sub.RemoteID)
+			return err
+		})
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
+	audit(ctx, models.AuditReactivate, sub, "")
+	sendJSON(w, http.StatusOK, sub)
+}
+
 func createOrModSub(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	payload, httpErr := extractValidPayload(r)
 	if httpErr != nil {
@@ -148,15 +420,39 @@ func createOrModSub(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	}
 
 	subType := kami.Param(ctx, "type")
+	if httpErr := checkPlans(ctx, subType, payload); httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	if httpErr := checkTrial(ctx, subType, payload); httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
 	log := getLogger(ctx).WithFields(logrus.Fields{
-		"plan": payload.Plan,
-		"type": subType,
+		"plan":     payload.Plan,
+		"quantity": payload.Quantity,
+		"type":     subType,
 	})
 	ctx = setLogger(ctx, log)
 
+	// the discount is checked before anything is changed
+	discount, httpErr := findDiscount(ctx, payload)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
+	target := getTargetUser(ctx)
+	lock, httpErr := lockUser(ctx, target.ID)
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+	defer releaseUser(ctx, lock)
+
 	// do we have a subscription already?
-	claims := getClaims(ctx)
-	sub, httpErr := getSubscription(ctx, claims.Subject, subType)
+	sub, httpErr := getSubscription(ctx, target.ID, subType)
 	if httpErr != nil {
 		sendJSON(w, httpErr.Code, httpErr)
 		return
@@ -164,10 +460,10 @@ func createOrModSub(ctx context.Context, w http.ResponseWriter, r *http.Request)
 
 	if sub == nil {
 		log.Debug("Starting to create new subscription")
-		sub, httpErr = createSub(ctx, subType, payload)
+		sub, httpErr = createSub(ctx, subType, payload, discount)
 	} else {
 		log.WithField("old_plan", sub.Plan).Debug("Starting to update subscription")
-		httpErr = updateSub(ctx, sub, payload)
+		httpErr = updateSub(ctx, sub, payload, discount)
 	}
 
 	if httpErr != nil {
@@ -178,24 +474,79 @@ func createOrModSub(ctx context.Context, w http.ResponseWriter, r *http.Request)
 	sendJSON(w, http.StatusOK, sub)
 }
 
-func createSub(ctx context.Context, subType string, payload *subscriptionRequest) (*models.Subscription, *HTTPError) {
+// checkPlans makes sure the plan and the add-ons are in the catalog for the type
+func checkPlans(ctx context.Context, subType string, payload *subscriptionRequest) *HTTPError {
+	plans := getConfig(ctx).Plans
+	if !plans.Allows(subType, payload.Plan) {
+		return httpError(http.StatusBadRequest, "The plan %s isn't available for subscriptions of type %s", payload.Plan, subType)
+	}
+	for _, item := range payload.Items {
+		if !plans.Allows(subType, item.Plan) {
+			return httpError(http.StatusBadRequest, "The add-on %s isn't available for subscriptions of type %s", item.Plan, subType)
+		}
+	}
+	return nil
+}
+
+// checkTrial lets everyone ask for a trial up to the one of the plan, a longer
+// one can only be given by admins
+func checkTrial(ctx context.Context, subType string, payload *subscriptionRequest) *HTTPError {
+	max := getConfig(ctx).Plans[subType][payload.Plan].TrialPeriodDays
+	if payload.TrialPeriodDays > max && !isAdmin(ctx) {
+		return httpError(http.StatusForbidden, "The trial of plan %s can be at most %d days, only admins can give a longer one", payload.Plan, max)
+	}
+	return nil
+}
+
+func createSub(ctx context.Context, subType string, payload *subscriptionRequest, discount *Coupon) (*models.Subscription, *HTTPError) {
 	log := getLogger(ctx)
 	pp := getPayerProxy(ctx)
-	claims := getClaims(ctx)
+	target := getTargetUser(ctx)
 	db := getDB(ctx)
 
-	// do we have a user?
+	// a create we didn't hear back from might still land, another one could
+	// subscribe the user twice
+	pending, err := models.HasPendingWrite(db, getTenantID(ctx), target.ID, subType)
+	if err != nil {
+		log.WithError(err).Warn("Failed to check for pending writes")
+		return nil, httpError(http.StatusInternalServerError, "Error while checking for pending writes")
+	}
+	if pending {
+		return nil, httpError(http.StatusConflict, "A subscription of type %s is still being created", subType)
+	}
+
+	trialDays, httpErr := trialDays(ctx, subType, payload)
+	if httpErr != nil {
+		return nil, httpErr
+	}
+
+	// do we have a user? a new customer gets the token when it is created, a
+	// returning one with the subscription
+	token := payload.StripeKey
 	user := &models.User{
-		ID: claims.Subject,
+		ID:       target.ID,
+		TenantID: getTenantID(ctx),
 	}
 	if rsp := db.Where(user).Find(user); rsp.Error != nil {
 		if rsp.RecordNotFound() {
-			remoteID, err := pp.createCustomer(claims.Subject, claims.Email, payload.StripeKey)
+			email := target.Email
+			if email == "" {
+				email = payload.Email
+			}
+			if email == "" {
+				return nil, httpError(http.StatusBadRequest, "An email is required to create a new customer")
+			}
+			if payload.StripeKey == "" && trialDays == 0 {
+				return nil, httpError(http.StatusBadRequest, "A stripe_key is required to create a new customer")
+			}
+			token = ""
+
+			remoteID, err := pp.CreateCustomer(ctx, target.ID, email, payload.StripeKey, getIdempotencyKey(ctx))
 			if err != nil {
 				return nil, httpError(http.StatusInternalServerError, "Failed to create new customer in stripe")
 			}
 			user.RemoteID = remoteID
-			user.Email = claims.Email
+			user.Email = email
 
 			if rsp := db.Save(user); rsp.Error != nil {
 				log.WithError(rsp.Error).Warnf("Failed to save new user with remote ID %s", remoteID)
@@ -211,59 +562,231 @@ func createSub(ctx context.Context, subType string, payload *subscriptionRequest
 	}
 
 	// create the subscription
-	subRemoteID, err := pp.create(user.RemoteID, payload.Plan, payload.StripeKey)
-	if err != nil {
-		log.WithError(err).Info("Failed to create sub in stripe")
-		return nil, httpError(http.StatusBadRequest, "Failed create new subscription for plan %s", payload.Plan)
+	params := &SubscriptionParams{
+		Type:           subType,
+		Plan:           payload.Plan,
+		Token:          token,
+		TrialDays:      trialDays,
+		Quantity:       payload.Quantity,
+		Items:          requestedItems(payload),
+		IdempotencyKey: getIdempotencyKey(ctx),
+	}
+	if params.IdempotencyKey == "" {
+		// the key must be known to repeat the create if we don't hear back
+		params.IdempotencyKey = uuid.NewRandom().String()
 	}
+	setDiscount(params, discount)
 
 	sub := &models.Subscription{
-		RemoteID: subRemoteID,
 		UserID:   user.ID,
+		TenantID: user.TenantID,
 		Plan:     payload.Plan,
 		Type:     subType,
 	}
-
-	rsp := getDB(ctx).Create(sub)
-	if rsp.Error != nil {
-		log.WithError(rsp.Error).Warnf("Failed to create new subscription after successful stripe call: %+v", sub)
-		return nil, httpError(http.StatusInternalServerError, "Error while creating db entry, but stripe call was successful")
+	remote, err := pp.Create(ctx, user.RemoteID, params)
+	if err != nil {
+		if isTransient(err) {
+			return nil, unknownCreate(ctx, sub, &createCall{CustomerID: user.RemoteID, Params: params}, err)
+		}
+		log.WithError(err).Info("Failed to create sub in stripe")
+		return nil, httpError(http.StatusBadRequest, "Failed create new subscription for plan %s", payload.Plan)
+	}
+	remote.Apply(sub)
+	applyPromotionCode(sub, payload, discount)
+
+	if err := models.CreateSubscription(db, sub); err != nil {
+		log.WithError(err).Warnf("Failed to create new subscription after successful stripe call: %+v", sub)
+		httpErr := compensateCreate(ctx, sub, err)
+		if existing, _ := getSubscription(ctx, user.ID, subType); existing != nil {
+			httpErr.Code = http.StatusConflict
+			httpErr.Message = fmt.Sprintf("A subscription of type %s already exists", subType)
+		}
+		return nil, httpErr
 	}
 
+	audit(ctx, models.AuditCreate, sub, "")
 	return sub, nil
 }
 
-func updateSub(ctx context.Context, existing *models.Subscription, payload *subscriptionRequest) *HTTPError {
+// trialDays is the length of the trial for a new subscription. The trial of the
+// plan is only given once per type, so canceling and subscribing again doesn't
+// start another one. Only the trial an admin gives is always given.
+func trialDays(ctx context.Context, subType string, payload *subscriptionRequest) (int, *HTTPError) {
+	if payload.TrialPeriodDays > 0 && isAdmin(ctx) {
+		return payload.TrialPeriodDays, nil
+	}
+
+	days := getConfig(ctx).Plans[subType][payload.Plan].TrialPeriodDays
+	if days == 0 {
+		return 0, nil
+	}
+	if payload.TrialPeriodDays > 0 {
+		// checkTrial made sure it isn't longer than the plan's
+		days = payload.TrialPeriodDays
+	}
+
+	had, err := models.HadSubscription(getDB(ctx), getTenantID(ctx), getTargetUser(ctx).ID, subType)
+	if err != nil {
+		getLogger(ctx).WithError(err).Warn("Failed to check for earlier subscriptions")
+		return 0, httpError(http.StatusInternalServerError, "Error while checking for earlier subscriptions")
+	}
+	if had {
+		getLogger(ctx).Debug("Not starting a trial, the user had a subscription of this type before")
+		return 0, nil
+	}
+	return days, nil
+}
+
+func updateSub(ctx context.Context, existing *models.Subscription, payload *subscriptionRequest, discount *Coupon) *HTTPError {
+	if payload.ChangeAt == changeAtPeriodEnd {
+		return scheduleChange(ctx, existing, payload)
+	}
+
 	log := getLogger(ctx)
 	pp := getPayerProxy(ctx)
 
-	remoteID, err := pp.update(existing.RemoteID, payload.Plan, payload.StripeKey)
+	params := &SubscriptionParams{
+		Plan:      payload.Plan,
+		Token:     payload.StripeKey,
+		Quantity:  payload.Quantity,
+		Proration: payload.Proration,
+		Items:     requestedItems(payload),
+		ItemID:    existing.RemoteItemID,
+	}
+	setDiscount(params, discount)
+	remote, err := pp.Update(ctx, existing.RemoteID, params)
 	if err != nil {
 		log.WithError(err).Info("Failed to create sub in stripe")
 		return httpError(http.StatusBadRequest, "Failed updating subscription %s to plan %s", existing.RemoteID, payload.Plan)
 	}
 
-	existing.RemoteID = remoteID
+	old := *existing
+	// the items of the remote subscription are told apart by the new plan
 	existing.Plan = payload.Plan
+	remote.Apply(existing)
+	applyPromotionCode(existing, payload, discount)
+	// changing the plan now replaces whatever was scheduled
+	existing.ClearPendingChange()
 
-	rsp := getDB(ctx).Save(existing)
-	if rsp.Error != nil {
-		log.WithError(rsp.Error).Warnf("Failed to create new subscription after successful stripe call: %+v", existing)
-		return httpError(http.StatusInternalServerError, "Error while creating db entry, but stripe call was successful")
+	return saveUpdate(ctx, old, existing)
+}
+
+// saveUpdate stores the changes made with the payer together with the add-ons,
+// if that fails the subscription is reverted to old with the payer
+func saveUpdate(ctx context.Context, old models.Subscription, existing *models.Subscription) *HTTPError {
+	if err := models.SaveSubscription(getDB(ctx), existing); err != nil {
+		getLogger(ctx).WithError(err).Warnf("Failed to update subscription after successful stripe call: %+v", existing)
+		return compensateUpdate(ctx, old, existing, err)
 	}
 
+	audit(ctx, models.AuditUpdate, existing, old.Plan)
 	return nil
 }
 
+// requestedItems are the add-ons of the request for the payer, nil if it has none
+func requestedItems(payload *subscriptionRequest) []ItemParams {
+	if payload.Items == nil {
+		return nil
+	}
+	items := make([]ItemParams, len(payload.Items))
+	for i, item := range payload.Items {
+		items[i] = ItemParams{Plan: item.Plan, Quantity: item.Quantity}
+	}
+	return items
+}
+
+// itemParams are the add-ons a subscription has for the payer
+func itemParams(items []models.SubscriptionItem) []ItemParams {
+	params := make([]ItemParams, len(items))
+	for i, item := range items {
+		params[i] = ItemParams{Plan: item.Plan, Quantity: item.Quantity}
+	}
+	return params
+}
+
+// findDiscount looks up the coupon or promotion code of the request, it is nil
+// if there is none
+func findDiscount(ctx context.Context, payload *subscriptionRequest) (*Coupon, *HTTPError) {
+	if payload.Coupon == "" && payload.PromotionCode == "" {
+		return nil, nil
+	}
+
+	pp := getPayerProxy(ctx)
+	var discount *Coupon
+	var err error
+	code := payload.Coupon
+	if code != "" {
+		discount, err = pp.GetCoupon(ctx, code)
+	} else {
+		code = payload.PromotionCode
+		discount, err = pp.GetPromotionCode(ctx, code)
+	}
+
+	log := getLogger(ctx).WithField("coupon", code)
+	if err != nil {
+		if err == ErrCouponNotFound {
+			log.Info("Tried to use an unknown coupon")
+			return nil, httpError(http.StatusBadRequest, "No coupon found for %s", code)
+		}
+		log.WithError(err).Warn("Failed to look up coupon in stripe")
+		return nil, httpError(http.StatusInternalServerError, "Error communicating with stripe: %s", err)
+	}
+	if !discount.Valid {
+		log.Info("Tried to use a coupon that is no longer valid")
+		return nil, httpError(http.StatusBadRequest, "The coupon %s can't be redeemed anymore", code)
+	}
+	return discount, nil
+}
+
+func setDiscount(params *SubscriptionParams, discount *Coupon) {
+	if discount == nil {
+		return
+	}
+	if discount.PromotionCode != "" {
+		params.PromotionCode = discount.PromotionCode
+	} else {
+		params.Coupon = discount.ID
+	}
+}
+
+// applyPromotionCode remembers the code the customer typed in, the provider only
+// tells us about the coupon behind it
+func applyPromotionCode(sub *models.Subscription, payload *subscriptionRequest, discount *Coupon) {
+	if discount != nil && discount.PromotionCode != "" && sub.Coupon == discount.ID {
+		sub.PromotionCode = payload.PromotionCode
+	}
+}
+
+// lockUser makes sure only one request at a time changes the subscriptions of a user
+func lockUser(ctx context.Context, userID string) (*models.UserLock, *HTTPError) {
+	lock, err := models.TryLockUser(getDB(ctx), getTenantID(ctx), userID)
+	if err != nil {
+		if err == models.ErrLocked {
+			getLogger(ctx).Info("Subscriptions are already being changed by another request")
+			return nil, httpError(http.StatusConflict, "Another change to the subscriptions of user %s is in progress", userID)
+		}
+		getLogger(ctx).WithError(err).Warn("Failed to lock user")
+		return nil, httpError(http.StatusInternalServerError, "Error while locking the user")
+	}
+	return lock, nil
+}
+
+func releaseUser(ctx context.Context, lock *models.UserLock) {
+	if err := lock.Release(); err != nil {
+		getLogger(ctx).WithError(err).Warn("Failed to release user lock")
+	}
+}
+
 func getSubscription(ctx context.Context, userID string, planType string) (*models.Subscription, *HTTPError) {
 	log := getLogger(ctx).WithField("type", planType)
 	db := getDB(ctx)
 	sub := &models.Subscription{
-		Type:   planType,
-		UserID: userID,
+		Type:     planType,
+		UserID:   userID,
+		TenantID: getTenantID(ctx),
 	}
 
-	if rsp := db.Where(sub).First(sub); rsp.Error != nil {
+	if rsp := db.Preload("Items").Where(sub).First(sub); rsp.Error != nil {
 
 		if rsp.RecordNotFound() {
 			log.Debug("Didn't find record")
@@ -1,12 +1,15 @@
 package api
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"io/ioutil"
 
 	"net/http"
 
+	"github.com/netlify/gojoin/conf"
 	"github.com/netlify/gojoin/models"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/assert"
@@ -55,6 +58,12 @@ func TestQueryForAllSubsAsUser(t *testing.T) {
 		}
 		assert.Equal(t, "nonsense", subsMap["membership"])
 		assert.Equal(t, "more-nonsense", subsMap["revenue"])
+
+		details, _ := meta["subscription_details"].(map[string]interface{})
+		membership, _ := details["membership"].(map[string]interface{})
+		assert.Equal(t, "nonsense", membership["plan"])
+		assert.Equal(t, models.StatusActive, membership["status"])
+		assert.NotEmpty(t, membership["current_period_end"])
 	}
 }
 
@@ -125,6 +134,7 @@ func TestCreateNewSubscription(t *testing.T) {
 		UserID:   testUserID,
 		Plan:     "super-important",
 		RemoteID: "remote-id",
+		Status:   models.StatusActive,
 	}
 	expectedUser := models.User{
 		ID:       testUserID,
@@ -138,9 +148,48 @@ func TestCreateNewSubscription(t *testing.T) {
 	assert.Len(t, tp.createCalls, 1)
 	call := tp.createCalls[0]
 	assert.Equal(t, "super-important", call.plan)
-	assert.Equal(t, "something", call.token)
+	assert.Equal(t, "membership", call.subType)
+	// the token was already used for the new customer
+	assert.Empty(t, call.token)
 	assert.Equal(t, "remote-user-id", call.userID)
 	assert.Empty(t, tp.updateCalls)
+	if assert.Len(t, tp.createCustomerCalls, 1) {
+		assert.Equal(t, "something", tp.createCustomerCalls[0].token)
+	}
+}
+
+func TestCreateSubscriptionForReturningCustomer(t *testing.T) {
+	tp := &testProxy{createSubID: "remote-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	defer cleanup(tu)
+
+	payload := &subscriptionRequest{
+		StripeKey: "new-card",
+		Plan:      "gold",
+	}
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "PUT", "/subscriptions/membership", payload, false), sub)
+	defer cleanup(sub)
+
+	if assert.Len(t, tp.createCalls, 1) {
+		assert.Equal(t, "stripe-given-value", tp.createCalls[0].userID)
+		assert.Equal(t, "new-card", tp.createCalls[0].token)
+	}
+	assert.Empty(t, tp.createCustomerCalls)
+}
+
+func TestCreateSubscriptionForNewCustomerNeedsToken(t *testing.T) {
+	tp := &testProxy{createSubID: "remote-id", createCustomerID: "remote-user-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	payload := &subscriptionRequest{Plan: "gold"}
+	extractError(t, http.StatusBadRequest, request(t, "PUT", "/subscriptions/membership", payload, false))
+	assert.Empty(t, tp.createCustomerCalls)
+	assert.Empty(t, tp.createCalls)
 }
 
 func TestModifySubscription(t *testing.T) {
@@ -162,6 +211,7 @@ func TestModifySubscription(t *testing.T) {
 		UserID:   testUserID,
 		Plan:     "charizard",
 		RemoteID: "remote-id",
+		Status:   models.StatusActive,
 	}
 	expectedUser := &models.User{
 		ID:       testUserID,
@@ -206,6 +256,75 @@ func TestCreateNewSubscriptionWithStripeError(t *testing.T) {
 	extractError(t, fasthttp.StatusBadRequest, rsp)
 }
 
+func TestCreateSubscriptionWhileLocked(t *testing.T) {
+	tp := &testProxy{createSubID: "remote-id", createCustomerID: "remote-user-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	lock, err := models.TryLockUser(db, "", testUserID)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	payload := &subscriptionRequest{
+		StripeKey: "something",
+		Plan:      "super-important",
+	}
+	rsp := request(t, "PUT", "/subscriptions/membership", payload, false)
+	extractError(t, http.StatusConflict, rsp)
+	assert.Empty(t, tp.createCalls)
+	assert.Empty(t, tp.createCustomerCalls)
+
+	rsp = request(t, "DELETE", "/subscriptions/membership", nil, false)
+	extractError(t, http.StatusConflict, rsp)
+
+	assert.NoError(t, lock.Release())
+	lock, err = models.TryLockUser(db, "", testUserID)
+	if assert.NoError(t, err) {
+		assert.NoError(t, lock.Release())
+	}
+}
+
+func TestOneSubscriptionPerType(t *testing.T) {
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "nonsense")
+	defer cleanup(s1, tu)
+
+	dup := &models.Subscription{
+		UserID:   testUserID,
+		Plan:     "other",
+		Type:     "membership",
+		RemoteID: "dup-remote-id",
+	}
+	if !assert.Error(t, db.Create(dup).Error) {
+		cleanup(dup)
+	}
+}
+
+func TestResubscribeAfterCancel(t *testing.T) {
+	tp := &testProxy{createSubID: "new-remote-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "nonsense")
+	defer cleanup(s1, tu)
+
+	rsp := request(t, "DELETE", "/subscriptions/membership", nil, false)
+	assert.Equal(t, http.StatusAccepted, rsp.StatusCode)
+
+	payload := &subscriptionRequest{
+		StripeKey: "something",
+		Plan:      "super-important",
+	}
+	rsp = request(t, "PUT", "/subscriptions/membership", payload, false)
+	sub := new(models.Subscription)
+	extractPayload(t, rsp, sub)
+	defer cleanup(sub)
+
+	assert.Equal(t, "new-remote-id", sub.RemoteID)
+	assert.Len(t, tp.createCalls, 1)
+}
+
 // ------------------------------------------------------------------------------------------------
 // helpers
 // ------------------------------------------------------------------------------------------------
@@ -216,6 +335,7 @@ func validateSub(t *testing.T, expected *models.Subscription, actual *models.Sub
 	assert.Equal(t, expected.Type, actual.Type)
 	assert.Equal(t, expected.RemoteID, actual.RemoteID)
 	assert.Equal(t, expected.Plan, actual.Plan)
+	assert.Equal(t, expected.Status, actual.Status)
 
 	assert.NotEmpty(t, actual.ID)
 	assert.NotEmpty(t, actual.UserID)
@@ -235,11 +355,15 @@ func createUser(userID, email, remoteID string) *models.User {
 }
 
 func createSubscription(userID, planType string, plan string) *models.Subscription {
+	end := time.Now().AddDate(0, 1, 0)
 	sub := &models.Subscription{
-		UserID:   userID,
-		Plan:     plan,
-		Type:     planType,
-		RemoteID: uuid.NewRandom().String(),
+		UserID:           userID,
+		Plan:             plan,
+		Type:             planType,
+		Quantity:         1,
+		RemoteID:         uuid.NewRandom().String(),
+		Status:           models.StatusActive,
+		CurrentPeriodEnd: &end,
 	}
 
 	db.Create(sub)
@@ -255,17 +379,59 @@ func cleanup(todelete ...interface{}) {
 type testProxy struct {
 	createSubID string
 	createCalls []struct {
-		userID string
-		plan   string
-		token  string
+		userID         string
+		subType        string
+		plan           string
+		token          string
+		idempotencyKey string
+		trialDays      int
+		quantity       int
+		coupon         string
+		promotionCode  string
+		items          []ItemParams
 	}
 	updateSubID string
 	updateCalls []struct {
-		subID string
-		plan  string
-		token string
+		subID         string
+		plan          string
+		token         string
+		quantity      int
+		coupon        string
+		promotionCode string
+		proration     string
+		removeCoupon  bool
+		items         []ItemParams
+		itemID        string
 	}
 	deleteCalls []string
+	deleteErr   error
+
+	cancelAtEndCalls []string
+	reactivateCalls  []string
+	pauseCalls       []*time.Time
+	resumeCalls      []string
+
+	paymentMethodCalls []struct {
+		customerID string
+		token      string
+	}
+	paymentMethodErr error
+	paymentMethods   []*PaymentMethod
+
+	// coupons are found by their id, promotionCodes by the code
+	coupons        map[string]*Coupon
+	promotionCodes map[string]*Coupon
+
+	// invoices are kept by the customer they belong to
+	invoices     map[string][]*Invoice
+	invoiceCalls []int
+
+	preview      *Invoice
+	previewCalls []struct {
+		customerID string
+		subID      string
+		params     SubscriptionParams
+	}
 
 	createCustomerID    string
 	createCustomerCalls []struct {
@@ -275,7 +441,7 @@ type testProxy struct {
 	}
 }
 
-func (tp *testProxy) createCustomer(userID, email, payToken string) (string, error) {
+func (tp *testProxy) CreateCustomer(ctx context.Context, userID, email, payToken, idempotencyKey string) (string, error) {
 	tp.createCustomerCalls = append(tp.createCustomerCalls, struct {
 		userID string
 		email  string
@@ -284,27 +450,207 @@ func (tp *testProxy) createCustomer(userID, email, payToken string) (string, err
 	return tp.createCustomerID, nil
 }
 
-func (tp *testProxy) delete(subID string) error {
-	tp.deleteCalls = append(tp.deleteCalls, subID)
+func (tp *testProxy) UpdatePaymentMethod(ctx context.Context, customerID, token, idempotencyKey string) error {
+	tp.paymentMethodCalls = append(tp.paymentMethodCalls, struct {
+		customerID string
+		token      string
+	}{customerID, token})
+	return tp.paymentMethodErr
+}
+
+func (tp *testProxy) ListPaymentMethods(ctx context.Context, customerID string) ([]*PaymentMethod, error) {
+	return tp.paymentMethods, nil
+}
+
+func (tp *testProxy) AddPaymentMethod(ctx context.Context, customerID, token, idempotencyKey string) (*PaymentMethod, error) {
+	method := &PaymentMethod{ID: "card_" + token, Brand: "Visa", Last4: "4242", Default: len(tp.paymentMethods) == 0}
+	tp.paymentMethods = append(tp.paymentMethods, method)
+	return method, nil
+}
+
+func (tp *testProxy) DeletePaymentMethod(ctx context.Context, customerID, methodID string) error {
+	for i, m := range tp.paymentMethods {
+		if m.ID == methodID {
+			tp.paymentMethods = append(tp.paymentMethods[:i], tp.paymentMethods[i+1:]...)
+			return nil
+		}
+	}
+	return ErrPaymentMethodNotFound
+}
+
+func (tp *testProxy) SetDefaultPaymentMethod(ctx context.Context, customerID, methodID string) error {
+	found := false
+	for _, m := range tp.paymentMethods {
+		found = found || m.ID == methodID
+	}
+	if !found {
+		return ErrPaymentMethodNotFound
+	}
+	for _, m := range tp.paymentMethods {
+		m.Default = m.ID == methodID
+	}
 	return nil
 }
 
-func (tp *testProxy) create(userID, plan, token string) (string, error) {
+func (tp *testProxy) Delete(ctx context.Context, subID string) error {
+	tp.deleteCalls = append(tp.deleteCalls, subID)
+	return tp.deleteErr
+}
+
+func (tp *testProxy) CancelAtPeriodEnd(ctx context.Context, subID string) (*RemoteSubscription, error) {
+	tp.cancelAtEndCalls = append(tp.cancelAtEndCalls, subID)
+	remote := testRemoteSub(subID)
+	remote.CancelAt = remote.PeriodEnd
+	return remote, nil
+}
+
+func (tp *testProxy) Reactivate(ctx context.Context, subID, itemID string) (*RemoteSubscription, error) {
+	tp.reactivateCalls = append(tp.reactivateCalls, subID)
+	return testRemoteSub(subID), nil
+}
+
+func (tp *testProxy) Pause(ctx context.Context, subID string, resumeAt *time.Time) (*RemoteSubscription, error) {
+	tp.pauseCalls = append(tp.pauseCalls, resumeAt)
+	remote := testRemoteSub(subID)
+	remote.Status = models.StatusPaused
+	remote.ResumeAt = resumeAt
+	return remote, nil
+}
+
+func (tp *testProxy) Resume(ctx context.Context, subID string) (*RemoteSubscription, error) {
+	tp.resumeCalls = append(tp.resumeCalls, subID)
+	return testRemoteSub(subID), nil
+}
+
+func (tp *testProxy) Create(ctx context.Context, userID string, p *SubscriptionParams) (*RemoteSubscription, error) {
 	tp.createCalls = append(tp.createCalls, struct {
-		userID string
-		plan   string
-		token  string
-	}{userID, plan, token})
-	return tp.createSubID, nil
+		userID         string
+		subType        string
+		plan           string
+		token          string
+		idempotencyKey string
+		trialDays      int
+		quantity       int
+		coupon         string
+		promotionCode  string
+		items          []ItemParams
+	}{userID, p.Type, p.Plan, p.Token, p.IdempotencyKey, p.TrialDays, p.Quantity, p.Coupon, p.PromotionCode, p.Items})
+	remote := testRemoteSub(tp.createSubID)
+	if p.Quantity > 0 {
+		remote.Quantity = p.Quantity
+	}
+	remote.Items = testRemoteItems(p, remote.Quantity)
+	remote.Coupon = tp.appliedCoupon(p)
+	if p.TrialDays > 0 {
+		trialEnd := remote.PeriodStart.AddDate(0, 0, p.TrialDays)
+		remote.Status = models.StatusTrialing
+		remote.TrialEnd = &trialEnd
+	}
+	return remote, nil
 }
 
-func (tp *testProxy) update(subID, plan, token string) (string, error) {
+func (tp *testProxy) Update(ctx context.Context, subID string, p *SubscriptionParams) (*RemoteSubscription, error) {
 	tp.updateCalls = append(tp.updateCalls, struct {
-		subID string
-		plan  string
-		token string
-	}{subID, plan, token})
-	return tp.updateSubID, nil
+		subID         string
+		plan          string
+		token         string
+		quantity      int
+		coupon        string
+		promotionCode string
+		proration     string
+		removeCoupon  bool
+		items         []ItemParams
+		itemID        string
+	}{subID, p.Plan, p.Token, p.Quantity, p.Coupon, p.PromotionCode, p.Proration, p.RemoveCoupon, p.Items, p.ItemID})
+	remote := testRemoteSub(tp.updateSubID)
+	if p.Quantity > 0 {
+		remote.Quantity = p.Quantity
+	}
+	if p.Items != nil {
+		remote.Items = testRemoteItems(p, remote.Quantity)
+	}
+	remote.Coupon = tp.appliedCoupon(p)
+	return remote, nil
+}
+
+func (tp *testProxy) GetCoupon(ctx context.Context, id string) (*Coupon, error) {
+	if c, ok := tp.coupons[id]; ok {
+		return c, nil
+	}
+	return nil, ErrCouponNotFound
+}
+
+func (tp *testProxy) GetPromotionCode(ctx context.Context, code string) (*Coupon, error) {
+	if c, ok := tp.promotionCodes[code]; ok {
+		return c, nil
+	}
+	return nil, ErrCouponNotFound
+}
+
+func (tp *testProxy) ListInvoices(ctx context.Context, customerID string, limit int) ([]*Invoice, error) {
+	tp.invoiceCalls = append(tp.invoiceCalls, limit)
+	invoices := tp.invoices[customerID]
+	if len(invoices) > limit {
+		invoices = invoices[:limit]
+	}
+	return invoices, nil
+}
+
+func (tp *testProxy) GetInvoice(ctx context.Context, customerID, id string) (*Invoice, error) {
+	for _, inv := range tp.invoices[customerID] {
+		if inv.ID == id {
+			return inv, nil
+		}
+	}
+	return nil, ErrInvoiceNotFound
+}
+
+func (tp *testProxy) PreviewInvoice(ctx context.Context, customerID, subID string, p *SubscriptionParams) (*Invoice, error) {
+	tp.previewCalls = append(tp.previewCalls, struct {
+		customerID string
+		subID      string
+		params     SubscriptionParams
+	}{customerID, subID, *p})
+	return tp.preview, nil
+}
+
+func (tp *testProxy) appliedCoupon(p *SubscriptionParams) string {
+	for _, c := range tp.promotionCodes {
+		if p.PromotionCode != "" && c.PromotionCode == p.PromotionCode {
+			return c.ID
+		}
+	}
+	return p.Coupon
+}
+
+// testRemoteItems has an item for the plan and one for each add-on, the ids of
+// new items are made up from the plans
+func testRemoteItems(p *SubscriptionParams, quantity int) []RemoteItem {
+	planItemID := p.ItemID
+	if planItemID == "" {
+		planItemID = "si-" + p.Plan
+	}
+	items := []RemoteItem{{ID: planItemID, Plan: p.Plan, Quantity: quantity}}
+	for _, item := range p.Items {
+		added := RemoteItem{ID: "si-" + item.Plan, Plan: item.Plan, Quantity: item.Quantity}
+		if added.Quantity == 0 {
+			added.Quantity = 1
+		}
+		items = append(items, added)
+	}
+	return items
+}
+
+func testRemoteSub(id string) *RemoteSubscription {
+	start := time.Now().UTC().Truncate(time.Second)
+	end := start.AddDate(0, 1, 0)
+	return &RemoteSubscription{
+		ID:          id,
+		Status:      models.StatusActive,
+		Quantity:    1,
+		PeriodStart: &start,
+		PeriodEnd:   &end,
+	}
 }
 
 func validateResponseAndDBVal(t *testing.T, rsp *http.Response, expected *models.Subscription, expectedUser *models.User) (*models.Subscription, *models.User) {
@@ -339,3 +685,215 @@ func validateResponseAndDBVal(t *testing.T, rsp *http.Response, expected *models
 
 	return dbSub, dbUser
 }
+
+func TestCreateSubscriptionWithPlanTrial(t *testing.T) {
+	clearAuditLog()
+	config.Plans = conf.PlansConfig{"membership": {"gold": {TrialPeriodDays: 14}}}
+	defer func() { config.Plans = nil }()
+	tp := &testProxy{createSubID: "remote-id", createCustomerID: "remote-user-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	// a trial doesn't need a payment method
+	payload := &subscriptionRequest{Plan: "gold"}
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "PUT", "/subscriptions/membership", payload, false), sub)
+	assert.Equal(t, models.StatusTrialing, sub.Status)
+	assert.NotNil(t, sub.TrialEnd)
+	if assert.Len(t, tp.createCalls, 1) {
+		assert.Equal(t, 14, tp.createCalls[0].trialDays)
+	}
+	if assert.Len(t, tp.createCustomerCalls, 1) {
+		assert.Empty(t, tp.createCustomerCalls[0].token)
+	}
+
+	// subscribing again after canceling doesn't start another trial, even
+	// without the audit log
+	rsp := request(t, "DELETE", "/subscriptions/membership", nil, false)
+	assert.Equal(t, http.StatusAccepted, rsp.StatusCode)
+	clearAuditLog()
+	payload.StripeKey = "something"
+	extractPayload(t, request(t, "PUT", "/subscriptions/membership", payload, false), sub)
+	defer cleanup(sub, &models.User{ID: testUserID})
+	if assert.Len(t, tp.createCalls, 2) {
+		assert.Equal(t, 0, tp.createCalls[1].trialDays)
+	}
+}
+
+func TestOnlyAdminsGiveLongerTrials(t *testing.T) {
+	config.Plans = conf.PlansConfig{"membership": {"gold": {TrialPeriodDays: 14}}}
+	defer func() { config.Plans = nil }()
+	tp := &testProxy{createSubID: "remote-id", createCustomerID: "remote-user-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	payload := &subscriptionRequest{Plan: "gold", TrialPeriodDays: 30}
+	extractError(t, http.StatusForbidden, request(t, "PUT", "/subscriptions/membership", payload, false))
+	assert.Empty(t, tp.createCalls)
+
+	// a shorter trial than the plan's is fine
+	payload.TrialPeriodDays = 7
+	mine := new(models.Subscription)
+	extractPayload(t, request(t, "PUT", "/subscriptions/membership", payload, false), mine)
+	defer cleanup(mine, &models.User{ID: testUserID})
+	if assert.Len(t, tp.createCalls, 1) {
+		assert.Equal(t, 7, tp.createCalls[0].trialDays)
+	}
+	payload.TrialPeriodDays = 30
+
+	payload.Email = "bruce@dc.com"
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "PUT", "/admin/users/batman/subscriptions/membership", payload, true), sub)
+	defer cleanup(sub, &models.User{ID: "batman"})
+	assert.Equal(t, models.StatusTrialing, sub.Status)
+	if assert.Len(t, tp.createCalls, 2) {
+		assert.Equal(t, 30, tp.createCalls[1].trialDays)
+	}
+}
+
+func TestSubscriptionQuantity(t *testing.T) {
+	tp := &testProxy{createSubID: "remote-id", createCustomerID: "remote-user-id", updateSubID: "remote-id"}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	payload := &subscriptionRequest{StripeKey: "something", Plan: "team", Quantity: -1}
+	extractError(t, http.StatusBadRequest, request(t, "PUT", "/subscriptions/seats", payload, false))
+	assert.Empty(t, tp.createCalls)
+
+	payload.Quantity = 5
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "PUT", "/subscriptions/seats", payload, false), sub)
+	defer cleanup(sub, &models.User{ID: testUserID})
+	assert.Equal(t, 5, sub.Quantity)
+	if assert.Len(t, tp.createCalls, 1) {
+		assert.Equal(t, 5, tp.createCalls[0].quantity)
+	}
+
+	// leaving it out keeps the seats
+	payload = &subscriptionRequest{Plan: "team-plus"}
+	extractPayload(t, request(t, "PUT", "/subscriptions/seats", payload, false), sub)
+	if assert.Len(t, tp.updateCalls, 1) {
+		assert.Equal(t, 0, tp.updateCalls[0].quantity)
+	}
+
+	payload.Quantity = 8
+	extractPayload(t, request(t, "PUT", "/subscriptions/seats", payload, false), sub)
+	assert.Equal(t, 8, sub.Quantity)
+
+	body := new(getAllResponse)
+	extractPayload(t, request(t, "GET", "/subscriptions", nil, false), body)
+	claims := decodeToken(t, body.Token, config.JWTSecret)
+	if assert.NotNil(t, claims) {
+		meta, _ := claims["app_metadata"].(map[string]interface{})
+		details, _ := meta["subscription_details"].(map[string]interface{})
+		seats, _ := details["seats"].(map[string]interface{})
+		assert.Equal(t, float64(8), seats["quantity"])
+	}
+}
+
+func TestCancelAtPeriodEnd(t *testing.T) {
+	clearAuditLog()
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "nonsense")
+	defer cleanup(s1, tu)
+
+	extractError(t, http.StatusBadRequest, request(t, "DELETE", "/subscriptions/membership?at_period_end=nope", nil, false))
+	extractError(t, http.StatusBadRequest, request(t, "POST", "/subscriptions/membership/reactivate", nil, false))
+
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "DELETE", "/subscriptions/membership?at_period_end=true", nil, false), sub)
+	assert.NotNil(t, sub.CancelAt)
+	assert.Empty(t, tp.deleteCalls)
+	assert.Equal(t, []string{s1.RemoteID}, tp.cancelAtEndCalls)
+
+	// the subscription is kept until the end of the period
+	stored, _ := getSubscriptionForTest(testUserID, "membership")
+	if assert.NotNil(t, stored) {
+		assert.NotNil(t, stored.CancelAt)
+		assert.Equal(t, models.StatusActive, stored.Status)
+	}
+
+	sub = new(models.Subscription)
+	extractPayload(t, request(t, "POST", "/subscriptions/membership/reactivate", nil, false), sub)
+	assert.Nil(t, sub.CancelAt)
+	assert.Equal(t, []string{s1.RemoteID}, tp.reactivateCalls)
+
+	entries := []models.AuditLogEntry{}
+	db.Order("created_at asc").Find(&entries)
+	if assert.Len(t, entries, 2) {
+		assert.Equal(t, models.AuditScheduleCancel, entries[0].Action)
+		assert.Equal(t, models.AuditReactivate, entries[1].Action)
+	}
+}
+
+func TestCancelAtPeriodEndByDefault(t *testing.T) {
+	config.CancelAtPeriodEnd = true
+	defer func() { config.CancelAtPeriodEnd = false }()
+	tp := &testProxy{}
+	api.payerProxy = tp
+	defer func() { api.payerProxy = &errorProxy{} }()
+
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "nonsense")
+	defer cleanup(s1, tu)
+
+	sub := new(models.Subscription)
+	extractPayload(t, request(t, "DELETE", "/subscriptions/membership", nil, false), sub)
+	assert.NotNil(t, sub.CancelAt)
+	assert.Len(t, tp.cancelAtEndCalls, 1)
+
+	// it can still be canceled right away
+	rsp := request(t, "DELETE", "/subscriptions/membership?at_period_end=false", nil, false)
+	assert.Equal(t, http.StatusAccepted, rsp.StatusCode)
+	assert.Len(t, tp.deleteCalls, 1)
+}
+
+func TestMigrationRemovesDuplicateCanceledSubscriptions(t *testing.T) {
+	// tables from before the unique index can have a canceled subscription next to a new one
+	if !assert.NoError(t, db.Exec("DROP INDEX idx_subscriptions_user_type").Error) {
+		return
+	}
+	first := createSubscription(testUserID, "membership", "basic")
+	db.Delete(first)
+	second := createSubscription(testUserID, "membership", "basic")
+	db.Delete(second)
+	live := createSubscription(testUserID, "membership", "pro")
+	other := createSubscription(testUserID, "support", "basic")
+	db.Delete(other)
+	defer cleanup(first, second, live, other)
+
+	if !assert.NoError(t, models.AutoMigrate(db)) {
+		return
+	}
+
+	subs := []models.Subscription{}
+	db.Unscoped().Where("user_id = ?", testUserID).Order("type").Find(&subs)
+	if assert.Len(t, subs, 2) {
+		assert.Equal(t, live.ID, subs[0].ID)
+		assert.Equal(t, other.ID, subs[1].ID)
+	}
+	assert.True(t, db.Dialect().HasIndex(models.Subscription{}.TableName(), "idx_subscriptions_user_type"))
+}
+
+func TestMigrationFillsInMissingTenants(t *testing.T) {
+	s1 := createSubscription(testUserID, "membership", "basic")
+	defer cleanup(s1)
+	db.Delete(s1)
+	// rows from before the tenant_id column had a default
+	table := models.Subscription{}.TableName()
+	if !assert.NoError(t, db.Exec("UPDATE "+table+" SET tenant_id = NULL WHERE id = ?", s1.ID).Error) {
+		return
+	}
+
+	if !assert.NoError(t, models.AutoMigrate(db)) {
+		return
+	}
+
+	had, err := models.HadSubscription(db, "", testUserID, "membership")
+	assert.NoError(t, err)
+	assert.True(t, had)
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gojoin/conf"
+	"github.com/netlify/gojoin/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// the tenants table is read again once the copy is this old
+	tenantReloadInterval = time.Minute
+	// or this old when a tenant isn't found, so new ones show up quickly
+	tenantMissInterval = 5 * time.Second
+)
+
+// tenant is a site served by a multi-tenant API, its requests run with its
+// config and payer
+type tenant struct {
+	id       string
+	settings conf.TenantConfig
+	config   *conf.Config
+	proxy    PayerProxy
+}
+
+// tenantRegistry has the tenants of the config and the tenants table
+type tenantRegistry struct {
+	sync.Mutex
+	log    *logrus.Entry
+	config *conf.Config
+	db     *gorm.DB
+
+	byID     map[string]*tenant
+	byHost   map[string]*tenant
+	loadedAt time.Time
+}
+
+func newTenantRegistry(config *conf.Config, db *gorm.DB) *tenantRegistry {
+	return &tenantRegistry{
+		log:    logrus.WithField("component", "tenants"),
+		config: config,
+		db:     db,
+		byID:   map[string]*tenant{},
+		byHost: map[string]*tenant{},
+	}
+}
+
+// find returns the tenant with the id, it is nil if there is none
+func (tr *tenantRegistry) find(id string) (*tenant, error) {
+	return tr.lookup(func() *tenant { return tr.byID[id] })
+}
+
+// findHost returns the tenant with the host, it is nil if there is none
+func (tr *tenantRegistry) findHost(host string) (*tenant, error) {
+	host = strings.ToLower(host)
+	return tr.lookup(func() *tenant { return tr.byHost[host] })
+}
+
+func (tr *tenantRegistry) lookup(get func() *tenant) (*tenant, error) {
+	tr.Lock()
+	defer tr.Unlock()
+
+	if time.Since(tr.loadedAt) > tenantReloadInterval {
+		if err := tr.load(); err != nil {
+			return nil, err
+		}
+	}
+	t := get()
+	if t == nil && time.Since(tr.loadedAt) > tenantMissInterval {
+		if err := tr.load(); err != nil {
+			return nil, err
+		}
+		t = get()
+	}
+	return t, nil
+}
+
+// load reads the tenants table, the tenants in the config win over the ones
+// with the same id in the table. Tenants that didn't change keep their payer.
+func (tr *tenantRegistry) load() error {
+	settings := map[string]conf.TenantConfig{}
+	stored := []models.Tenant{}
+	if rsp := tr.db.Find(&stored); rsp.Error != nil {
+		return rsp.Error
+	}
+	for _, t := range stored {
+		c, err := t.TenantConfig()
+		if err != nil {
+			tr.log.WithError(err).Warnf("Skipping tenant %s", t.ID)
+			continue
+		}
+		settings[t.ID] = c
+	}
+	for id, c := range tr.config.Tenants {
+		settings[id] = c
+	}
+
+	byID := map[string]*tenant{}
+	byHost := map[string]*tenant{}
+	for id, c := range settings {
+		log := tr.log.WithField("tenant", id)
+		if c.JWTSecret == "" {
+			log.Warn("Skipping tenant without a jwt_secret")
+			continue
+		}
+
+		t := tr.byID[id]
+		if t == nil || !reflect.DeepEqual(t.settings, c) {
+			config := tr.config.ForTenant(c)
+			proxy, err := NewProvider(config, tr.db)
+			if err != nil {
+				log.WithError(err).Warn("Skipping tenant, failed to configure its payment provider")
+				continue
+			}
+			t = &tenant{
+				id:       id,
+				settings: c,
+				config:   config,
+				proxy:    withRetries(proxy, config.ProviderCalls),
+			}
+		}
+
+		byID[id] = t
+		for _, host := range c.Hosts {
+			byHost[strings.ToLower(host)] = t
+		}
+	}
+
+	tr.byID = byID
+	tr.byHost = byHost
+	tr.loadedAt = time.Now()
+	return nil
+}
+
+// requestTenant finds the tenant named in the tenant header, or else the one
+// with the host of the request. It is nil if there is neither.
+func (a *API) requestTenant(r *http.Request) (*tenant, *HTTPError) {
+	if id := r.Header.Get(a.config.TenantHeader); id != "" {
+		t, err := a.tenants.find(id)
+		if err != nil {
+			return nil, httpError(http.StatusInternalServerError, "Failed to load the tenants")
+		}
+		if t == nil {
+			return nil, httpError(http.StatusBadRequest, "Unknown tenant %s", id)
+		}
+		return t, nil
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	t, err := a.tenants.findHost(host)
+	if err != nil {
+		return nil, httpError(http.StatusInternalServerError, "Failed to load the tenants")
+	}
+	return t, nil
+}
+
+// requireTenant is the multi-tenant part of the middleware for requests without
+// a JWT, the tenant must be in the header or the host
+func (a *API) requireTenant(ctx context.Context, w http.ResponseWriter, r *http.Request) context.Context {
+	if !a.config.MultiTenant {
+		return ctx
+	}
+	t, httpErr := a.requestTenant(r)
+	if httpErr == nil && t == nil {
+		httpErr = httpError(http.StatusBadRequest, "Must name the tenant with the %s header or the host", a.config.TenantHeader)
+	}
+	if httpErr != nil {
+		getLogger(ctx).Info(httpErr.Message)
+		sendJSON(w, httpErr.Code, httpErr)
+		return nil
+	}
+	return useTenant(ctx, t)
+}
+
+// tenantContext is the context for work on the rows of a tenant outside of a
+// request, like the scheduled changes
+func (a *API) tenantContext(ctx context.Context, tenantID string) (context.Context, error) {
+	if !a.config.MultiTenant {
+		return ctx, nil
+	}
+	t, err := a.tenants.find(tenantID)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, fmt.Errorf("Unknown tenant %s", tenantID)
+	}
+	return useTenant(ctx, t), nil
+}
+
+// useTenant makes the request run with the config and payer of the tenant
+func useTenant(ctx context.Context, t *tenant) context.Context {
+	ctx = setTenantID(ctx, t.id)
+	ctx = setConfig(ctx, t.config)
+	ctx = setPayerProxy(ctx, t.proxy)
+	return setLogger(ctx, getLogger(ctx).WithField("tenant", t.id))
+}
+
+// forTenant limits a query to the rows of the tenant of the request, the column
+// can have its table in front for joins. Nothing is limited with a single tenant.
+func forTenant(ctx context.Context, query *gorm.DB, column string) *gorm.DB {
+	if id := getTenantID(ctx); id != "" {
+		return query.Where(column+" = ?", id)
+	}
+	return query
+}
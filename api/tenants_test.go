@@ -0,0 +1,205 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/netlify/gojoin/conf"
+	"github.com/netlify/gojoin/models"
+)
+
+const tenantHeader = "X-GoJoin-Tenant"
+
+// tenantServer runs an API with two tenants in the config and one in the db,
+// all of them bill with the fake provider
+func tenantServer(t *testing.T) (*httptest.Server, func()) {
+	mt := *config
+	mt.Provider = fakeProvider
+	mt.MultiTenant = true
+	mt.TenantHeader = tenantHeader
+	mt.Tenants = map[string]conf.TenantConfig{
+		"site-a": {
+			Hosts:     []string{"a.example.com"},
+			JWTSecret: "secret-a",
+			Plans:     conf.PlansConfig{"membership": {"gold": {Name: "Gold", Price: 1000}}},
+		},
+		"site-b": {
+			Hosts:          []string{"b.example.com"},
+			JWTSecret:      "secret-b",
+			AdminGroupName: "staff",
+		},
+	}
+	stored := &models.Tenant{
+		ID:        "site-c",
+		JWTSecret: "secret-c",
+		Plans:     `{"membership": {"silver": {"name": "Silver", "price": 500}}}`,
+	}
+	if !assert.NoError(t, db.Create(stored).Error) {
+		t.FailNow()
+	}
+
+	server := httptest.NewServer(NewAPI(&mt, db, nil, "test").handler)
+	return server, func() {
+		server.Close()
+		db.Delete(models.Tenant{})
+		db.Delete(models.FakeCustomer{})
+		db.Delete(models.FakeSubscription{})
+		db.Delete(models.FakeInvoice{})
+		db.Delete(models.FakeInvoiceLine{})
+	}
+}
+
+func tenantToken(t *testing.T, sub, secret, aud string, groups ...string) string {
+	claims := &JWTClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject:   sub,
+			Audience:  aud,
+			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		},
+		Email:  sub + "@example.com",
+		Groups: groups,
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return token
+}
+
+// tenantRequest makes a request to the server, the Host header sets the host
+func tenantRequest(t *testing.T, server *httptest.Server, method, path string, body interface{}, token string, headers map[string]string) *http.Response {
+	buf := new(bytes.Buffer)
+	if body != nil {
+		if !assert.NoError(t, json.NewEncoder(buf).Encode(body)) {
+			t.FailNow()
+		}
+	}
+	r, _ := http.NewRequest(method, server.URL+path, buf)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	for k, v := range headers {
+		if k == "Host" {
+			r.Host = v
+		} else {
+			r.Header.Set(k, v)
+		}
+	}
+	rsp, err := client.Do(r)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	return rsp
+}
+
+func TestFindTenant(t *testing.T) {
+	server, done := tenantServer(t)
+	defer done()
+
+	// the endpoints without a token need the header or the host
+	extractError(t, http.StatusBadRequest, tenantRequest(t, server, "GET", "/plans", nil, "", nil))
+	extractError(t, http.StatusBadRequest, tenantRequest(t, server, "GET", "/plans", nil, "", map[string]string{tenantHeader: "nope"}))
+	extractError(t, http.StatusBadRequest, tenantRequest(t, server, "POST", "/webhooks/stripe", nil, "", nil))
+
+	catalog := map[string][]planResponse{}
+	extractPayload(t, tenantRequest(t, server, "GET", "/plans", nil, "", map[string]string{tenantHeader: "site-a"}), &catalog)
+	if assert.Len(t, catalog["membership"], 1) {
+		assert.Equal(t, "gold", catalog["membership"][0].ID)
+	}
+	catalog = map[string][]planResponse{}
+	extractPayload(t, tenantRequest(t, server, "GET", "/plans", nil, "", map[string]string{"Host": "B.example.com:8080"}), &catalog)
+	assert.Empty(t, catalog)
+	catalog = map[string][]planResponse{}
+	extractPayload(t, tenantRequest(t, server, "GET", "/plans", nil, "", map[string]string{tenantHeader: "site-c"}), &catalog)
+	if assert.Len(t, catalog["membership"], 1) {
+		assert.Equal(t, "silver", catalog["membership"][0].ID)
+	}
+
+	// the token must be signed with the secret of the tenant
+	tokenA := tenantToken(t, "alfred", "secret-a", "")
+	extractPayload(t, tenantRequest(t, server, "GET", "/subscriptions", nil, tokenA, map[string]string{"Host": "a.example.com"}), new(getAllResponse))
+	extractError(t, http.StatusUnauthorized, tenantRequest(t, server, "GET", "/subscriptions", nil, tokenA, map[string]string{tenantHeader: "site-b"}))
+
+	// without header or host the aud names it
+	extractError(t, http.StatusUnauthorized, tenantRequest(t, server, "GET", "/subscriptions", nil, tokenA, nil))
+	tokenC := tenantToken(t, "alfred", "secret-c", "site-c")
+	extractPayload(t, tenantRequest(t, server, "GET", "/subscriptions", nil, tokenC, nil), new(getAllResponse))
+	extractError(t, http.StatusUnauthorized, tenantRequest(t, server, "GET", "/subscriptions", nil, tenantToken(t, "alfred", "secret-a", "site-c"), nil))
+}
+
+func TestTenantsAreSeparate(t *testing.T) {
+	server, done := tenantServer(t)
+	defer done()
+	clearAuditLog()
+	defer clearAuditLog()
+
+	siteA := map[string]string{tenantHeader: "site-a"}
+	siteB := map[string]string{tenantHeader: "site-b"}
+	userA := tenantToken(t, "alfred", "secret-a", "")
+	adminA := tenantToken(t, "bruce", "secret-a", "", "admin")
+	adminB := tenantToken(t, "selina", "secret-b", "", "staff")
+
+	// the plans are the tenant's
+	extractError(t, http.StatusBadRequest, tenantRequest(t, server, "PUT", "/subscriptions/membership", &subscriptionRequest{Plan: "silver", StripeKey: "tok_visa"}, userA, siteA))
+
+	sub := new(models.Subscription)
+	extractPayload(t, tenantRequest(t, server, "PUT", "/subscriptions/membership", &subscriptionRequest{Plan: "gold", StripeKey: "tok_visa"}, userA, siteA), sub)
+	defer cleanup(&models.Subscription{ID: sub.ID}, &models.User{ID: "alfred"})
+	assert.Equal(t, "site-a", sub.TenantID)
+
+	user := new(models.User)
+	if assert.NoError(t, db.Where("tenant_id = ? AND id = ?", "site-a", "alfred").First(user).Error) {
+		assert.Equal(t, "site-a", user.TenantID)
+	}
+
+	subs := []models.Subscription{}
+	extractPayload(t, tenantRequest(t, server, "GET", "/admin/subscriptions", nil, adminA, siteA), &subs)
+	assert.Len(t, subs, 1)
+	entries := []models.AuditLogEntry{}
+	extractPayload(t, tenantRequest(t, server, "GET", "/admin/audit_log", nil, adminA, siteA), &entries)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "site-a", entries[0].TenantID)
+	}
+
+	// the admins of other tenants don't see them
+	extractError(t, http.StatusForbidden, tenantRequest(t, server, "GET", "/admin/subscriptions", nil, tenantToken(t, "selina", "secret-b", "", "admin"), siteB))
+	extractPayload(t, tenantRequest(t, server, "GET", "/admin/subscriptions", nil, adminB, siteB), &subs)
+	assert.Empty(t, subs)
+	extractPayload(t, tenantRequest(t, server, "GET", "/admin/audit_log", nil, adminB, siteB), &entries)
+	assert.Empty(t, entries)
+	extractError(t, http.StatusNotFound, tenantRequest(t, server, "GET", "/admin/users/alfred/subscriptions/membership", nil, adminB, siteB))
+
+	// the same id is another user on another site
+	other := new(models.Subscription)
+	payload := &subscriptionRequest{Plan: "gold", StripeKey: "tok_visa", Email: "alfred@b.example.com"}
+	extractPayload(t, tenantRequest(t, server, "PUT", "/admin/users/alfred/subscriptions/membership", payload, adminB, siteB), other)
+	defer cleanup(&models.Subscription{ID: other.ID})
+	assert.Equal(t, "site-b", other.TenantID)
+	assert.NotEqual(t, sub.ID, other.ID)
+
+	users := []models.User{}
+	db.Where("id = ?", "alfred").Order("tenant_id").Find(&users)
+	if assert.Len(t, users, 2) {
+		assert.Equal(t, "alfred@example.com", users[0].Email)
+		assert.Equal(t, "alfred@b.example.com", users[1].Email)
+		assert.NotEqual(t, users[0].RemoteID, users[1].RemoteID)
+	}
+	// and the admins see their own user with it
+	extractPayload(t, tenantRequest(t, server, "GET", "/admin/subscriptions", nil, adminB, siteB), &subs)
+	if assert.Len(t, subs, 1) && assert.NotNil(t, subs[0].User) {
+		assert.Equal(t, "site-b", subs[0].User.TenantID)
+		assert.Equal(t, "alfred@b.example.com", subs[0].User.Email)
+	}
+	mine := getAllResponse{}
+	extractPayload(t, tenantRequest(t, server, "GET", "/subscriptions", nil, userA, siteA), &mine)
+	if assert.Len(t, mine.Subscriptions, 1) {
+		assert.Equal(t, sub.ID, mine.Subscriptions[0].ID)
+	}
+}
@@ -0,0 +1,364 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netlify/gojoin/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	stripeSignatureHeader = "Stripe-Signature"
+
+	// how old a signed webhook can be before we refuse it, this protects against replays
+	webhookTolerance = 5 * time.Minute
+
+	maxWebhookBodySize = 1 << 20
+)
+
+// stripeEvent is the subset of a stripe event we care about. The object is
+// decoded depending on the type of event.
+type stripeEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+type stripeSubscriptionObject struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Quantity int    `json:"quantity"`
+	Plan     *struct {
+		ID string `json:"id"`
+	} `json:"plan"`
+	PeriodStart int64 `json:"current_period_start"`
+	PeriodEnd   int64 `json:"current_period_end"`
+	EndCancel   bool  `json:"cancel_at_period_end"`
+	TrialEnd    int64 `json:"trial_end"`
+	// PauseCollection is set while the billing is paused
+	PauseCollection *struct {
+		ResumesAt int64 `json:"resumes_at"`
+	} `json:"pause_collection"`
+	Discount *struct {
+		Coupon *struct {
+			ID string `json:"id"`
+		} `json:"coupon"`
+		End int64 `json:"end"`
+	} `json:"discount"`
+	// Items has the plan and the add-ons, the plan above is only set if there
+	// is a single item
+	Items *struct {
+		Data []struct {
+			ID   string `json:"id"`
+			Plan *struct {
+				ID string `json:"id"`
+			} `json:"plan"`
+			Quantity int `json:"quantity"`
+		} `json:"data"`
+	} `json:"items"`
+}
+
+// plan is the plan of the subscription, with add-ons it is the one of the item
+// we know as the plan's
+func (o *stripeSubscriptionObject) plan(sub *models.Subscription) string {
+	if o.Plan != nil {
+		return o.Plan.ID
+	}
+	if o.Items != nil {
+		for _, item := range o.Items.Data {
+			if item.ID == sub.RemoteItemID && item.Plan != nil {
+				return item.Plan.ID
+			}
+		}
+	}
+	return ""
+}
+
+func (o *stripeSubscriptionObject) remote() *RemoteSubscription {
+	remote := &RemoteSubscription{
+		ID:          o.ID,
+		Status:      o.Status,
+		Quantity:    o.Quantity,
+		PeriodStart: UnixTime(o.PeriodStart),
+		PeriodEnd:   UnixTime(o.PeriodEnd),
+		TrialEnd:    UnixTime(o.TrialEnd),
+	}
+	if o.EndCancel {
+		remote.CancelAt = remote.PeriodEnd
+	}
+	if o.PauseCollection != nil && o.Status == models.StatusActive {
+		remote.Status = models.StatusPaused
+		remote.ResumeAt = UnixTime(o.PauseCollection.ResumesAt)
+	}
+	if o.Discount != nil && o.Discount.Coupon != nil {
+		remote.Coupon = o.Discount.Coupon.ID
+		remote.DiscountEnd = UnixTime(o.Discount.End)
+	}
+	if o.Items != nil {
+		remote.Items = []RemoteItem{}
+		for _, item := range o.Items.Data {
+			if item.Plan == nil {
+				continue
+			}
+			remote.Items = append(remote.Items, RemoteItem{ID: item.ID, Plan: item.Plan.ID, Quantity: item.Quantity})
+		}
+	}
+	return remote
+}
+
+type stripeInvoiceObject struct {
+	ID           string `json:"id"`
+	Subscription string `json:"subscription"`
+}
+
+// stripeWebhook receives events from stripe and applies them to the subscriptions
+// we have stored. This keeps us in sync with changes made outside of gojoin, e.g. in
+// the stripe dashboard.
+func stripeWebhook(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	log := getLogger(ctx)
+	config := getConfig(ctx)
+
+	if config.StripeWebhookSecret == "" {
+		log.Warn("Received a stripe webhook, but no webhook secret is configured")
+		writeError(w, http.StatusInternalServerError, "Stripe webhooks are not configured")
+		return
+	}
+
+	defer r.Body.Close()
+	payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Failed to read webhook payload")
+		return
+	}
+
+	if err := verifyStripeSignature(payload, r.Header.Get(stripeSignatureHeader), config.StripeWebhookSecret, time.Now()); err != nil {
+		log.WithError(err).Info("Invalid stripe webhook signature")
+		writeError(w, http.StatusBadRequest, "Invalid signature: %s", err)
+		return
+	}
+
+	event := new(stripeEvent)
+	if err := json.Unmarshal(payload, event); err != nil {
+		writeError(w, http.StatusBadRequest, "failed to decode payload: "+err.Error())
+		return
+	}
+
+	log = log.WithFields(logrus.Fields{
+		"event_id":   event.ID,
+		"event_type": event.Type,
+	})
+	ctx = setLogger(ctx, log)
+
+	var httpErr *HTTPError
+	switch event.Type {
+	case "customer.subscription.updated":
+		httpErr = handleSubscriptionUpdated(ctx, event)
+	case "customer.subscription.deleted":
+		httpErr = handleSubscriptionDeleted(ctx, event)
+	case "invoice.payment_failed":
+		httpErr = handlePaymentFailed(ctx, event)
+	default:
+		log.Debug("Ignoring unhandled event type")
+	}
+
+	if httpErr != nil {
+		sendJSON(w, httpErr.Code, httpErr)
+		return
+	}
+
+	sendJSON(w, http.StatusOK, struct{}{})
+}
+
+func handleSubscriptionUpdated(ctx context.Context, event *stripeEvent) *HTTPError {
+	log := getLogger(ctx)
+	obj := new(stripeSubscriptionObject)
+	if err := json.Unmarshal(event.Data.Object, obj); err != nil {
+		return httpError(http.StatusBadRequest, "failed to decode subscription: "+err.Error())
+	}
+
+	sub, httpErr := getSubscriptionByRemoteID(ctx, obj.ID)
+	if httpErr != nil || sub == nil {
+		return httpErr
+	}
+
+	old := *sub
+	if plan := obj.plan(sub); plan != "" && plan != sub.Plan {
+		log.WithFields(logrus.Fields{
+			"old_plan": sub.Plan,
+			"plan":     plan,
+		}).Info("Updating subscription plan from stripe")
+		sub.Plan = plan
+		if sub.HasPendingChange() {
+			log.WithField("pending_plan", sub.PendingPlan).Info("Dropping scheduled plan change, the plan was changed in stripe")
+			sub.ClearPendingChange()
+		}
+	}
+	obj.remote().Apply(sub)
+
+	log.WithField("status", sub.Status).Debug("Updating subscription from stripe")
+	// stripe sends the event again if we fail, nothing is stored until then
+	if err := models.SaveSubscription(getDB(ctx), sub); err != nil {
+		log.WithError(err).Warnf("Failed to update subscription %+v", sub)
+		return httpError(http.StatusInternalServerError, "Error while updating subscription")
+	}
+
+	if old.Plan != sub.Plan || old.Status != sub.Status {
+		auditAs(ctx, stripeActor, models.AuditUpdate, sub, old.Plan)
+	}
+
+	// a new period started before we applied the scheduled plan change, it is
+	// late but shouldn't wait for the next check
+	if sub.HasPendingChange() && sub.CurrentPeriodStart != nil && !sub.CurrentPeriodStart.Before(*sub.PendingChangeAt) {
+		if err := applyScheduledChange(ctx, sub); err != nil {
+			log.WithError(err).Warn("Failed to apply scheduled plan change, it will be retried")
+		}
+	}
+	return nil
+}
+
+func handleSubscriptionDeleted(ctx context.Context, event *stripeEvent) *HTTPError {
+	log := getLogger(ctx)
+	obj := new(stripeSubscriptionObject)
+	if err := json.Unmarshal(event.Data.Object, obj); err != nil {
+		return httpError(http.StatusBadRequest, "failed to decode subscription: "+err.Error())
+	}
+
+	sub, httpErr := getSubscriptionByRemoteID(ctx, obj.ID)
+	if httpErr != nil || sub == nil {
+		return httpErr
+	}
+
+	if rsp := getDB(ctx).Delete(sub); rsp.Error != nil {
+		log.WithError(rsp.Error).Warnf("Error while deleting subscription %+v", sub)
+		return httpError(http.StatusInternalServerError, "Error while deleting subscription")
+	}
+
+	log.Info("Removed subscription canceled in stripe from db")
+	auditAs(ctx, stripeActor, models.AuditCancel, sub, "")
+	return nil
+}
+
+func handlePaymentFailed(ctx context.Context, event *stripeEvent) *HTTPError {
+	obj := new(stripeInvoiceObject)
+	if err := json.Unmarshal(event.Data.Object, obj); err != nil {
+		return httpError(http.StatusBadRequest, "failed to decode invoice: "+err.Error())
+	}
+
+	if obj.Subscription == "" {
+		getLogger(ctx).Debug("Invoice isn't associated with a subscription")
+		return nil
+	}
+
+	sub, httpErr := getSubscriptionByRemoteID(ctx, obj.Subscription)
+	if httpErr != nil || sub == nil {
+		return httpErr
+	}
+
+	log := getLogger(ctx).WithFields(logrus.Fields{
+		"invoice_id": obj.ID,
+		"user_id":    sub.UserID,
+		"type":       sub.Type,
+	})
+	log.Warn("Payment failed for subscription")
+
+	if sub.Status == models.StatusPastDue {
+		return nil
+	}
+
+	sub.Status = models.StatusPastDue
+	if rsp := getDB(ctx).Save(sub); rsp.Error != nil {
+		log.WithError(rsp.Error).Warnf("Failed to update subscription %+v", sub)
+		return httpError(http.StatusInternalServerError, "Error while updating subscription")
+	}
+	auditAs(ctx, stripeActor, models.AuditUpdate, sub, sub.Plan)
+	return nil
+}
+
+// getSubscriptionByRemoteID returns nil if there is no matching subscription. Events
+// for subscriptions that were not created through gojoin are expected.
+func getSubscriptionByRemoteID(ctx context.Context, remoteID string) (*models.Subscription, *HTTPError) {
+	log := getLogger(ctx).WithField("remote_id", remoteID)
+	sub := new(models.Subscription)
+	if rsp := forTenant(ctx, getDB(ctx), "tenant_id").Preload("Items").Where("remote_id = ?", remoteID).First(sub); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			log.Debug("No subscription found for remote id")
+			return nil, nil
+		}
+		log.WithError(rsp.Error).Warn("Error while searching for subscription")
+		return nil, httpError(http.StatusInternalServerError, "Error while searching for subscription %s", remoteID)
+	}
+
+	return sub, nil
+}
+
+// verifyStripeSignature checks the header stripe sends along with every webhook.
+// It looks like: t=1492774577,v1=5257a869e7ec...,v0=6ffbb59b2300...
+// The v1 signature is a HMAC-SHA256 of "<t>.<payload>" using the endpoint's secret.
+func verifyStripeSignature(payload []byte, header, secret string, now time.Time) error {
+	if header == "" {
+		return errors.New("missing signature header")
+	}
+
+	var timestamp string
+	signatures := [][]byte{}
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			timestamp = kv[1]
+		case "v1":
+			sig, err := hex.DecodeString(kv[1])
+			if err != nil {
+				continue
+			}
+			signatures = append(signatures, sig)
+		}
+	}
+
+	if timestamp == "" {
+		return errors.New("no timestamp in signature header")
+	}
+	if len(signatures) == 0 {
+		return errors.New("no v1 signature in signature header")
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp in signature header")
+	}
+	if diff := now.Sub(time.Unix(ts, 0)); diff > webhookTolerance || diff < -webhookTolerance {
+		return errors.New("timestamp is outside of the tolerance zone")
+	}
+
+	expected := computeStripeSignature(payload, timestamp, secret)
+	for _, sig := range signatures {
+		if hmac.Equal(expected, sig) {
+			return nil
+		}
+	}
+
+	return errors.New("no matching signature found")
+}
+
+func computeStripeSignature(payload []byte, timestamp, secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
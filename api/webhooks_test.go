@@ -0,0 +1,107 @@
+package api
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/netlify/gojoin/models"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookUpdatesPlan(t *testing.T) {
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "bronze")
+	defer cleanup(s1, tu)
+
+	body := fmt.Sprintf(`{"id": "evt_1", "type": "customer.subscription.updated", "data": {"object": {"id": "%s", "status": "active", "plan": {"id": "gold"}}}}`, s1.RemoteID)
+	rsp := webhookRequest(t, body, time.Now(), config.StripeWebhookSecret)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	found := &models.Subscription{ID: s1.ID}
+	if assert.NoError(t, db.Find(found).Error) {
+		assert.Equal(t, "gold", found.Plan)
+	}
+}
+
+func TestWebhookUpdatesStatus(t *testing.T) {
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "bronze")
+	defer cleanup(s1, tu)
+
+	end := time.Now().Add(time.Hour).Unix()
+	body := fmt.Sprintf(`{"id": "evt_5", "type": "customer.subscription.updated", "data": {"object": {"id": "%s", "status": "trialing", "plan": {"id": "bronze"}, "current_period_end": %d, "trial_end": %d, "cancel_at_period_end": true}}}`, s1.RemoteID, end, end)
+	rsp := webhookRequest(t, body, time.Now(), config.StripeWebhookSecret)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	found := &models.Subscription{ID: s1.ID}
+	if assert.NoError(t, db.Find(found).Error) {
+		assert.Equal(t, models.StatusTrialing, found.Status)
+		if assert.NotNil(t, found.TrialEnd) && assert.NotNil(t, found.CancelAt) {
+			assert.Equal(t, end, found.TrialEnd.Unix())
+			assert.Equal(t, end, found.CancelAt.Unix())
+		}
+	}
+
+	body = fmt.Sprintf(`{"id": "evt_6", "type": "invoice.payment_failed", "data": {"object": {"id": "in_1", "subscription": "%s"}}}`, s1.RemoteID)
+	rsp = webhookRequest(t, body, time.Now(), config.StripeWebhookSecret)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	found = &models.Subscription{ID: s1.ID}
+	if assert.NoError(t, db.Find(found).Error) {
+		assert.Equal(t, models.StatusPastDue, found.Status)
+	}
+}
+
+func TestWebhookDeletesSubscription(t *testing.T) {
+	tu := createUser(testUserID, testUserEmail, "stripe-given-value")
+	s1 := createSubscription(testUserID, "membership", "bronze")
+	defer cleanup(s1, tu)
+
+	body := fmt.Sprintf(`{"id": "evt_2", "type": "customer.subscription.deleted", "data": {"object": {"id": "%s", "status": "canceled"}}}`, s1.RemoteID)
+	rsp := webhookRequest(t, body, time.Now(), config.StripeWebhookSecret)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+
+	found := &models.Subscription{ID: s1.ID}
+	if assert.NoError(t, db.Unscoped().Find(found).Error) {
+		assert.NotNil(t, found.DeletedAt)
+	}
+}
+
+func TestWebhookUnknownSubscription(t *testing.T) {
+	body := `{"id": "evt_3", "type": "customer.subscription.deleted", "data": {"object": {"id": "sub_unknown"}}}`
+	rsp := webhookRequest(t, body, time.Now(), config.StripeWebhookSecret)
+	assert.Equal(t, http.StatusOK, rsp.StatusCode)
+}
+
+func TestWebhookBadSignature(t *testing.T) {
+	body := `{"id": "evt_4", "type": "customer.subscription.deleted", "data": {"object": {"id": "sub_unknown"}}}`
+	rsp := webhookRequest(t, body, time.Now(), "not-the-secret")
+	extractError(t, http.StatusBadRequest, rsp)
+
+	rsp = webhookRequest(t, body, time.Now().Add(-time.Hour), config.StripeWebhookSecret)
+	extractError(t, http.StatusBadRequest, rsp)
+
+	r, _ := http.NewRequest("POST", serverURL+"/webhooks/stripe", bytes.NewBufferString(body))
+	rsp, err := client.Do(r)
+	if assert.NoError(t, err) {
+		extractError(t, http.StatusBadRequest, rsp)
+	}
+}
+
+func webhookRequest(t *testing.T, body string, ts time.Time, secret string) *http.Response {
+	timestamp := fmt.Sprintf("%d", ts.Unix())
+	sig := hex.EncodeToString(computeStripeSignature([]byte(body), timestamp, secret))
+
+	r, _ := http.NewRequest("POST", serverURL+"/webhooks/stripe", bytes.NewBufferString(body))
+	r.Header.Set(stripeSignatureHeader, fmt.Sprintf("t=%s,v1=%s", timestamp, sig))
+
+	rsp, err := client.Do(r)
+	if !assert.NoError(t, err) {
+		assert.FailNow(t, "failed to make request: "+r.URL.String())
+	}
+	return rsp
+}
@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/netlify/gojoin/conf"
+	"github.com/netlify/gojoin/models"
+	"github.com/spf13/cobra"
+)
+
+var auditCmd = cobra.Command{
+	Run:   showAudit,
+	Use:   "audit",
+	Short: "Show the most recent changes to subscriptions",
+}
+
+func showAudit(cmd *cobra.Command, args []string) {
+	config, err := conf.LoadConfig(cmd)
+	if err != nil {
+		log.Fatal("Failed to load config: " + err.Error())
+	}
+
+	db, err := models.Connect(&config.DBConfig)
+	if err != nil {
+		log.Fatal("Failed to connect to db: " + err.Error())
+	}
+
+	flags := cmd.Flags()
+	limit, err := flags.GetInt("limit")
+	if err != nil {
+		log.Fatal("Failed to read limit flag: " + err.Error())
+	}
+
+	query := db.Order("created_at desc").Limit(limit)
+	filters := map[string]string{
+		"user":   "target_user_id",
+		"actor":  "actor",
+		"type":   "type",
+		"tenant": "tenant_id",
+	}
+	for flag, column := range filters {
+		v, err := flags.GetString(flag)
+		if err != nil {
+			log.Fatalf("Failed to read %s flag: %v", flag, err)
+		}
+		if v != "" {
+			query = query.Where(column+" = ?", v)
+		}
+	}
+
+	entries := []models.AuditLogEntry{}
+	if rsp := query.Find(&entries); rsp.Error != nil {
+		log.Fatal("Failed to query the audit log: " + rsp.Error.Error())
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tACTOR\tACTION\tUSER\tTYPE\tOLD PLAN\tNEW PLAN\tREMOTE ID\tREQUEST ID")
+	for _, e := range entries {
+		actor := e.Actor
+		if e.Admin {
+			actor += " (admin)"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			e.CreatedAt.Format(time.RFC3339), actor, e.Action, e.TargetUserID, e.Type,
+			e.OldPlan, e.NewPlan, e.RemoteID, e.RequestID)
+	}
+	w.Flush()
+}
@@ -9,7 +9,6 @@ import (
 	"github.com/netlify/gojoin/conf"
 	"github.com/netlify/gojoin/models"
 	"github.com/spf13/cobra"
-	"github.com/stripe/stripe-go"
 )
 
 var rootCmd = cobra.Command{
@@ -21,7 +20,16 @@ func RootCommand() *cobra.Command {
 	rootCmd.PersistentFlags().StringP("config", "c", "", "the config file to use")
 	rootCmd.Flags().IntP("port", "p", 0, "the port to use")
 
-	rootCmd.AddCommand(&versionCmd)
+	syncCmd.Flags().Bool("repair", false, "update the db to match stripe instead of only reporting differences")
+	syncCmd.Flags().String("tenant", "", "the tenant to sync, required in multi-tenant mode")
+
+	auditCmd.Flags().String("user", "", "only show changes to this user's subscriptions")
+	auditCmd.Flags().String("actor", "", "only show changes made by this actor")
+	auditCmd.Flags().String("type", "", "only show changes to this subscription type")
+	auditCmd.Flags().String("tenant", "", "only show changes of this tenant")
+	auditCmd.Flags().Int("limit", 50, "the maximum number of entries to show")
+
+	rootCmd.AddCommand(&versionCmd, &syncCmd, &auditCmd)
 
 	return &rootCmd
 }
@@ -43,11 +51,20 @@ func run(cmd *cobra.Command, args []string) {
 		logger.Fatal("Failed to connect to db: " + err.Error())
 	}
 
-	logger.Info("Configuring stripe access")
-	stripe.Key = config.StripeKey
+	var provider api.PayerProxy
+	if config.MultiTenant {
+		// every tenant gets its own, with its own stripe key
+		logger.Infof("Serving multiple tenants with %s as payment provider", providerName(config))
+	} else {
+		logger.Infof("Configuring %s as payment provider", providerName(config))
+		provider, err = api.NewProvider(config, db)
+		if err != nil {
+			logger.Fatal("Failed to configure payment provider: " + err.Error())
+		}
+	}
 
 	logger.Infof("Starting API on port %d", config.Port)
-	a := api.NewAPI(config, db, &api.StripeProxy{}, Version)
+	a := api.NewAPI(config, db, provider, Version)
 	err = a.Serve()
 	if err != nil {
 		logger.WithError(err).Error("Error while running API: %v", err)
@@ -55,3 +72,10 @@ func run(cmd *cobra.Command, args []string) {
 	}
 	logger.Info("API Shutdown")
 }
+
+func providerName(config *conf.Config) string {
+	if config.Provider == "" {
+		return api.DefaultProvider
+	}
+	return config.Provider
+}
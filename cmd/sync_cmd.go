@@ -0,0 +1,363 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gojoin/api"
+	"github.com/netlify/gojoin/conf"
+	"github.com/netlify/gojoin/models"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/stripe/stripe-go"
+	"github.com/stripe/stripe-go/customer"
+	"github.com/stripe/stripe-go/sub"
+)
+
+// the actor in the audit log for repairs made by sync
+const syncActor = "sync"
+
+var syncCmd = cobra.Command{
+	Run:   runSync,
+	Use:   "sync",
+	Short: "Find (and optionally repair) differences between the db and stripe",
+}
+
+func runSync(cmd *cobra.Command, args []string) {
+	config, err := conf.LoadConfig(cmd)
+	if err != nil {
+		log.Fatal("Failed to load config: " + err.Error())
+	}
+
+	logger, err := conf.ConfigureLogging(&config.LogConfig)
+	if err != nil {
+		log.Fatal("Failed to configure logging: " + err.Error())
+	}
+
+	repair, err := cmd.Flags().GetBool("repair")
+	if err != nil {
+		logger.Fatal("Failed to read repair flag: " + err.Error())
+	}
+
+	tenantID, err := cmd.Flags().GetString("tenant")
+	if err != nil {
+		logger.Fatal("Failed to read tenant flag: " + err.Error())
+	}
+
+	db, err := models.Connect(&config.DBConfig)
+	if err != nil {
+		logger.Fatal("Failed to connect to db: " + err.Error())
+	}
+
+	if config.MultiTenant {
+		if tenantID == "" {
+			logger.Fatal("The tenant to sync is required in multi-tenant mode")
+		}
+		settings, err := tenantSettings(config, db, tenantID)
+		if err != nil {
+			logger.Fatal("Failed to find tenant: " + err.Error())
+		}
+		config = config.ForTenant(settings)
+	} else {
+		tenantID = ""
+	}
+	if config.Provider != "" && config.Provider != api.DefaultProvider {
+		logger.Fatalf("Sync only works with the %s provider, not %s", api.DefaultProvider, config.Provider)
+	}
+	stripe.Key = config.StripeKey
+
+	s := &syncer{
+		db:       db,
+		log:      logger.WithField("component", "sync"),
+		repair:   repair,
+		tenantID: tenantID,
+	}
+	if err := s.run(); err != nil {
+		logger.WithError(err).Fatal("Failed to sync with stripe")
+	}
+
+	logger.Infof("Finished sync, found %d differences and repaired %d", s.found, s.repaired)
+}
+
+// tenantSettings finds the tenant in the config, or else in the tenants table
+func tenantSettings(config *conf.Config, db *gorm.DB, id string) (conf.TenantConfig, error) {
+	if settings, ok := config.Tenants[id]; ok {
+		return settings, nil
+	}
+	t := new(models.Tenant)
+	if rsp := db.Where("id = ?", id).First(t); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return conf.TenantConfig{}, fmt.Errorf("unknown tenant %s", id)
+		}
+		return conf.TenantConfig{}, rsp.Error
+	}
+	return t.TenantConfig()
+}
+
+// syncer walks the users and subscriptions in the db and compares
+// them to what stripe has. It only changes the db when repair is set,
+// stripe is never modified. With a tenant only its rows are synced.
+type syncer struct {
+	db       *gorm.DB
+	log      *logrus.Entry
+	repair   bool
+	tenantID string
+
+	found    int
+	repaired int
+}
+
+func (s *syncer) run() error {
+	if err := s.syncOrphanedCustomers(); err != nil {
+		return err
+	}
+	if err := s.syncUsers(); err != nil {
+		return err
+	}
+	return s.syncSubscriptions()
+}
+
+// scoped limits a query to the rows of the tenant being synced
+func (s *syncer) scoped() *gorm.DB {
+	if s.tenantID == "" {
+		return s.db
+	}
+	return s.db.Where("tenant_id = ?", s.tenantID)
+}
+
+// drift records a difference, it returns if it should be repaired
+func (s *syncer) drift(log *logrus.Entry, msg string) bool {
+	s.found++
+	if s.repair {
+		log.Warn(msg + ", repairing")
+	} else {
+		log.Warn(msg)
+	}
+	return s.repair
+}
+
+func (s *syncer) repairFailed(log *logrus.Entry, err error) {
+	log.WithError(err).Error("Failed to repair")
+}
+
+// syncOrphanedCustomers finds stripe customers that were created by us, but never
+// made it into the db.
+func (s *syncer) syncOrphanedCustomers() error {
+	i := customer.List(&stripe.CustomerListParams{})
+	for i.Next() {
+		c := i.Customer()
+		userID := c.Meta["nf_id"]
+		if userID == "" {
+			continue
+		}
+
+		log := s.log.WithFields(logrus.Fields{
+			"user_id":   userID,
+			"remote_id": c.ID,
+		})
+
+		user := new(models.User)
+		rsp := s.db.Where("tenant_id = ? AND id = ?", s.tenantID, userID).First(user)
+		if rsp.Error == nil {
+			if user.RemoteID != c.ID {
+				log.WithField("db_remote_id", user.RemoteID).Warn("User is associated with a different stripe customer")
+			}
+			continue
+		}
+		if !rsp.RecordNotFound() {
+			return rsp.Error
+		}
+
+		if !s.drift(log, "Stripe customer has no user in the db") {
+			continue
+		}
+
+		user = &models.User{
+			ID:       userID,
+			Email:    c.Email,
+			RemoteID: c.ID,
+			TenantID: s.tenantID,
+		}
+		if rsp := s.db.Create(user); rsp.Error != nil {
+			s.repairFailed(log, rsp.Error)
+			continue
+		}
+		s.repaired++
+	}
+
+	return i.Err()
+}
+
+// syncUsers checks that every user has a customer in stripe and that all the
+// subscriptions stripe has for that customer are in the db.
+func (s *syncer) syncUsers() error {
+	users := []models.User{}
+	if rsp := s.scoped().Find(&users); rsp.Error != nil {
+		return rsp.Error
+	}
+
+	for _, user := range users {
+		log := s.log.WithFields(logrus.Fields{
+			"user_id":   user.ID,
+			"remote_id": user.RemoteID,
+		})
+
+		c, err := customer.Get(user.RemoteID, nil)
+		if err != nil {
+			if isNotFound(err) {
+				s.found++
+				log.Warn("User has no customer in stripe")
+				continue
+			}
+			return err
+		}
+		if c.Deleted {
+			s.found++
+			log.Warn("User's customer was deleted in stripe")
+			continue
+		}
+
+		known := map[string]bool{}
+		subs := []models.Subscription{}
+		if rsp := s.db.Where("tenant_id = ? AND user_id = ?", user.TenantID, user.ID).Find(&subs); rsp.Error != nil {
+			return rsp.Error
+		}
+		for _, sub := range subs {
+			known[sub.RemoteID] = true
+		}
+
+		i := sub.List(&stripe.SubListParams{Customer: c.ID})
+		for i.Next() {
+			remote := i.Sub()
+			if known[remote.ID] {
+				continue
+			}
+			s.syncMissingSubscription(log.WithField("sub_remote_id", remote.ID), &user, remote)
+		}
+		if err := i.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncMissingSubscription restores a subscription that only exists in stripe. We
+// can only do that if we know which type it is.
+func (s *syncer) syncMissingSubscription(log *logrus.Entry, user *models.User, remote *stripe.Sub) {
+	subType := remote.Meta["nf_type"]
+	if subType == "" || remote.Plan == nil {
+		s.found++
+		log.Warn("Stripe subscription isn't in the db and has no type, it must be repaired by hand")
+		return
+	}
+
+	if !s.drift(log.WithField("type", subType), "Stripe subscription isn't in the db") {
+		return
+	}
+
+	restored := &models.Subscription{
+		UserID:   user.ID,
+		TenantID: user.TenantID,
+		Type:     subType,
+		Plan:     remote.Plan.ID,
+	}
+	remoteSub(restored, remote).Apply(restored)
+	if err := models.CreateSubscription(s.db, restored); err != nil {
+		s.repairFailed(log, err)
+		return
+	}
+	s.audit(log, models.AuditCreate, restored, "")
+	s.repaired++
+}
+
+// syncSubscriptions checks every subscription in the db against stripe
+func (s *syncer) syncSubscriptions() error {
+	subs := []models.Subscription{}
+	if rsp := s.scoped().Preload("Items").Find(&subs); rsp.Error != nil {
+		return rsp.Error
+	}
+
+	for _, existing := range subs {
+		existing := existing
+		log := s.log.WithFields(logrus.Fields{
+			"user_id":   existing.UserID,
+			"type":      existing.Type,
+			"remote_id": existing.RemoteID,
+		})
+
+		remote, err := sub.Get(existing.RemoteID, nil)
+		if err != nil && !isNotFound(err) {
+			return err
+		}
+
+		if remote == nil || remote.Status == stripe.Canceled {
+			if !s.drift(log, "Subscription was canceled in stripe") {
+				continue
+			}
+			if rsp := s.db.Delete(&existing); rsp.Error != nil {
+				s.repairFailed(log, rsp.Error)
+				continue
+			}
+			s.audit(log, models.AuditCancel, &existing, "")
+			s.repaired++
+			continue
+		}
+
+		updated := existing
+		if remote.Plan != nil {
+			updated.Plan = remote.Plan.ID
+		}
+		remoteSub(&existing, remote).Apply(&updated)
+		if updated.Plan == existing.Plan && updated.Status == existing.Status && updated.Quantity == existing.Quantity {
+			continue
+		}
+
+		log = log.WithFields(logrus.Fields{
+			"plan":            existing.Plan,
+			"remote_plan":     updated.Plan,
+			"status":          existing.Status,
+			"remote_status":   updated.Status,
+			"quantity":        existing.Quantity,
+			"remote_quantity": updated.Quantity,
+		})
+		if !s.drift(log, "Subscription is out of date") {
+			continue
+		}
+
+		if err := models.SaveSubscription(s.db, &updated); err != nil {
+			s.repairFailed(log, err)
+			continue
+		}
+		s.audit(log, models.AuditUpdate, &updated, existing.Plan)
+		s.repaired++
+	}
+
+	return nil
+}
+
+// audit records a repair in the audit log, with sync as the actor
+func (s *syncer) audit(log *logrus.Entry, action string, sub *models.Subscription, oldPlan string) {
+	entry := &models.AuditLogEntry{Actor: syncActor, Action: action, OldPlan: oldPlan}
+	if err := models.RecordAudit(s.db, entry, sub); err != nil {
+		log.WithError(err).Warn("Failed to write audit log entry")
+	}
+}
+
+// remoteSub is stripe's version of the subscription. The client can't see that
+// a subscription is paused, so it stays paused while stripe has it as active.
+func remoteSub(existing *models.Subscription, remote *stripe.Sub) *api.RemoteSubscription {
+	r := api.FromStripeSub(remote)
+	if existing.Status == models.StatusPaused && r.Status == models.StatusActive {
+		r.Status = existing.Status
+		r.ResumeAt = existing.ResumeAt
+	}
+	return r
+}
+
+func isNotFound(err error) bool {
+	stripeErr, ok := err.(*stripe.Error)
+	return ok && stripeErr.HTTPStatusCode == http.StatusNotFound
+}
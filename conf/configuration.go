@@ -13,12 +13,86 @@ import (
 
 // Config the application's configuration
 type Config struct {
-	Port           int           `mapstructure:"port" json:"port"`
-	JWTSecret      string        `mapstructure:"jwt_secret" json:"jwt_secret"`
-	AdminGroupName string        `mapstructure:"admin_group_name" json:"admin_group_name"`
-	StripeKey      string        `mapstructure:"stripe_key" json:"stripe_key"`
-	LogConfig      LoggingConfig `mapstructure:"log" json:"log"`
-	DBConfig       DBConfig      `mapstructure:"db" json:"db"`
+	Port                int           `mapstructure:"port" json:"port"`
+	JWTSecret           string        `mapstructure:"jwt_secret" json:"jwt_secret"`
+	AdminGroupName      string        `mapstructure:"admin_group_name" json:"admin_group_name"`
+	Provider            string        `mapstructure:"provider" json:"provider"`
+	ProviderCalls       CallConfig    `mapstructure:"provider_calls" json:"provider_calls"`
+	StripeKey           string        `mapstructure:"stripe_key" json:"stripe_key"`
+	StripeWebhookSecret string        `mapstructure:"stripe_webhook_secret" json:"stripe_webhook_secret"`
+	Plans               PlansConfig   `mapstructure:"plans" json:"plans"`
+	CancelAtPeriodEnd   bool          `mapstructure:"cancel_at_period_end" json:"cancel_at_period_end"`
+	LogConfig           LoggingConfig `mapstructure:"log" json:"log"`
+	DBConfig            DBConfig      `mapstructure:"db" json:"db"`
+
+	// MultiTenant serves many sites from one process, each request is for the
+	// tenant named in the TenantHeader, the one with the request's host or the
+	// one in the aud of the JWT. The tenants come from Tenants and the tenants
+	// table, and replace the secrets, stripe key and plans above.
+	MultiTenant  bool                    `mapstructure:"multi_tenant" json:"multi_tenant"`
+	TenantHeader string                  `mapstructure:"tenant_header" json:"tenant_header"`
+	Tenants      map[string]TenantConfig `mapstructure:"tenants" json:"tenants"`
+}
+
+// TenantConfig are the settings of a single tenant, keyed by the tenant id in
+// Config.Tenants
+type TenantConfig struct {
+	Hosts               []string    `mapstructure:"hosts" json:"hosts"`
+	JWTSecret           string      `mapstructure:"jwt_secret" json:"jwt_secret"`
+	AdminGroupName      string      `mapstructure:"admin_group_name" json:"admin_group_name"`
+	StripeKey           string      `mapstructure:"stripe_key" json:"stripe_key"`
+	StripeWebhookSecret string      `mapstructure:"stripe_webhook_secret" json:"stripe_webhook_secret"`
+	Plans               PlansConfig `mapstructure:"plans" json:"plans"`
+}
+
+// ForTenant is the config for the requests of a tenant. The secrets, key and
+// plans are always the tenant's, the admin group only if it has one.
+func (c *Config) ForTenant(t TenantConfig) *Config {
+	config := *c
+	config.JWTSecret = t.JWTSecret
+	config.StripeKey = t.StripeKey
+	config.StripeWebhookSecret = t.StripeWebhookSecret
+	config.Plans = t.Plans
+	if t.AdminGroupName != "" {
+		config.AdminGroupName = t.AdminGroupName
+	}
+	config.Tenants = nil
+	return &config
+}
+
+// PlansConfig is the plan catalog, it has the plans each subscription type allows
+// keyed by the type and then the plan id. Without it any plan can be used.
+type PlansConfig map[string]map[string]PlanConfig
+
+// Allows is true if the plan can be used for the type
+func (p PlansConfig) Allows(subType, plan string) bool {
+	if len(p) == 0 {
+		return true
+	}
+	_, ok := p[subType][plan]
+	return ok
+}
+
+// PlanConfig are the settings for a single plan. The price is in the smallest
+// unit of the currency and is only shown, stripe's plan is what gets billed.
+type PlanConfig struct {
+	Name     string   `mapstructure:"name" json:"name"`
+	Price    int      `mapstructure:"price" json:"price"`
+	Currency string   `mapstructure:"currency" json:"currency"`
+	Interval string   `mapstructure:"interval" json:"interval"`
+	Features []string `mapstructure:"features" json:"features"`
+
+	// TrialPeriodDays is the free trial new subscribers get
+	TrialPeriodDays int `mapstructure:"trial_period_days" json:"trial_period_days"`
+}
+
+// CallConfig controls the calls to the payment provider. The timeout is for
+// each attempt, failed calls are retried with exponential backoff starting at
+// the retry delay. Set max_retries to -1 to turn retries off.
+type CallConfig struct {
+	TimeoutMs    int `mapstructure:"timeout_ms" json:"timeout_ms"`
+	MaxRetries   int `mapstructure:"max_retries" json:"max_retries"`
+	RetryDelayMs int `mapstructure:"retry_delay_ms" json:"retry_delay_ms"`
 }
 
 type DBConfig struct {
@@ -95,5 +169,23 @@ func validateConfig(config *Config) (*Config, error) {
 		config.Port = 7070
 	}
 
+	calls := &config.ProviderCalls
+	if calls.TimeoutMs == 0 {
+		calls.TimeoutMs = 30000
+	}
+	if calls.MaxRetries == 0 {
+		calls.MaxRetries = 2
+	}
+	if calls.RetryDelayMs == 0 {
+		calls.RetryDelayMs = 500
+	}
+
+	if len(config.Tenants) > 0 {
+		config.MultiTenant = true
+	}
+	if config.MultiTenant && config.TenantHeader == "" {
+		config.TenantHeader = "X-GoJoin-Tenant"
+	}
+
 	return config, nil
 }
@@ -56,6 +56,8 @@ func recursivelySet(val reflect.Value, prefix string) error {
 			thisField.SetString(viper.GetString(tag))
 		case reflect.Bool:
 			thisField.SetBool(viper.GetBool(tag))
+		case reflect.Map:
+			// maps can only come from the config file, they are already unmarshaled
 		default:
 			return fmt.Errorf("unexpected type detected ~ aborting: %s", thisField.Kind())
 		}
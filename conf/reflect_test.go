@@ -40,3 +40,12 @@ func TestNestedValues(t *testing.T) {
 	assert.Equal(t, "i am a simple string", c.Nested.StringVal)
 	assert.Equal(t, true, c.Nested.BoolVal)
 }
+
+func TestMapValuesAreKept(t *testing.T) {
+	c := struct {
+		Plans PlansConfig `json:"plans"`
+	}{Plans: PlansConfig{"membership": {"gold": {TrialPeriodDays: 14}}}}
+
+	assert.Nil(t, recursivelySet(reflect.ValueOf(&c), ""))
+	assert.Equal(t, 14, c.Plans["membership"]["gold"].TrialPeriodDays)
+}
@@ -0,0 +1,76 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// The actions recorded in the audit log
+const (
+	AuditCreate = "create"
+	AuditUpdate = "update"
+	AuditCancel = "cancel"
+
+	// A cancellation at the end of the period is scheduled and can be undone
+	// until then, the cancel itself is recorded when it happens.
+	AuditScheduleCancel = "schedule_cancel"
+	AuditReactivate     = "reactivate"
+
+	AuditPause  = "pause"
+	AuditResume = "resume"
+
+	// A plan change scheduled for the end of the period, the new plan is the
+	// pending one. The change itself is recorded as an update when it happens.
+	AuditScheduleChange = "schedule_change"
+
+	// The payment method actions are changes to the customer, they have no
+	// type or plan and the remote id is the payment method's, or the customer's
+	// when the method was set from a token.
+	AuditPaymentMethod       = "payment_method"
+	AuditAddPaymentMethod    = "add_payment_method"
+	AuditRemovePaymentMethod = "remove_payment_method"
+)
+
+// AuditLogEntry records a single change to a subscription. The actor is the
+// sub of the JWT that made the change, or the name of the system that made it
+// (e.g. stripe for webhooks).
+type AuditLogEntry struct {
+	ID           string `json:"id"`
+	Actor        string `json:"actor"`
+	Admin        bool   `json:"admin"`
+	Action       string `json:"action"`
+	TargetUserID string `json:"target_user_id"`
+	Type         string `json:"type"`
+	OldPlan      string `json:"old_plan,omitempty"`
+	NewPlan      string `json:"new_plan,omitempty"`
+	RequestID    string `json:"request_id,omitempty"`
+	RemoteID     string `json:"remote_id,omitempty"`
+	TenantID     string `gorm:"index;default:''" json:"tenant_id,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (e *AuditLogEntry) BeforeCreate(scope *gorm.Scope) error {
+	e.ID = uuid.NewRandom().String()
+	return scope.SetColumn("ID", e.ID)
+}
+
+func (AuditLogEntry) TableName() string {
+	return tableName("audit_log")
+}
+
+// RecordAudit writes the entry for a change to the subscription
+func RecordAudit(db *gorm.DB, entry *AuditLogEntry, sub *Subscription) error {
+	entry.TargetUserID = sub.UserID
+	entry.Type = sub.Type
+	entry.RemoteID = sub.RemoteID
+	entry.TenantID = sub.TenantID
+	if entry.Action == AuditCancel {
+		entry.OldPlan = sub.Plan
+	} else {
+		entry.NewPlan = sub.Plan
+	}
+	return db.Create(entry).Error
+}
@@ -38,8 +38,72 @@ func Connect(config *conf.DBConfig) (*gorm.DB, error) {
 }
 
 func AutoMigrate(db *gorm.DB) error {
-	return db.AutoMigrate(Subscription{}, User{}).Error
+	if err := dedupeSubscriptions(db); err != nil {
+		return errors.Wrap(err, "removing duplicate subscriptions")
+	}
+	if err := backfillTenants(db); err != nil {
+		return errors.Wrap(err, "setting the tenant of existing rows")
+	}
+	return db.AutoMigrate(Subscription{}, SubscriptionItem{}, User{}, FailedWrite{}, IdempotencyKey{}, AuditLogEntry{}, Tenant{}).Error
+}
+
+// dedupeSubscriptions removes canceled subscriptions that have the same user and
+// type as another one, otherwise the unique index on them can't be created or a
+// missing tenant can't be filled in. The subscription that is still active is
+// kept, or else the last canceled one so we still know the user had one.
+func dedupeSubscriptions(db *gorm.DB) error {
+	table := Subscription{}.TableName()
+	if !db.HasTable(table) {
+		return nil
+	}
+
+	same := "s.user_id = d.user_id AND s.type = d.type"
+	if db.Dialect().HasColumn(table, "tenant_id") {
+		same += " AND COALESCE(s.tenant_id, '') = COALESCE(d.tenant_id, '')"
+	}
+	// mysql can't select from the table it deletes from, unless it is wrapped like this
+	return db.Exec(`DELETE FROM ` + table + ` WHERE id IN (SELECT id FROM (
+		SELECT d.id FROM ` + table + ` d, ` + table + ` s
+		WHERE d.deleted_at IS NOT NULL AND s.id <> d.id AND ` + same + ` AND (
+			s.deleted_at IS NULL OR s.deleted_at > d.deleted_at OR (s.deleted_at = d.deleted_at AND s.id > d.id))
+	) dupes)`).Error
+}
+
+// backfillTenants sets the tenant of rows that were stored before the tenant_id
+// columns had a default. Those rows are from a single tenant, and the queries for
+// an empty tenant_id would miss them.
+func backfillTenants(db *gorm.DB) error {
+	tables := []string{
+		Subscription{}.TableName(),
+		User{}.TableName(),
+		IdempotencyKey{}.TableName(),
+		AuditLogEntry{}.TableName(),
+		FailedWrite{}.TableName(),
+	}
+	for _, table := range tables {
+		if !db.HasTable(table) || !db.Dialect().HasColumn(table, "tenant_id") {
+			continue
+		}
+		if rsp := db.Exec("UPDATE " + table + " SET tenant_id = '' WHERE tenant_id IS NULL"); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return nil
 }
+
+// inTransaction runs fn in a transaction, it is rolled back if fn fails
+func inTransaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	tx := db.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
+
 func tableName(defaultName string) string {
 	if Namespace != "" {
 		return Namespace + "_" + defaultName
@@ -0,0 +1,68 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// The states a failed write can be in
+const (
+	FailedWriteRolledBack = "rolled_back"
+	FailedWritePending    = "pending"
+	FailedWriteResolved   = "resolved"
+	FailedWriteAbandoned  = "abandoned"
+)
+
+// The operations that can fail after the payer was called
+const (
+	OperationCreate = "create"
+	OperationUpdate = "update"
+)
+
+// FailedWrite records a change that succeeded with the payer, but couldn't be
+// written to the db. Either the change was rolled back with the payer, or the
+// write is pending and will be retried using the stored subscription. A create
+// we didn't get an answer for is pending without a remote id, the call to the
+// payer is repeated with the same idempotency key to find out. A write that keeps
+// failing is eventually abandoned.
+type FailedWrite struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	Type      string `json:"type"`
+	Operation string `json:"operation"`
+	RemoteID  string `json:"remote_id"`
+	Status    string `json:"status"`
+	Error     string `json:"error"`
+	Attempts  int    `json:"attempts"`
+	TenantID  string `gorm:"index;default:''" json:"tenant_id,omitempty"`
+
+	// Subscription is the JSON of the subscription we tried to write
+	Subscription string `gorm:"type:text" json:"subscription"`
+	// RemoteCall is the JSON of the create call when its result is unknown
+	RemoteCall string `gorm:"type:text" json:"remote_call,omitempty"`
+
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	ResolvedAt *time.Time `json:"resolved_at,omitempty"`
+}
+
+// HasPendingWrite checks if a write for the user's subscription of the type is
+// still waiting to be retried
+func HasPendingWrite(db *gorm.DB, tenantID, userID, subType string) (bool, error) {
+	count := 0
+	rsp := db.Model(&FailedWrite{}).
+		Where("tenant_id = ? AND user_id = ? AND type = ? AND status = ?", tenantID, userID, subType, FailedWritePending).
+		Count(&count)
+	return count > 0, rsp.Error
+}
+
+func (f *FailedWrite) BeforeCreate(scope *gorm.Scope) error {
+	f.ID = uuid.NewRandom().String()
+	return scope.SetColumn("ID", f.ID)
+}
+
+func (FailedWrite) TableName() string {
+	return tableName("failed_writes")
+}
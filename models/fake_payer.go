@@ -0,0 +1,111 @@
+package models
+
+import "time"
+
+// FakeCustomer is a customer of the fake payment provider
+type FakeCustomer struct {
+	ID             string `json:"id"`
+	UserID         string `json:"user_id"`
+	Email          string `json:"email"`
+	IdempotencyKey string `json:"-" gorm:"column:idempotency_key;index"`
+
+	// DefaultPaymentMethod is the id of a FakePaymentMethod
+	DefaultPaymentMethod string `json:"default_payment_method"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (FakeCustomer) TableName() string {
+	return tableName("fake_customers")
+}
+
+// FakeSubscription is a subscription of the fake payment provider
+type FakeSubscription struct {
+	ID             string     `json:"id"`
+	CustomerID     string     `json:"customer_id"`
+	Type           string     `json:"type"`
+	Plan           string     `json:"plan"`
+	Quantity       int        `json:"quantity"`
+	Status         string     `json:"status"`
+	PeriodStart    time.Time  `json:"period_start"`
+	PeriodEnd      time.Time  `json:"period_end"`
+	TrialEnd       *time.Time `json:"trial_end,omitempty"`
+	ResumeAt       *time.Time `json:"resume_at,omitempty"`
+	Coupon         string     `json:"coupon,omitempty"`
+	CancelAtEnd    bool       `json:"cancel_at_period_end"`
+	CanceledAt     *time.Time `json:"canceled_at,omitempty"`
+	IdempotencyKey string     `json:"-" gorm:"column:idempotency_key;index"`
+
+	// Items are the add-ons, the fake provider saves them itself
+	Items []FakeSubscriptionItem `json:"items,omitempty" gorm:"ForeignKey:SubscriptionID;save_associations:false"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (FakeSubscription) TableName() string {
+	return tableName("fake_subscriptions")
+}
+
+// FakeSubscriptionItem is an add-on of a subscription of the fake payment provider
+type FakeSubscriptionItem struct {
+	ID             string `json:"id"`
+	SubscriptionID string `json:"subscription_id" gorm:"index"`
+	Plan           string `json:"plan"`
+	Quantity       int    `json:"quantity"`
+}
+
+func (FakeSubscriptionItem) TableName() string {
+	return tableName("fake_subscription_items")
+}
+
+// FakePaymentMethod is a card of a customer of the fake payment provider
+type FakePaymentMethod struct {
+	ID             string `json:"id"`
+	CustomerID     string `json:"customer_id" gorm:"index"`
+	Brand          string `json:"brand"`
+	Last4          string `json:"last4"`
+	ExpMonth       int    `json:"exp_month"`
+	ExpYear        int    `json:"exp_year"`
+	IdempotencyKey string `json:"-" gorm:"column:idempotency_key;index"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (FakePaymentMethod) TableName() string {
+	return tableName("fake_payment_methods")
+}
+
+// FakeInvoice is an invoice of the fake payment provider, one is made for the first
+// period of every subscription
+type FakeInvoice struct {
+	ID             string            `json:"id"`
+	CustomerID     string            `json:"customer_id" gorm:"index"`
+	SubscriptionID string            `json:"subscription_id"`
+	Status         string            `json:"status"`
+	Amount         int               `json:"amount"`
+	Currency       string            `json:"currency"`
+	PeriodStart    time.Time         `json:"period_start"`
+	PeriodEnd      time.Time         `json:"period_end"`
+	Lines          []FakeInvoiceLine `json:"lines" gorm:"ForeignKey:InvoiceID;save_associations:false"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (FakeInvoice) TableName() string {
+	return tableName("fake_invoices")
+}
+
+// FakeInvoiceLine is a plan billed on an invoice of the fake payment provider
+type FakeInvoiceLine struct {
+	ID          string `json:"id"`
+	InvoiceID   string `json:"invoice_id" gorm:"index"`
+	Description string `json:"description"`
+	Plan        string `json:"plan"`
+	Quantity    int    `json:"quantity"`
+	Amount      int    `json:"amount"`
+}
+
+func (FakeInvoiceLine) TableName() string {
+	return tableName("fake_invoice_lines")
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+)
+
+// IdempotencyKey stores the response to a request made with an Idempotency-Key
+// header so it can be replayed when the client retries the same request.
+// A StatusCode of 0 means the request is still being processed.
+type IdempotencyKey struct {
+	ID          string `json:"id"`
+	TenantID    string `gorm:"unique_index:idx_idempotency_user_key;default:''" json:"tenant_id,omitempty"`
+	UserID      string `gorm:"unique_index:idx_idempotency_user_key" json:"user_id"`
+	Key         string `gorm:"column:idempotency_key;unique_index:idx_idempotency_user_key" json:"key"`
+	Fingerprint string `json:"fingerprint"`
+	StatusCode  int    `json:"status_code"`
+	Response    string `gorm:"type:text" json:"response"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (k *IdempotencyKey) BeforeCreate(scope *gorm.Scope) error {
+	k.ID = uuid.NewRandom().String()
+	return scope.SetColumn("ID", k.ID)
+}
+
+func (IdempotencyKey) TableName() string {
+	return tableName("idempotency_keys")
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+)
+
+// ErrLocked is returned when the lock is held by someone else
+var ErrLocked = errors.New("lock is held by another request")
+
+// UserLock is an exclusive lock on changing a user's subscriptions. On
+// postgres and mysql it is a db advisory lock, so it works across several
+// instances. Other databases only lock within this process.
+type UserLock struct {
+	name    string
+	tx      *gorm.DB
+	release func() error
+}
+
+var localLocks = struct {
+	sync.Mutex
+	held map[string]bool
+}{held: map[string]bool{}}
+
+// TryLockUser takes the lock for the user of the tenant without waiting. It
+// returns ErrLocked if another request holds it.
+func TryLockUser(db *gorm.DB, tenantID, userID string) (*UserLock, error) {
+	h := fnv.New64a()
+	if tenantID != "" {
+		h.Write([]byte(tenantID + "/"))
+	}
+	h.Write([]byte(userID))
+	key := int64(h.Sum64())
+	lock := &UserLock{name: fmt.Sprintf("gojoin_user_%x", uint64(key))}
+
+	switch db.Dialect().GetName() {
+	case "postgres":
+		// a transaction pins the connection, the lock is released when it ends
+		lock.tx = db.Begin()
+		if err := lock.acquire("SELECT pg_try_advisory_xact_lock(?)", key); err != nil {
+			return nil, err
+		}
+		lock.release = func() error {
+			return lock.tx.Commit().Error
+		}
+	case "mysql":
+		lock.tx = db.Begin()
+		if err := lock.acquire("SELECT GET_LOCK(?, 0)", lock.name); err != nil {
+			return nil, err
+		}
+		lock.release = func() error {
+			if err := lock.tx.Exec("SELECT RELEASE_LOCK(?)", lock.name).Error; err != nil {
+				lock.tx.Rollback()
+				return err
+			}
+			return lock.tx.Commit().Error
+		}
+	default:
+		localLocks.Lock()
+		defer localLocks.Unlock()
+		if localLocks.held[lock.name] {
+			return nil, ErrLocked
+		}
+		localLocks.held[lock.name] = true
+		lock.release = func() error {
+			localLocks.Lock()
+			delete(localLocks.held, lock.name)
+			localLocks.Unlock()
+			return nil
+		}
+	}
+
+	return lock, nil
+}
+
+func (l *UserLock) acquire(query string, arg interface{}) error {
+	if l.tx.Error != nil {
+		return l.tx.Error
+	}
+
+	var acquired bool
+	if err := l.tx.Raw(query, arg).Row().Scan(&acquired); err != nil {
+		l.tx.Rollback()
+		return err
+	}
+	if !acquired {
+		l.tx.Rollback()
+		return ErrLocked
+	}
+	return nil
+}
+
+// Release gives up the lock
+func (l *UserLock) Release() error {
+	return l.release()
+}
@@ -10,15 +10,58 @@ import (
 	"github.com/pborman/uuid"
 )
 
+// The lifecycle states of a subscription, these match the ones stripe uses.
+// Stripe keeps paused subscriptions active and pauses their billing, we give
+// them their own status since they don't grant the plan.
+const (
+	StatusTrialing = "trialing"
+	StatusActive   = "active"
+	StatusPastDue  = "past_due"
+	StatusUnpaid   = "unpaid"
+	StatusCanceled = "canceled"
+	StatusPaused   = "paused"
+)
+
 type Subscription struct {
 	ID   string `gorm:"unique;primary",json:"id"`
-	Type string `json:"type"`
+	Type string `gorm:"unique_index:idx_subscriptions_user_type" json:"type"`
 
 	User   *User  `json:"user,omitempty"`
-	UserID string `json:"user_id,omitempty"`
+	UserID string `gorm:"unique_index:idx_subscriptions_user_type" json:"user_id,omitempty"`
+
+	// TenantID is only set in multi-tenant mode, it is the user's
+	TenantID string `gorm:"index;unique_index:idx_subscriptions_user_type;default:''" json:"tenant_id,omitempty"`
 
 	RemoteID string `json:"remote_id"`
 	Plan     string `json:"plan"`
+	// Quantity is the number of seats that are billed
+	Quantity int `json:"quantity"`
+	// RemoteItemID is the payer's id for the item of the plan, it is needed to
+	// change the plan once there are add-ons
+	RemoteItemID string `json:"remote_item_id,omitempty"`
+
+	// Items are the add-ons billed together with the plan, they are saved with
+	// CreateSubscription and SaveSubscription
+	Items []SubscriptionItem `json:"items,omitempty" gorm:"save_associations:false"`
+
+	Status             string     `json:"status"`
+	CurrentPeriodStart *time.Time `json:"current_period_start,omitempty"`
+	CurrentPeriodEnd   *time.Time `json:"current_period_end,omitempty"`
+	CancelAt           *time.Time `json:"cancel_at,omitempty"`
+	TrialEnd           *time.Time `json:"trial_end,omitempty"`
+	ResumeAt           *time.Time `json:"resume_at,omitempty"`
+
+	// Coupon is the discount applied, PromotionCode the code it was redeemed
+	// with if it wasn't applied directly
+	Coupon        string     `json:"coupon,omitempty"`
+	PromotionCode string     `json:"promotion_code,omitempty"`
+	DiscountEnd   *time.Time `json:"discount_end,omitempty"`
+
+	// A plan change scheduled for the end of the period, it is applied once
+	// PendingChangeAt has passed. A pending quantity of 0 keeps the seats.
+	PendingPlan     string     `json:"pending_plan,omitempty"`
+	PendingQuantity int        `json:"pending_quantity,omitempty"`
+	PendingChangeAt *time.Time `json:"pending_change_at,omitempty"`
 
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
@@ -52,3 +95,115 @@ func (s *Subscription) BeforeCreate(scope *gorm.Scope) error {
 func (Subscription) TableName() string {
 	return tableName("subscriptions")
 }
+
+// SubscriptionItem is an add-on of a subscription, like extra storage or priority
+// support. The plan of the subscription itself isn't one of its items.
+type SubscriptionItem struct {
+	ID             string `gorm:"primary_key" json:"-"`
+	SubscriptionID string `gorm:"index" json:"-"`
+	RemoteID       string `json:"remote_id"`
+	Plan           string `json:"plan"`
+	Quantity       int    `json:"quantity"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (i *SubscriptionItem) BeforeCreate(scope *gorm.Scope) error {
+	i.ID = uuid.NewRandom().String()
+	return scope.SetColumn("ID", i.ID)
+}
+
+func (SubscriptionItem) TableName() string {
+	return tableName("subscription_items")
+}
+
+// CreateSubscription stores a new subscription together with its items. The
+// canceled one of the same type is only purged with the new one taking its
+// place, it tells us the user had a trial.
+func CreateSubscription(db *gorm.DB, sub *Subscription) error {
+	return inTransaction(db, func(tx *gorm.DB) error {
+		if err := PurgeDeletedSubscriptions(tx, sub.TenantID, sub.UserID, sub.Type); err != nil {
+			return err
+		}
+		if rsp := tx.Create(sub); rsp.Error != nil {
+			return rsp.Error
+		}
+		return replaceSubscriptionItems(tx, sub)
+	})
+}
+
+// SaveSubscription stores the changes of a subscription together with its items,
+// if either fails neither is changed
+func SaveSubscription(db *gorm.DB, sub *Subscription) error {
+	return inTransaction(db, func(tx *gorm.DB) error {
+		if rsp := tx.Save(sub); rsp.Error != nil {
+			return rsp.Error
+		}
+		return replaceSubscriptionItems(tx, sub)
+	})
+}
+
+// replaceSubscriptionItems replaces the stored items of the subscription with the
+// ones it has now
+func replaceSubscriptionItems(tx *gorm.DB, sub *Subscription) error {
+	if rsp := tx.Where("subscription_id = ?", sub.ID).Delete(SubscriptionItem{}); rsp.Error != nil {
+		return rsp.Error
+	}
+	for i := range sub.Items {
+		sub.Items[i].SubscriptionID = sub.ID
+		if rsp := tx.Create(&sub.Items[i]); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return nil
+}
+
+// HasPendingChange is true if a plan change is scheduled
+func (s *Subscription) HasPendingChange() bool {
+	return s.PendingPlan != "" && s.PendingChangeAt != nil
+}
+
+// ClearPendingChange drops the scheduled plan change
+func (s *Subscription) ClearPendingChange() {
+	s.PendingPlan = ""
+	s.PendingQuantity = 0
+	s.PendingChangeAt = nil
+}
+
+// DueSubscriptionChanges finds the subscriptions with a scheduled plan change
+// that is due by the time
+func DueSubscriptionChanges(db *gorm.DB, by time.Time) ([]Subscription, error) {
+	subs := []Subscription{}
+	rsp := db.Where("pending_plan <> '' AND pending_change_at <= ?", by).Find(&subs)
+	return subs, rsp.Error
+}
+
+// HadSubscription is true if the user ever had a subscription of the type. The
+// canceled ones are only soft deleted, and purged when a new one replaces them.
+func HadSubscription(db *gorm.DB, tenantID, userID, subType string) (bool, error) {
+	count := 0
+	rsp := db.Unscoped().Model(&Subscription{}).
+		Where("tenant_id = ? AND user_id = ? AND type = ?", tenantID, userID, subType).
+		Count(&count)
+	return count > 0, rsp.Error
+}
+
+// PurgeDeletedSubscriptions removes the canceled subscriptions of a type for the
+// user. There can only be one row per user and type, so this needs to happen
+// before a new subscription of that type is created.
+func PurgeDeletedSubscriptions(db *gorm.DB, tenantID, userID, subType string) error {
+	deleted := db.Unscoped().
+		Where("tenant_id = ? AND user_id = ? AND type = ? AND deleted_at IS NOT NULL", tenantID, userID, subType)
+
+	ids := []string{}
+	if rsp := deleted.Model(&Subscription{}).Pluck("id", &ids); rsp.Error != nil {
+		return rsp.Error
+	}
+	if len(ids) > 0 {
+		if rsp := db.Where("subscription_id IN (?)", ids).Delete(SubscriptionItem{}); rsp.Error != nil {
+			return rsp.Error
+		}
+	}
+	return deleted.Delete(Subscription{}).Error
+}
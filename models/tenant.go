@@ -0,0 +1,52 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/netlify/gojoin/conf"
+)
+
+// Tenant is a site served by a multi-tenant process. Tenants can be added here
+// instead of the config so they don't need a restart. The hosts are comma
+// separated and the plans are the JSON of the plan catalog.
+type Tenant struct {
+	ID                  string `json:"id"`
+	Hosts               string `json:"hosts"`
+	JWTSecret           string `json:"-"`
+	AdminGroupName      string `json:"admin_group_name"`
+	StripeKey           string `json:"-"`
+	StripeWebhookSecret string `json:"-"`
+	Plans               string `gorm:"type:text" json:"plans"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (Tenant) TableName() string {
+	return tableName("tenants")
+}
+
+// TenantConfig are the settings of the tenant as they would be in the config
+func (t *Tenant) TenantConfig() (conf.TenantConfig, error) {
+	c := conf.TenantConfig{
+		JWTSecret:           t.JWTSecret,
+		AdminGroupName:      t.AdminGroupName,
+		StripeKey:           t.StripeKey,
+		StripeWebhookSecret: t.StripeWebhookSecret,
+	}
+	for _, host := range strings.Split(t.Hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			c.Hosts = append(c.Hosts, host)
+		}
+	}
+	if t.Plans != "" {
+		if err := json.Unmarshal([]byte(t.Plans), &c.Plans); err != nil {
+			return c, errors.Wrapf(err, "parsing the plans of tenant %s", t.ID)
+		}
+	}
+	return c, nil
+}
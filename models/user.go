@@ -2,10 +2,13 @@ package models
 
 import "time"
 
+// User is keyed by its tenant and id, each site has its own users
 type User struct {
-	ID       string `json:"id"`
+	ID       string `gorm:"primary_key" json:"id"`
 	Email    string `json:"email"`
 	RemoteID string `json:"remote_id"`
+	// TenantID is only set in multi-tenant mode, it is empty otherwise
+	TenantID string `gorm:"primary_key;default:''" json:"tenant_id,omitempty"`
 
 	CreatedAt time.Time
 	UpdatedAt time.Time